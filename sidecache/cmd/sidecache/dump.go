@@ -0,0 +1,212 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/Trendyol/sidecache/pkg/snapshot"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// runCommand runs the dump and load commands, which copy the entries of the cache backend configured
+// by the environment to and from a snapshot file.
+func runCommand(name string, args []string) error {
+	switch name {
+	case "dump":
+		return runDump(args)
+	case "load":
+		return runLoad(args)
+	default:
+		return fmt.Errorf("unknown command %q, expected dump or load", name)
+	}
+}
+
+// inProcessBackends keep their entries in the sidecar process, so dump and load can't reach them; their
+// replicas are dumped with the dump endpoint instead.
+var inProcessBackends = map[string]bool{
+	cache.BackendMemory: true,
+	cache.BackendDisk:   true,
+	cache.BackendPeer:   true,
+}
+
+func openBackend(cacheKeyPrefix string) (*cache.Backend, invalidation.Index, error) {
+	name := cache.BackendNameFromEnv()
+	if inProcessBackends[name] {
+		return nil, nil, fmt.Errorf("the %s backend is kept in the sidecar process, dump its replicas with %s instead", name, server.DumpPath)
+	}
+
+	backend, err := cache.NewBackend(name, cache.BackendConfig{
+		Logger:  zap.NewNop(),
+		Metrics: metric.NewPrometheus(prometheus.NewRegistry()),
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var index invalidation.Index
+	if backend.NewIndex != nil {
+		index = backend.NewIndex(cacheKeyPrefix)
+	}
+	return backend, index, nil
+}
+
+func runDump(args []string) error {
+	flags := flag.NewFlagSet("dump", flag.ContinueOnError)
+	output := flags.String("o", "", "snapshot file to write, - for stdout")
+	prefix := flags.String("prefix", os.Getenv("CACHE_KEY_PREFIX"), "cache key prefix whose index holds the urls of the entries")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *output == "" {
+		return errors.New("usage: sidecache dump -o <file> [-prefix <cache key prefix>]")
+	}
+
+	backend, index, err := openBackend(*prefix)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	iterable, ok := cache.Iterate(backend.Repository, index)
+	if !ok {
+		return fmt.Errorf("the %s backend can't be iterated", backend.Name)
+	}
+	lookup, _ := index.(invalidation.Lookup)
+
+	var file *os.File
+	if *output == "-" {
+		file = os.Stdout
+	} else {
+		if file, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer file.Close()
+	}
+
+	buffered := bufio.NewWriter(file)
+	count, err := snapshot.Dump(context.Background(), iterable, lookup, buffered)
+	if err == nil {
+		err = buffered.Flush()
+	}
+	if err != nil {
+		if file != os.Stdout {
+			_ = os.Remove(*output)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "dumped %d entries of the %s backend\n", count, backend.Name)
+	return nil
+}
+
+// loadStats counts the records of a snapshot by what happened to them.
+type loadStats struct {
+	loaded, expired, withoutURL, failed int
+}
+
+func runLoad(args []string) error {
+	flags := flag.NewFlagSet("load", flag.ContinueOnError)
+	input := flags.String("i", "", "snapshot file to read, - for stdin")
+	rewritePrefix := flags.String("rewrite-prefix", "", "cache key prefix the keys are rehashed under from their urls")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *input == "" {
+		return errors.New("usage: sidecache load -i <file> [-rewrite-prefix <cache key prefix>]")
+	}
+
+	rewrite := false
+	flags.Visit(func(f *flag.Flag) { rewrite = rewrite || f.Name == "rewrite-prefix" })
+	prefix := os.Getenv("CACHE_KEY_PREFIX")
+	if rewrite {
+		prefix = *rewritePrefix
+	}
+
+	var file *os.File
+	if *input == "-" {
+		file = os.Stdin
+	} else {
+		var err error
+		if file, err = os.Open(*input); err != nil {
+			return err
+		}
+		defer file.Close()
+
+		// the checksum is only known at the end, so a file is verified before anything is loaded
+		if err := readSnapshot(file, func(snapshot.Record) {}); err != nil {
+			return err
+		}
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+	}
+
+	backend, index, err := openBackend(prefix)
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+
+	var stats loadStats
+	err = readSnapshot(file, func(record snapshot.Record) {
+		loadRecord(backend.Repository, index, record, rewrite, prefix, &stats)
+	})
+	fmt.Fprintf(os.Stderr, "loaded %d entries into the %s backend, skipped %d expired, %d without url, %d failed\n",
+		stats.loaded, backend.Name, stats.expired, stats.withoutURL, stats.failed)
+	return err
+}
+
+func readSnapshot(r io.Reader, fn func(record snapshot.Record)) error {
+	reader, err := snapshot.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		fn(record)
+	}
+}
+
+func loadRecord(repository cache.CacheRepository, index invalidation.Index, record snapshot.Record, rewrite bool, prefix string, stats *loadStats) {
+	now := time.Now()
+	if record.Expired(now) {
+		stats.expired++
+		return
+	}
+
+	key := record.Key
+	if rewrite {
+		if record.URL == "" {
+			stats.withoutURL++
+			return
+		}
+		key = server.HashKey(prefix, record.URL)
+	}
+
+	if err := repository.Set(context.Background(), key, record.Value, record.TTL(now)); err != nil {
+		stats.failed++
+		return
+	}
+	if index != nil && record.URL != "" {
+		_ = index.Add(key, record.URL, record.Tags)
+	}
+	stats.loaded++
+}
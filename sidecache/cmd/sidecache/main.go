@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
 	"github.com/Trendyol/sidecache/pkg/server"
 	"github.com/valyala/fasthttp"
 	"go.uber.org/zap"
@@ -20,12 +22,28 @@ const (
 )
 
 func main() {
+	// the image starts the server as `main app`
+	if len(os.Args) > 1 && os.Args[1] != "app" {
+		if err := runCommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	logger, _ := zap.NewProduction()
 	logger.Info("Side cache process started...", zap.String("version", version))
 
 	defer logger.Sync()
 
-	couchbaseRepo := cache.NewCouchbaseRepository()
+	metrics := metric.NewPrometheusClient()
+
+	backend, err := cache.NewBackend(cache.BackendNameFromEnv(), cache.BackendConfig{Logger: logger, Metrics: metrics})
+	if err != nil {
+		logger.Fatal("Cache backend could not be created", zap.Error(err))
+	}
+	defer backend.Close()
+	logger.Info("Cache backend", append([]zap.Field{zap.String("backend", backend.Name)}, backend.Fields...)...)
 
 	mainContainerPort := "8080"
 	logger.Info("Main container port", zap.String("port", mainContainerPort))
@@ -37,10 +55,51 @@ func main() {
 		MaxConns:                  defaultMaxConnectionsPerHost,
 	}
 
-	cacheServer := server.NewServer(couchbaseRepo, proxy, logger)
+	if err := server.ValidateEnv(); err != nil {
+		logger.Fatal("Cache server could not be configured", zap.Error(err))
+	}
+	cacheServer := server.NewServer(backend.Repository, proxy, logger, metrics)
 	logger.Info("Cache key prefix", zap.String("prefix", cacheServer.CacheKeyPrefix))
+	cacheServer.LocalRepo = backend.Local
+	if backend.NewIndex != nil {
+		cacheServer.Index = backend.NewIndex(cacheServer.CacheKeyPrefix)
+	}
+	for prefix, handler := range backend.Handlers {
+		cacheServer.Handle(prefix, handler)
+	}
+
+	if rulesFile := os.Getenv("INVALIDATION_RULES_FILE"); rulesFile != "" {
+		rules, err := invalidation.LoadRules(rulesFile)
+		if err != nil {
+			logger.Fatal("Invalidation rules could not be loaded", zap.String("file", rulesFile), zap.Error(err))
+		}
+		cacheServer.Rules = rules
+		logger.Info("Invalidation rules loaded", zap.Int("count", rules.Len()))
+	}
+
+	preload, err := server.PreloadOptionsFromEnv()
+	if err != nil {
+		logger.Fatal("Cache preload could not be configured", zap.Error(err))
+	}
+	warm, err := server.WarmOptionsFromEnv()
+	if err != nil {
+		logger.Fatal("Cache warming could not be configured", zap.Error(err))
+	}
+	if preload.Enabled() {
+		cacheServer.SetReady(false)
+	}
+	go func() {
+		if preload.Enabled() {
+			cacheServer.Preload(preload)
+		}
+		if warm.URLFile != "" {
+			if _, err := cacheServer.Warm(warm); err != nil {
+				logger.Warn("Cache warming failed", zap.Error(err))
+			}
+		}
+	}()
 
-	stopChan := make(chan os.Signal)
+	stopChan := make(chan os.Signal, 1)
 	signal.Notify(stopChan, os.Interrupt, syscall.SIGTERM)
 
 	cacheServer.Start(stopChan)
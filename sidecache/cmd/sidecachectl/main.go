@@ -0,0 +1,246 @@
+// Command sidecachectl purges, inspects and warms the caches of sidecache replicas and prints their
+// stats. Every command runs against all addresses given by -addr or all ready pods of the -service.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/admin"
+	"github.com/Trendyol/sidecache/pkg/discovery"
+	"github.com/Trendyol/sidecache/pkg/model"
+)
+
+const (
+	defaultPort = 9191
+
+	usage = `usage: sidecachectl [flags] <command> [command flags] [args]
+
+commands:
+  purge <target>...     purge urls, prefix:<path> and tag:<tag> targets
+  inspect <url>         describe the cache entry of a url, its age and expiry
+  keys                  list the recent or top keys
+  stats                 print the readiness, metrics and hit ratio
+  warm [url]...         start warming from urls or the WARM_URLS_FILE of the replicas
+  warm-status           print the warming progress
+
+flags:
+`
+)
+
+// errFailed reports that the command failed on some replicas, whose errors are in the output.
+var errFailed = errors.New("the command failed on some replicas")
+
+type options struct {
+	addresses string
+	service   string
+	port      int
+	kubeAPI   string
+	kubeToken string
+	token     string
+	timeout   time.Duration
+}
+
+func main() {
+	if err := run(os.Args[1:], os.Stdout); err != nil {
+		if err != errFailed {
+			fmt.Fprintln(os.Stderr, err)
+		}
+		os.Exit(1)
+	}
+}
+
+func run(args []string, out io.Writer) error {
+	var opts options
+	flags := flag.NewFlagSet("sidecachectl", flag.ContinueOnError)
+	flags.StringVar(&opts.addresses, "addr", os.Getenv("SIDECACHE_ADDR"), "comma separated host:port addresses of the replicas")
+	flags.StringVar(&opts.service, "service", os.Getenv("SIDECACHE_SERVICE"), "kubernetes service, [namespace/]name, whose ready pods are the replicas")
+	flags.IntVar(&opts.port, "port", defaultPort, "sidecache port of the service pods")
+	flags.StringVar(&opts.kubeAPI, "kube-api", "", "kubernetes api address, e.g. http://127.0.0.1:8001 of kubectl proxy; in cluster when empty")
+	flags.StringVar(&opts.kubeToken, "kube-token", "", "bearer token for -kube-api")
+	flags.StringVar(&opts.token, "token", os.Getenv("SIDECACHE_ADMIN_TOKEN"), "ADMIN_TOKEN of the replicas")
+	flags.DurationVar(&opts.timeout, "timeout", admin.DefaultTimeout, "timeout of each request")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), usage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("no command given")
+	}
+
+	command, err := newCommand(flags.Arg(0), flags.Args()[1:], admin.NewClient(opts.timeout, opts.token))
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	addresses, err := opts.discover(ctx)
+	if err != nil {
+		return err
+	}
+	if len(addresses) == 0 {
+		return errors.New("no replicas found")
+	}
+
+	results := admin.FanOut(ctx, addresses, command.call)
+	output := interface{}(results)
+	if command.summarize != nil {
+		output = command.summarize(results)
+	}
+	if err := writeJSON(out, output); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if result.Error != "" {
+			return errFailed
+		}
+	}
+	return nil
+}
+
+func (opts options) discover(ctx context.Context) ([]string, error) {
+	var source discovery.Discovery
+	switch {
+	case opts.addresses != "":
+		var addresses discovery.Static
+		for _, address := range strings.Split(opts.addresses, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				addresses = append(addresses, address)
+			}
+		}
+		source = addresses
+	case opts.service != "" && opts.kubeAPI != "":
+		namespace, service := "default", opts.service
+		if i := strings.IndexByte(service, '/'); i >= 0 {
+			namespace, service = service[:i], service[i+1:]
+		}
+		source = &discovery.Kubernetes{
+			APIServer: strings.TrimSuffix(opts.kubeAPI, "/"),
+			Token:     opts.kubeToken,
+			Namespace: namespace,
+			Service:   service,
+			Port:      opts.port,
+			Client:    &http.Client{Timeout: opts.timeout},
+		}
+	case opts.service != "":
+		kubernetes, err := discovery.NewKubernetes(opts.service, opts.port)
+		if err != nil {
+			return nil, err
+		}
+		source = kubernetes
+	default:
+		return nil, errors.New("either -addr or -service is required")
+	}
+	return source.Addresses(ctx)
+}
+
+// command is called for every replica; summarize, if set, replaces the results in the output.
+type command struct {
+	call      func(ctx context.Context, address string) (interface{}, error)
+	summarize func(results []admin.Result) interface{}
+}
+
+func newCommand(name string, args []string, client *admin.Client) (command, error) {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	switch name {
+	case "purge":
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		targets := flags.Args()
+		if len(targets) == 0 {
+			return command{}, errors.New("usage: sidecachectl purge <url|prefix:<path>|tag:<tag>>...")
+		}
+		return command{call: func(ctx context.Context, address string) (interface{}, error) {
+			return client.Purge(ctx, address, targets)
+		}}, nil
+	case "inspect":
+		preview := flags.Int("preview", model.DefaultPreviewBytes, "bytes of the body to show")
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		if flags.NArg() != 1 {
+			return command{}, errors.New("usage: sidecachectl inspect [-preview <bytes>] <url>")
+		}
+		url := flags.Arg(0)
+		return command{call: func(ctx context.Context, address string) (interface{}, error) {
+			return client.Inspect(ctx, address, url, *preview)
+		}}, nil
+	case "keys":
+		order := flags.String("order", model.KeysOrderRecent, "recent or top")
+		limit := flags.Int("limit", model.DefaultKeysLimit, "number of keys")
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		return command{call: func(ctx context.Context, address string) (interface{}, error) {
+			return client.Keys(ctx, address, *order, *limit)
+		}}, nil
+	case "stats":
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		return command{
+			call: func(ctx context.Context, address string) (interface{}, error) {
+				return client.Stats(ctx, address)
+			},
+			summarize: summarizeStats,
+		}, nil
+	case "warm":
+		var request model.WarmRequest
+		flags.IntVar(&request.Concurrency, "concurrency", 0, "concurrent fetches of each replica")
+		flags.IntVar(&request.Rate, "rate", 0, "fetches per second of each replica")
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		request.URLs = flags.Args()
+		return command{call: func(ctx context.Context, address string) (interface{}, error) {
+			return client.Warm(ctx, address, request)
+		}}, nil
+	case "warm-status":
+		if err := flags.Parse(args); err != nil {
+			return command{}, err
+		}
+		return command{call: func(ctx context.Context, address string) (interface{}, error) {
+			return client.WarmProgress(ctx, address)
+		}}, nil
+	default:
+		return command{}, fmt.Errorf("unknown command %q", name)
+	}
+}
+
+// statsSummary adds the hit ratio of all replicas to their stats.
+type statsSummary struct {
+	Total    admin.Stats    `json:"total"`
+	Replicas []admin.Result `json:"replicas"`
+}
+
+func summarizeStats(results []admin.Result) interface{} {
+	summary := statsSummary{Replicas: results}
+	summary.Total.Ready = true
+	for _, result := range results {
+		stats, ok := result.Result.(admin.Stats)
+		if !ok || !stats.Ready {
+			summary.Total.Ready = false
+		}
+		summary.Total.Add(stats)
+	}
+	return summary
+}
+
+func writeJSON(out io.Writer, value interface{}) error {
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(value)
+}
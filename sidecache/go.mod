@@ -3,12 +3,14 @@ module github.com/Trendyol/sidecache
 go 1.14
 
 require (
-	github.com/go-redis/redis v6.15.7+incompatible
+	github.com/alicebob/miniredis/v2 v2.14.3
+	github.com/bradfitz/gomemcache v0.0.0-20190913173617-a41fca850d0b
+	github.com/couchbase/gocb/v2 v2.2.5
+	github.com/go-redis/redis/v8 v8.11.4
 	github.com/golang/mock v1.4.3
 	github.com/klauspost/compress v1.13.4
 	github.com/mailru/easyjson v0.7.7
 	github.com/minio/highwayhash v1.0.2
-	github.com/onsi/gomega v1.14.0 // indirect
 	github.com/prometheus/client_golang v1.5.1
 	github.com/stretchr/testify v1.7.0 // indirect
 	github.com/valyala/fasthttp v1.28.0
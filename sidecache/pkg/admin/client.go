@@ -0,0 +1,244 @@
+// Package admin is a client of the sidecache admin endpoints that can address every replica of a
+// deployment at once.
+package admin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/model"
+)
+
+const (
+	DefaultTimeout = 10 * time.Second
+
+	metricPrefix     = "sidecache_"
+	hitsMetric       = `sidecache_cache_request_counter{outcome="hit"}`
+	missesMetric     = `sidecache_cache_request_counter{outcome="miss"}`
+	maxErrorBodySize = 512
+)
+
+// Client calls the admin endpoints of sidecache replicas by their host:port address. Token is the
+// ADMIN_TOKEN of the replicas.
+type Client struct {
+	HTTP  *http.Client
+	Token string
+}
+
+func NewClient(timeout time.Duration, token string) *Client {
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+	return &Client{HTTP: &http.Client{Timeout: timeout}, Token: token}
+}
+
+// Stats are the counters of a replica. Requests are the reads looked up in the cache, hits and misses;
+// writes and requests bypassing the cache aren't counted. Metrics holds every sidecache sample of
+// /metrics by name and labels.
+type Stats struct {
+	Ready    bool               `json:"ready"`
+	Requests float64            `json:"requests"`
+	Hits     float64            `json:"hits"`
+	HitRatio float64            `json:"hitRatio"`
+	Metrics  map[string]float64 `json:"metrics,omitempty"`
+}
+
+// Add sums the requests and hits of other into stats and updates the hit ratio.
+func (stats *Stats) Add(other Stats) {
+	stats.Requests += other.Requests
+	stats.Hits += other.Hits
+	stats.HitRatio = hitRatio(stats.Hits, stats.Requests)
+}
+
+// Purge removes the targets, urls or `prefix:` and `tag:` targets, and returns the number of removed keys.
+func (client *Client) Purge(ctx context.Context, address string, targets []string) (model.PurgeResponse, error) {
+	var result model.PurgeResponse
+	err := client.do(ctx, http.MethodPost, address, "/purge", model.PurgeRequest{Targets: targets}, &result)
+	return result, err
+}
+
+// Inspect describes the cache entry of the url. Urls that aren't cached are no error, their Cached is false.
+func (client *Client) Inspect(ctx context.Context, address, rawURL string, preview int) (model.EntryInfo, error) {
+	query := url.Values{"url": {rawURL}, "preview": {strconv.Itoa(preview)}}
+	resp, err := client.request(ctx, http.MethodGet, address, model.InspectPath+"?"+query.Encode(), nil)
+	if err != nil {
+		return model.EntryInfo{}, err
+	}
+	defer resp.Body.Close()
+
+	// urls that aren't cached are described with 404
+	if resp.StatusCode != http.StatusNotFound {
+		if err := checkStatus(resp); err != nil {
+			return model.EntryInfo{}, err
+		}
+	}
+	var info model.EntryInfo
+	err = json.NewDecoder(resp.Body).Decode(&info)
+	return info, err
+}
+
+// Keys lists the recent or top keys of the replica.
+func (client *Client) Keys(ctx context.Context, address, order string, limit int) ([]model.KeyInfo, error) {
+	query := url.Values{"order": {order}, "limit": {strconv.Itoa(limit)}}
+	var keys []model.KeyInfo
+	err := client.do(ctx, http.MethodGet, address, model.KeysPath+"?"+query.Encode(), nil, &keys)
+	return keys, err
+}
+
+// Warm starts warming the replica, the fields left empty are taken from its environment.
+func (client *Client) Warm(ctx context.Context, address string, request model.WarmRequest) (model.WarmProgress, error) {
+	var progress model.WarmProgress
+	err := client.do(ctx, http.MethodPost, address, model.WarmPath, request, &progress)
+	return progress, err
+}
+
+func (client *Client) WarmProgress(ctx context.Context, address string) (model.WarmProgress, error) {
+	var progress model.WarmProgress
+	err := client.do(ctx, http.MethodGet, address, model.WarmPath, nil, &progress)
+	return progress, err
+}
+
+// Stats reads the readiness and the metrics of the replica.
+func (client *Client) Stats(ctx context.Context, address string) (Stats, error) {
+	resp, err := client.request(ctx, http.MethodGet, address, model.ReadyPath, nil)
+	if err != nil {
+		return Stats{}, err
+	}
+	_ = resp.Body.Close()
+	stats := Stats{Ready: resp.StatusCode == http.StatusOK}
+
+	resp, err = client.request(ctx, http.MethodGet, address, "/metrics", nil)
+	if err != nil {
+		return stats, err
+	}
+	defer resp.Body.Close()
+	if err := checkStatus(resp); err != nil {
+		return stats, err
+	}
+
+	stats.Metrics, err = parseMetrics(resp.Body)
+	if err != nil {
+		return stats, err
+	}
+	stats.Hits = stats.Metrics[hitsMetric]
+	stats.Requests = stats.Hits + stats.Metrics[missesMetric]
+	stats.HitRatio = hitRatio(stats.Hits, stats.Requests)
+	return stats, nil
+}
+
+func hitRatio(hits, requests float64) float64 {
+	if requests == 0 {
+		return 0
+	}
+	return hits / requests
+}
+
+// parseMetrics reads the sidecache samples of the prometheus text format, e.g.
+// `sidecache_cache_tier_hit_counter{tier="l1"} 42`, keyed by the name with its labels.
+func parseMetrics(r io.Reader) (map[string]float64, error) {
+	metrics := make(map[string]float64)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, metricPrefix) {
+			continue
+		}
+		separator := strings.LastIndexByte(line, ' ')
+		if separator < 0 {
+			continue
+		}
+		value, err := strconv.ParseFloat(line[separator+1:], 64)
+		if err != nil {
+			continue
+		}
+		metrics[line[:separator]] = value
+	}
+	return metrics, scanner.Err()
+}
+
+func (client *Client) do(ctx context.Context, method, address, path string, body, result interface{}) error {
+	resp, err := client.request(ctx, method, address, path, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if err := checkStatus(resp); err != nil {
+		return err
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+func (client *Client) request(ctx context.Context, method, address, path string, body interface{}) (*http.Response, error) {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+
+	req, err := http.NewRequest(method, "http://"+address+path, reader)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if client.Token != "" {
+		req.Header.Set(model.AdminTokenHeaderKey, client.Token)
+	}
+	return client.HTTP.Do(req)
+}
+
+func checkStatus(resp *http.Response) error {
+	if resp.StatusCode < http.StatusBadRequest {
+		return nil
+	}
+	message, _ := ioutil.ReadAll(io.LimitReader(resp.Body, maxErrorBodySize))
+	return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+}
+
+// Result is the outcome of a call to a single replica.
+type Result struct {
+	Address string      `json:"address"`
+	Result  interface{} `json:"result,omitempty"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// FanOut calls fn for every address at once and returns the results ordered by address. The result of
+// a failed call is left out.
+func FanOut(ctx context.Context, addresses []string, fn func(ctx context.Context, address string) (interface{}, error)) []Result {
+	results := make([]Result, len(addresses))
+	var wg sync.WaitGroup
+	for i, address := range addresses {
+		wg.Add(1)
+		go func(i int, address string) {
+			defer wg.Done()
+			result, err := fn(ctx, address)
+			if err != nil {
+				results[i] = Result{Address: address, Error: err.Error()}
+				return
+			}
+			results[i] = Result{Address: address, Result: result}
+		}(i, address)
+	}
+	wg.Wait()
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Address < results[j].Address })
+	return results
+}
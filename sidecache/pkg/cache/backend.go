@@ -0,0 +1,446 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	BackendMemory    = "memory"
+	BackendRedis     = "redis"
+	BackendMemcached = "memcached"
+	BackendDisk      = "disk"
+	BackendTiered    = "tiered"
+	BackendCouchbase = "couchbase"
+	BackendSharded   = "sharded"
+	BackendPeer      = "peer"
+)
+
+// BackendConfig carries what the backends share with the server. Metrics is required, the repositories
+// record to it without checking.
+type BackendConfig struct {
+	Logger  *zap.Logger
+	Metrics *metric.Prometheus
+}
+
+// Backend is a repository built from configuration, ready to be served.
+type Backend struct {
+	Name       string
+	Repository CacheRepository
+	// NewIndex creates an invalidation index shared by all replicas, it is nil for backends that are
+	// local to a replica.
+	NewIndex func(cacheKeyPrefix string) invalidation.Index
+	// Local is the part of the cache kept in process by this replica, which snapshots and preloads work
+	// on: the repository of in-process backends, the L1 of tiered and the share of a peer group this
+	// replica keeps. It is nil for backends whose entries are shared by the replicas.
+	Local CacheRepository
+	// Fields describe the backend options for the startup log.
+	Fields []zap.Field
+	// Handlers are served by the cache server next to the cache, by path prefix.
+	Handlers map[string]fasthttp.RequestHandler
+
+	closers []func()
+}
+
+// BackendFactory builds a backend from its environment variables.
+type BackendFactory func(config BackendConfig) (*Backend, error)
+
+var (
+	backendsMu sync.RWMutex
+	backends   = make(map[string]BackendFactory)
+)
+
+func init() {
+	RegisterBackend(BackendMemory, newMemoryBackend)
+	RegisterBackend(BackendRedis, newRedisBackend)
+	RegisterBackend(BackendMemcached, newMemcachedBackend)
+	RegisterBackend(BackendDisk, newDiskBackend)
+	RegisterBackend(BackendTiered, newTieredBackend)
+	RegisterBackend(BackendCouchbase, newCouchbaseBackend)
+	RegisterBackend(BackendSharded, newShardedBackend)
+	RegisterBackend(BackendPeer, newPeerBackend)
+}
+
+// RegisterBackend adds or replaces the factory of a backend name.
+func RegisterBackend(name string, factory BackendFactory) {
+	backendsMu.Lock()
+	defer backendsMu.Unlock()
+	backends[name] = factory
+}
+
+// BackendNames returns the registered backend names in sorted order.
+func BackendNames() []string {
+	backendsMu.RLock()
+	defer backendsMu.RUnlock()
+
+	names := make([]string, 0, len(backends))
+	for name := range backends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// BackendNameFromEnv returns the CACHE_BACKEND variable, memory by default.
+func BackendNameFromEnv() string {
+	return envString("CACHE_BACKEND", BackendMemory)
+}
+
+// NewBackend builds the named backend. Unknown names, malformed environment variables and backends that
+// can't be reached are errors, so a misconfigured sidecar fails on startup instead of running uncached.
+func NewBackend(name string, config BackendConfig) (*Backend, error) {
+	backendsMu.RLock()
+	factory, ok := backends[name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown cache backend %q, known backends: %s", name, strings.Join(BackendNames(), ", "))
+	}
+	if config.Metrics == nil {
+		return nil, errors.New("cache backends require metrics")
+	}
+
+	backend, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("%s cache backend: %w", name, err)
+	}
+	backend.Name = name
+	return backend, nil
+}
+
+// Close releases the connections and background loops of the backend.
+func (backend *Backend) Close() {
+	for i := len(backend.closers) - 1; i >= 0; i-- {
+		backend.closers[i]()
+	}
+}
+
+func newMemoryBackend(config BackendConfig) (*Backend, error) {
+	return newMemoryTier(config, TierMemory)
+}
+
+// newMemoryTier builds a memory backend whose gauges are labelled by tier.
+func newMemoryTier(config BackendConfig, tier string) (*Backend, error) {
+	options, err := MemoryOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	options.Tier = tier
+	repository, err := NewMemoryRepository(options, config.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	return &Backend{
+		Repository: repository,
+		Local:      repository,
+		Fields:     memoryFields(options),
+		closers:    []func(){repository.Close},
+	}, nil
+}
+
+func newRedisBackend(config BackendConfig) (*Backend, error) {
+	options, err := RedisOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	breaker, err := BreakerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	env := &envReader{}
+	indexSize := env.int("INVALIDATION_INDEX_SIZE", invalidation.DefaultIndexSize, 0)
+	if err := env.err(); err != nil {
+		return nil, err
+	}
+
+	repository, err := NewRedisRepository(options)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := ping(repository.Ping, options.DialTimeout); err != nil {
+		_ = repository.Close()
+		return nil, err
+	}
+
+	// the index shares the breaker of the entries, so neither blocks requests while redis is down
+	guarded := NewBreakerRepository(repository, breaker, config.Metrics)
+	return &Backend{
+		Repository: guarded,
+		NewIndex: func(cacheKeyPrefix string) invalidation.Index {
+			return repository.Index(cacheKeyPrefix, indexSize).WithBreaker(guarded)
+		},
+		Fields: append([]zap.Field{
+			zap.String("mode", options.Mode),
+			zap.String("addr", options.Addr),
+			zap.Strings("addrs", options.Addrs),
+		}, breakerFields(breaker)...),
+		closers: []func(){func() { _ = repository.Close() }},
+	}, nil
+}
+
+func newMemcachedBackend(config BackendConfig) (*Backend, error) {
+	options, err := MemcachedOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	breaker, err := BreakerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	repository, err := NewMemcachedRepository(options)
+	if err != nil {
+		return nil, err
+	}
+	if err := ping(repository.Ping, options.Timeout); err != nil {
+		return nil, err
+	}
+	return withBreaker(&Backend{
+		Repository: repository,
+		Fields:     []zap.Field{zap.Strings("servers", options.Servers), zap.Duration("timeout", options.Timeout)},
+	}, breaker, config), nil
+}
+
+// newDiskBackend keeps small entries in memory and sends large entries to disk.
+func newDiskBackend(config BackendConfig) (*Backend, error) {
+	options, err := DiskOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	memory, err := newMemoryBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	disk, err := NewDiskRepository(options, config.Metrics)
+	if err != nil {
+		memory.Close()
+		return nil, err
+	}
+
+	repository := NewSizeRoutedRepository(memory.Repository, disk, options.Threshold)
+	return &Backend{
+		Repository: repository,
+		Local:      repository,
+		Fields: append(memory.Fields,
+			zap.String("dir", options.Dir),
+			zap.Int64("diskMaxBytes", options.MaxBytes),
+			zap.Int("threshold", options.Threshold)),
+		closers: append(memory.closers, disk.Close),
+	}, nil
+}
+
+// newTieredBackend puts the in-memory backend in front of the TIERED_L2_BACKEND, redis by default.
+func newTieredBackend(config BackendConfig) (*Backend, error) {
+	l2Name := envString("TIERED_L2_BACKEND", BackendRedis)
+	switch l2Name {
+	case BackendRedis, BackendMemcached, BackendCouchbase:
+	default:
+		return nil, fmt.Errorf("TIERED_L2_BACKEND must be %s, %s or %s, got %q", BackendRedis, BackendMemcached, BackendCouchbase, l2Name)
+	}
+
+	backendsMu.RLock()
+	l2Factory, ok := backends[l2Name]
+	backendsMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown TIERED_L2_BACKEND %q", l2Name)
+	}
+	options, err := TieredOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	l2, err := l2Factory(config)
+	if err != nil {
+		return nil, err
+	}
+	l1, err := newMemoryTier(config, TierL1)
+	if err != nil {
+		l2.Close()
+		return nil, err
+	}
+
+	fields := append([]zap.Field{zap.String("l2", l2Name), zap.Duration("l1TTL", options.L1TTL)}, l1.Fields...)
+	repository := NewTieredRepository(l1.Repository, l2.Repository, options, config.Metrics)
+	return &Backend{
+		Repository: repository,
+		NewIndex:   l2.NewIndex,
+		Local:      repository.L1(),
+		Handlers:   l2.Handlers,
+		Fields:     append(fields, l2.Fields...),
+		closers:    append(l2.closers, l1.closers...),
+	}, nil
+}
+
+func newCouchbaseBackend(config BackendConfig) (*Backend, error) {
+	options, err := CouchbaseOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	breaker, err := BreakerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	repository, err := NewCouchbaseRepository(options, config.Logger, config.Metrics)
+	if err != nil {
+		return nil, err
+	}
+	return withBreaker(&Backend{
+		Repository: repository,
+		Fields:     []zap.Field{zap.String("host", options.Host), zap.String("bucket", options.Bucket)},
+		closers:    []func(){repository.Close},
+	}, breaker, config), nil
+}
+
+// newShardedBackend spreads the keys over the SHARD_NODES addresses, every node being a standalone
+// server of the SHARD_BACKEND, redis or memcached. Node failures eject the node from the hash ring
+// instead of opening a circuit breaker.
+func newShardedBackend(config BackendConfig) (*Backend, error) {
+	addrs := envList("SHARD_NODES")
+	if len(addrs) == 0 {
+		return nil, errors.New("SHARD_NODES is required")
+	}
+	nodeBackend := envString("SHARD_BACKEND", BackendRedis)
+	options, err := ShardedOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	backend := &Backend{}
+	nodes := make(map[string]CacheRepository, len(addrs))
+	for _, addr := range addrs {
+		node, closer, err := newShardNode(nodeBackend, addr)
+		if err != nil {
+			backend.Close()
+			return nil, fmt.Errorf("shard node %s: %w", addr, err)
+		}
+		nodes[addr] = node
+		if closer != nil {
+			backend.closers = append(backend.closers, closer)
+		}
+	}
+
+	backend.Repository = NewShardedRepository(nodes, options, config.Metrics)
+	backend.Fields = []zap.Field{
+		zap.String("nodeBackend", nodeBackend),
+		zap.Strings("nodes", addrs),
+		zap.Int("replicas", options.Replicas),
+		zap.Int("ejectThreshold", options.EjectThreshold),
+		zap.Duration("ejectTimeout", options.EjectTimeout),
+	}
+	return backend, nil
+}
+
+func newShardNode(nodeBackend, addr string) (CacheRepository, func(), error) {
+	switch nodeBackend {
+	case BackendRedis:
+		options, err := RedisOptionsFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		options.Mode, options.Addr, options.Addrs = RedisModeStandalone, addr, nil
+		repository, err := NewRedisRepository(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		closer := func() { _ = repository.Close() }
+		if err := ping(repository.Ping, options.DialTimeout); err != nil {
+			closer()
+			return nil, nil, err
+		}
+		return repository, closer, nil
+	case BackendMemcached:
+		options, err := MemcachedOptionsFromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		options.Servers = []string{addr}
+		repository, err := NewMemcachedRepository(options)
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := ping(repository.Ping, options.Timeout); err != nil {
+			return nil, nil, err
+		}
+		return repository, nil, nil
+	default:
+		return nil, nil, fmt.Errorf("SHARD_BACKEND must be redis or memcached, got %q", nodeBackend)
+	}
+}
+
+// newPeerBackend shares the in-memory caches of the replicas found by the peer discovery.
+func newPeerBackend(config BackendConfig) (*Backend, error) {
+	options, err := PeerOptionsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	peers, err := PeerDiscoveryFromEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	local, err := newMemoryBackend(config)
+	if err != nil {
+		return nil, err
+	}
+	repository, err := NewPeerRepository(local.Repository, options, config.Logger, config.Metrics)
+	if err != nil {
+		local.Close()
+		return nil, err
+	}
+	repository.Watch(peers)
+
+	return &Backend{
+		Repository: repository,
+		Local:      local.Repository,
+		Fields: append(local.Fields,
+			zap.String("self", options.Self),
+			zap.Strings("peers", repository.Peers()),
+			zap.Int("hotThreshold", options.HotThreshold),
+			zap.Duration("mirrorTTL", options.MirrorTTL)),
+		Handlers: map[string]fasthttp.RequestHandler{PeerPathPrefix: repository.Handler},
+		closers:  append(local.closers, repository.Close),
+	}, nil
+}
+
+// withBreaker wraps the repository of a remote backend in a circuit breaker. The in-process tier of the
+// tiered backend stays outside, so it keeps serving hits while the remote backend is down.
+func withBreaker(backend *Backend, options BreakerOptions, config BackendConfig) *Backend {
+	backend.Repository = NewBreakerRepository(backend.Repository, options, config.Metrics)
+	backend.Fields = append(backend.Fields, breakerFields(options)...)
+	return backend
+}
+
+func breakerFields(options BreakerOptions) []zap.Field {
+	return []zap.Field{
+		zap.Int("breakerThreshold", options.Threshold),
+		zap.Duration("breakerOpenTimeout", options.OpenTimeout),
+	}
+}
+
+// ping checks that a shared backend is reachable on startup.
+func ping(ping func(ctx context.Context) error, timeout time.Duration) error {
+	if timeout <= 0 {
+		timeout = time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return ping(ctx)
+}
+
+func memoryFields(options MemoryOptions) []zap.Field {
+	return []zap.Field{
+		zap.Int64("maxBytes", options.MaxBytes),
+		zap.Int("shards", options.Shards),
+		zap.String("policy", options.Policy),
+	}
+}
@@ -0,0 +1,162 @@
+package cache_test
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+func setEnv(t *testing.T, name, value string) {
+	previous, ok := os.LookupEnv(name)
+	_ = os.Setenv(name, value)
+	t.Cleanup(func() {
+		if ok {
+			_ = os.Setenv(name, previous)
+		} else {
+			_ = os.Unsetenv(name)
+		}
+	})
+}
+
+func newBackend(name string) (*cache.Backend, error) {
+	return cache.NewBackend(name, cache.BackendConfig{
+		Logger:  zap.NewNop(),
+		Metrics: metric.NewPrometheus(prometheus.NewRegistry()),
+	})
+}
+
+func TestNewBackendRejectsInvalidConfiguration(t *testing.T) {
+	if _, err := newBackend("mongodb"); err == nil || !strings.Contains(err.Error(), "memory") {
+		t.Errorf("expected an error listing the known backends, got %v", err)
+	}
+	if _, err := cache.NewBackend(cache.BackendMemory, cache.BackendConfig{Logger: zap.NewNop()}); err == nil {
+		t.Error("expected a backend without metrics to be rejected")
+	}
+
+	for _, size := range []string{"lots", "-5", "0"} {
+		setEnv(t, "MEMORY_CACHE_SIZE_MB", size)
+		if _, err := newBackend(cache.BackendMemory); err == nil || !strings.Contains(err.Error(), "MEMORY_CACHE_SIZE_MB") {
+			t.Errorf("expected an error naming the malformed variable, got %v", err)
+		}
+	}
+	setEnv(t, "MEMORY_CACHE_SIZE_MB", "")
+
+	setEnv(t, "REDIS_MAX_RETRIES", "-1")
+	setEnv(t, "CACHE_BREAKER_OPEN_TIMEOUT", "-1s")
+	if _, err := newBackend(cache.BackendRedis); err == nil || !strings.Contains(err.Error(), "REDIS_MAX_RETRIES") {
+		t.Errorf("expected an error naming the out of range variable, got %v", err)
+	}
+	setEnv(t, "REDIS_MAX_RETRIES", "")
+	if _, err := newBackend(cache.BackendRedis); err == nil || !strings.Contains(err.Error(), "CACHE_BREAKER_OPEN_TIMEOUT") {
+		t.Errorf("expected an error naming the out of range variable, got %v", err)
+	}
+	setEnv(t, "CACHE_BREAKER_OPEN_TIMEOUT", "")
+
+	setEnv(t, "TIERED_L2_BACKEND", cache.BackendTiered)
+	if _, err := newBackend(cache.BackendTiered); err == nil {
+		t.Error("expected a tiered backend in front of itself to be rejected")
+	}
+	for _, l2 := range []string{cache.BackendDisk, cache.BackendPeer} {
+		setEnv(t, "TIERED_L2_BACKEND", l2)
+		if _, err := newBackend(cache.BackendTiered); err == nil || !strings.Contains(err.Error(), "TIERED_L2_BACKEND") {
+			t.Errorf("expected the %s backend to be rejected as the shared tier, got %v", l2, err)
+		}
+	}
+
+	if _, err := newBackend(cache.BackendPeer); err == nil {
+		t.Error("expected a peer backend without peers to be rejected")
+	}
+
+	setEnv(t, "REDIS_ADDR", "127.0.0.1:1")
+	if _, err := newBackend(cache.BackendRedis); err == nil {
+		t.Error("expected an unreachable redis to be rejected")
+	}
+}
+
+func TestNewBackendBuildsTheSelectedBackend(t *testing.T) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+	setEnv(t, "REDIS_ADDR", server.Addr())
+	setEnv(t, "DISK_CACHE_DIR", newDiskDir(t))
+	setEnv(t, "PEER_ADDRS", "127.0.0.1:9191")
+	setEnv(t, "PEER_SELF", "127.0.0.1:9191")
+	setEnv(t, "PEER_TOKEN", "secret")
+
+	for _, name := range []string{cache.BackendMemory, cache.BackendRedis, cache.BackendDisk, cache.BackendTiered, cache.BackendPeer} {
+		backend, err := newBackend(name)
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		ctx := context.Background()
+		if err := backend.Repository.Set(ctx, "key", []byte("value"), 0); err != nil {
+			t.Errorf("%s: %v", name, err)
+		}
+		if value, err := backend.Repository.Get(ctx, "key"); err != nil || string(value) != "value" {
+			t.Errorf("%s: expected value, got %s %v", name, value, err)
+		}
+
+		shared := name == cache.BackendRedis || name == cache.BackendTiered
+		if (backend.NewIndex != nil) != shared {
+			t.Errorf("%s: expected a shared index only for redis backed backends", name)
+		}
+		if (backend.Local != nil) != (name != cache.BackendRedis) {
+			t.Errorf("%s: expected an in-process part for all but the shared backends", name)
+		}
+		backend.Close()
+	}
+}
+
+func TestNewBackendBuildsShardedBackend(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		server, err := miniredis.Run()
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer server.Close()
+		addrs = append(addrs, server.Addr())
+	}
+
+	setEnv(t, "SHARD_NODES", strings.Join(addrs, ","))
+	backend, err := newBackend(cache.BackendSharded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	ctx := context.Background()
+	if err := backend.Repository.Set(ctx, "key", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := backend.Repository.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Errorf("expected value, got %s %v", value, err)
+	}
+
+	setEnv(t, "SHARD_NODES", addrs[0]+",127.0.0.1:1")
+	if _, err := newBackend(cache.BackendSharded); err == nil {
+		t.Error("expected an unreachable shard node to be rejected")
+	}
+}
+
+func TestRegisterBackend(t *testing.T) {
+	cache.RegisterBackend("test", func(config cache.BackendConfig) (*cache.Backend, error) {
+		repo, err := cache.NewMemoryRepository(cache.MemoryOptions{}, config.Metrics)
+		return &cache.Backend{Repository: repo}, err
+	})
+
+	backend, err := newBackend("test")
+	if err != nil || backend.Name != "test" {
+		t.Fatalf("expected the registered backend, got %v %v", backend, err)
+	}
+}
@@ -0,0 +1,233 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+// ErrCircuitOpen is returned without calling the backend while the circuit breaker is open.
+var ErrCircuitOpen = errors.New("cache: circuit breaker is open")
+
+type BreakerState int
+
+func (state BreakerState) String() string {
+	switch state {
+	case BreakerClosed:
+		return "closed"
+	case BreakerHalfOpen:
+		return "half-open"
+	default:
+		return "open"
+	}
+}
+
+type BreakerOptions struct {
+	// Threshold is the number of consecutive failures that opens the breaker.
+	Threshold int
+	// OpenTimeout is how long the breaker stays open before a probe is let through.
+	OpenTimeout time.Duration
+
+	// Deadlines of the single operations, a shorter context deadline takes precedence.
+	GetTimeout    time.Duration
+	SetTimeout    time.Duration
+	RemoveTimeout time.Duration
+}
+
+func BreakerOptionsFromEnv() (BreakerOptions, error) {
+	env := &envReader{}
+	options := BreakerOptions{
+		Threshold:     env.int("CACHE_BREAKER_THRESHOLD", 5, 1),
+		OpenTimeout:   env.duration("CACHE_BREAKER_OPEN_TIMEOUT", 10*time.Second),
+		GetTimeout:    env.duration("CACHE_GET_TIMEOUT", 50*time.Millisecond),
+		SetTimeout:    env.duration("CACHE_SET_TIMEOUT", 100*time.Millisecond),
+		RemoveTimeout: env.duration("CACHE_REMOVE_TIMEOUT", 100*time.Millisecond),
+	}
+	return options, env.err()
+}
+
+// BreakerRepository protects the request path from a slow or failing backend. After Threshold
+// consecutive failures the breaker opens and Get and Set fail with ErrCircuitOpen right away. Once
+// OpenTimeout has passed a single probe is let through: its success closes the breaker, its failure
+// opens it again.
+//
+// Removes are always tried, so invalidations aren't lost while the breaker is open.
+type BreakerRepository struct {
+	repository CacheRepository
+	options    BreakerOptions
+	metrics    *metric.Prometheus
+
+	mu       sync.Mutex
+	state    BreakerState
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func NewBreakerRepository(repository CacheRepository, options BreakerOptions, metrics *metric.Prometheus) *BreakerRepository {
+	if options.Threshold <= 0 {
+		options.Threshold = 5
+	}
+	if options.OpenTimeout <= 0 {
+		options.OpenTimeout = 10 * time.Second
+	}
+	metrics.CacheBreakerStateGauge.Set(float64(BreakerClosed))
+	return &BreakerRepository{repository: repository, options: options, metrics: metrics}
+}
+
+func (breaker *BreakerRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	probe, err := breaker.allow()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := withTimeout(ctx, breaker.options.GetTimeout)
+	defer cancel()
+
+	value, err := breaker.repository.Get(ctx, key)
+	breaker.record(OperationGet, probe, err)
+	return value, err
+}
+
+func (breaker *BreakerRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	probe, err := breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, breaker.options.SetTimeout)
+	defer cancel()
+
+	err = breaker.repository.Set(ctx, key, value, ttl)
+	breaker.record(OperationSet, probe, err)
+	return err
+}
+
+// SetMany batches the writes when the wrapped repository supports it.
+func (breaker *BreakerRepository) SetMany(ctx context.Context, entries []Entry) error {
+	writer, ok := breaker.repository.(BatchWriter)
+	if !ok {
+		for _, entry := range entries {
+			if err := breaker.Set(ctx, entry.Key, entry.Value, entry.TTL); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	probe, err := breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := withTimeout(ctx, breaker.options.SetTimeout)
+	defer cancel()
+
+	err = writer.SetMany(ctx, entries)
+	breaker.record(OperationSet, probe, err)
+	return err
+}
+
+func (breaker *BreakerRepository) Remove(ctx context.Context, key string) error {
+	ctx, cancel := withTimeout(ctx, breaker.options.RemoveTimeout)
+	defer cancel()
+
+	err := breaker.repository.Remove(ctx, key)
+	breaker.record(OperationRemove, false, err)
+	return err
+}
+
+// Do runs an operation on the protected backend besides its entries, e.g. on the invalidation index stored
+// next to them. Like Get and Set it fails with ErrCircuitOpen while the breaker is open, and its failures
+// count towards opening the breaker.
+func (breaker *BreakerRepository) Do(ctx context.Context, operation string, fn func(ctx context.Context) error) error {
+	probe, err := breaker.allow()
+	if err != nil {
+		return err
+	}
+
+	err = fn(ctx)
+	breaker.record(operation, probe, err)
+	return err
+}
+
+// Unwrap returns the protected repository.
+func (breaker *BreakerRepository) Unwrap() CacheRepository {
+	return breaker.repository
+}
+
+func (breaker *BreakerRepository) State() BreakerState {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+	return breaker.state
+}
+
+// allow returns ErrCircuitOpen if the operation must not reach the backend, and whether the operation
+// is the probe of a half-open breaker.
+func (breaker *BreakerRepository) allow() (bool, error) {
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	switch breaker.state {
+	case BreakerClosed:
+		return false, nil
+	case BreakerOpen:
+		if time.Since(breaker.openedAt) < breaker.options.OpenTimeout {
+			return false, ErrCircuitOpen
+		}
+		breaker.setState(BreakerHalfOpen)
+	}
+
+	if breaker.probing {
+		return false, ErrCircuitOpen
+	}
+	breaker.probing = true
+	return true, nil
+}
+
+func (breaker *BreakerRepository) record(operation string, probe bool, err error) {
+	failed := err != nil && !IsNotFound(err)
+	recordBackendError(breaker.metrics, operation, err)
+
+	breaker.mu.Lock()
+	defer breaker.mu.Unlock()
+
+	if probe {
+		breaker.probing = false
+	}
+
+	if !failed {
+		breaker.failures = 0
+		if probe {
+			breaker.setState(BreakerClosed)
+		}
+		return
+	}
+
+	breaker.failures++
+	if probe || (breaker.state == BreakerClosed && breaker.failures >= breaker.options.Threshold) {
+		breaker.openedAt = time.Now()
+		breaker.setState(BreakerOpen)
+	}
+}
+
+func (breaker *BreakerRepository) setState(state BreakerState) {
+	breaker.state = state
+	breaker.metrics.CacheBreakerStateGauge.Set(float64(state))
+}
+
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
@@ -0,0 +1,184 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// flakyRepository fails while down is set and blocks Get until the context is done while slow is set.
+type flakyRepository struct {
+	down    int32
+	slow    int32
+	calls   int32
+	removes int32
+}
+
+func (repository *flakyRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	atomic.AddInt32(&repository.calls, 1)
+	if atomic.LoadInt32(&repository.slow) == 1 {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if atomic.LoadInt32(&repository.down) == 1 {
+		return nil, errors.New("backend down")
+	}
+	return nil, cache.ErrNotFound
+}
+
+func (repository *flakyRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	atomic.AddInt32(&repository.calls, 1)
+	if atomic.LoadInt32(&repository.down) == 1 {
+		return errors.New("backend down")
+	}
+	return nil
+}
+
+func (repository *flakyRepository) Remove(ctx context.Context, key string) error {
+	atomic.AddInt32(&repository.removes, 1)
+	return nil
+}
+
+func newBreakerRepository(repo cache.CacheRepository, options cache.BreakerOptions) (*cache.BreakerRepository, *metric.Prometheus) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	return cache.NewBreakerRepository(repo, options, metrics), metrics
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	repo := &flakyRepository{down: 1}
+	breaker, metrics := newBreakerRepository(repo, cache.BreakerOptions{Threshold: 3, OpenTimeout: time.Hour})
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Get(ctx, "key"); err == nil || err == cache.ErrCircuitOpen {
+			t.Fatalf("expected the backend error, got %v", err)
+		}
+	}
+	if state := breaker.State(); state != cache.BreakerOpen {
+		t.Fatalf("expected the breaker to be open, got %v", state)
+	}
+	if state := testutil.ToFloat64(metrics.CacheBreakerStateGauge); state != float64(cache.BreakerOpen) {
+		t.Errorf("expected the state gauge to be open, got %v", state)
+	}
+
+	if _, err := breaker.Get(ctx, "key"); err != cache.ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if err := breaker.Set(ctx, "key", []byte("value"), 0); err != cache.ErrCircuitOpen {
+		t.Errorf("expected ErrCircuitOpen, got %v", err)
+	}
+	if calls := atomic.LoadInt32(&repo.calls); calls != 3 {
+		t.Errorf("expected the open breaker not to call the backend, got %d calls", calls)
+	}
+
+	if err := breaker.Remove(ctx, "key"); err != nil || atomic.LoadInt32(&repo.removes) != 1 {
+		t.Errorf("expected removes to reach the backend while open, got %v", err)
+	}
+
+	if errors := testutil.ToFloat64(metrics.CacheBackendErrorCounter.WithLabelValues(cache.OperationGet)); errors != 3 {
+		t.Errorf("expected the failures but not the rejected operations to be counted, got %v", errors)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheBackendErrorCounter.WithLabelValues(cache.OperationSet)); errors != 0 {
+		t.Errorf("expected the rejected set not to be counted, got %v", errors)
+	}
+}
+
+func TestBreakerMissesAreNotFailures(t *testing.T) {
+	repo := &flakyRepository{}
+	breaker, metrics := newBreakerRepository(repo, cache.BreakerOptions{Threshold: 1})
+
+	for i := 0; i < 3; i++ {
+		if _, err := breaker.Get(context.Background(), "key"); !cache.IsNotFound(err) {
+			t.Fatalf("expected a miss, got %v", err)
+		}
+	}
+	if state := breaker.State(); state != cache.BreakerClosed {
+		t.Errorf("expected the breaker to stay closed, got %v", state)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheBackendErrorCounter.WithLabelValues(cache.OperationGet)); errors != 0 {
+		t.Errorf("expected misses not to be counted as errors, got %v", errors)
+	}
+}
+
+func TestBreakerProbesWhenHalfOpen(t *testing.T) {
+	repo := &flakyRepository{down: 1}
+	breaker, metrics := newBreakerRepository(repo, cache.BreakerOptions{Threshold: 1, OpenTimeout: 20 * time.Millisecond})
+	ctx := context.Background()
+
+	_, _ = breaker.Get(ctx, "key")
+	time.Sleep(30 * time.Millisecond)
+
+	// a failed probe opens the breaker again
+	if _, err := breaker.Get(ctx, "key"); err == nil || err == cache.ErrCircuitOpen {
+		t.Fatalf("expected the probe to reach the backend, got %v", err)
+	}
+	if _, err := breaker.Get(ctx, "key"); err != cache.ErrCircuitOpen {
+		t.Fatalf("expected the breaker to open again, got %v", err)
+	}
+
+	atomic.StoreInt32(&repo.down, 0)
+	time.Sleep(30 * time.Millisecond)
+	if _, err := breaker.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected the probe to succeed, got %v", err)
+	}
+	if state := breaker.State(); state != cache.BreakerClosed {
+		t.Errorf("expected the successful probe to close the breaker, got %v", state)
+	}
+	if state := testutil.ToFloat64(metrics.CacheBreakerStateGauge); state != float64(cache.BreakerClosed) {
+		t.Errorf("expected the state gauge to be closed, got %v", state)
+	}
+}
+
+func TestBreakerLetsASingleProbeThrough(t *testing.T) {
+	repo := &flakyRepository{down: 1}
+	breaker, _ := newBreakerRepository(repo, cache.BreakerOptions{
+		Threshold:   1,
+		OpenTimeout: 10 * time.Millisecond,
+		GetTimeout:  100 * time.Millisecond,
+	})
+	ctx := context.Background()
+
+	_, _ = breaker.Get(ctx, "key")
+	time.Sleep(20 * time.Millisecond)
+	atomic.StoreInt32(&repo.slow, 1)
+
+	probed := make(chan error)
+	go func() {
+		_, err := breaker.Get(ctx, "key")
+		probed <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	if state := breaker.State(); state != cache.BreakerHalfOpen {
+		t.Errorf("expected the breaker to be half-open during the probe, got %v", state)
+	}
+	if _, err := breaker.Get(ctx, "key"); err != cache.ErrCircuitOpen {
+		t.Errorf("expected other operations to be rejected during the probe, got %v", err)
+	}
+	if err := <-probed; err != context.DeadlineExceeded {
+		t.Errorf("expected the probe to hit the get deadline, got %v", err)
+	}
+	if state := breaker.State(); state != cache.BreakerOpen {
+		t.Errorf("expected the timed out probe to open the breaker, got %v", state)
+	}
+}
+
+func TestBreakerAppliesOperationDeadlines(t *testing.T) {
+	repo := &flakyRepository{slow: 1}
+	breaker, _ := newBreakerRepository(repo, cache.BreakerOptions{GetTimeout: 20 * time.Millisecond})
+
+	start := time.Now()
+	if _, err := breaker.Get(context.Background(), "key"); err != context.DeadlineExceeded {
+		t.Fatalf("expected the get deadline to be exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("expected the get to give up after its deadline, took %v", elapsed)
+	}
+}
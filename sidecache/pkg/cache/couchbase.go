@@ -1,98 +1,219 @@
 package cache
-//
-//import (
-//	"github.com/Trendyol/sidecache/pkg/metric"
-//	"os"
-//	"time"
-//
-//	"go.uber.org/zap"
-//
-//	"gopkg.in/couchbase/gocb.v1"
-//)
-//
-//var (
-//	FiveMinute = time.Minute * 5
-//	lastLoggedTimeStamp time.Time
-//)
-//
-//type CouchbaseRepository struct {
-//	bucket  *gocb.Bucket
-//	logger  *zap.Logger
-//	cluster *gocb.Cluster
-//	metrics *metric.Prometheus
-//}
-//
-//func NewCouchbaseRepository(logger *zap.Logger, metrics *metric.Prometheus) *CouchbaseRepository {
-//	lastLoggedTimeStamp = time.Now().Add(-FiveMinute)
-//	couchbaseHost := os.Getenv("COUCHBASE_HOST")
-//	cluster, err := gocb.Connect("couchbase://" + couchbaseHost)
-//	if err != nil {
-//		logger.Error("Couchbase connection error:", zap.Error(err))
-//		return nil
-//	}
-//
-//	err = cluster.Authenticate(gocb.PasswordAuthenticator{
-//		Username: os.Getenv("COUCHBASE_USERNAME"),
-//		Password: os.Getenv("COUCHBASE_PASSWORD"),
-//	})
-//
-//	if err != nil {
-//		logger.Error("Couchbase authentication error:", zap.Error(err))
-//		return nil
-//	}
-//
-//	cacheBucket, err := cluster.OpenBucket(os.Getenv("BUCKET_NAME"), "")
-//	if err != nil {
-//		logger.Error("Couchbase could not open bucket error:", zap.Error(err))
-//		return nil
-//	}
-//	cacheBucket.SetOperationTimeout(100 * time.Millisecond)
-//
-//	return &CouchbaseRepository{bucket: cacheBucket, logger: logger, cluster: cluster, metrics: metrics}
-//}
-//
-//func (repository *CouchbaseRepository) SetKey(key string, value []byte, ttl int) {
-//	_, err := repository.bucket.Upsert(key, value, uint32(ttl))
-//	if err != nil {
-//		repository.logIfInTime(func() {repository.logger.Warn("Error occurred when Upsert", zap.String("key", key))})
-//	}
-//}
-//
-//func (repository *CouchbaseRepository) Get(key string) []byte {
-//	var data []byte
-//	_, err := repository.bucket.Get(key, &data)
-//
-//	if err != nil && err != gocb.ErrKeyNotFound {
-//		repository.logIfInTime(func() {repository.logger.Warn("Error occurred when Get", zap.String("key", key), zap.Error(err))})
-//	}
-//
-//	return data
-//}
-//
-//func (repository *CouchbaseRepository) Remove(key string) error {
-//	_, err := repository.bucket.Remove(key, 0)
-//	if err != nil {
-//		repository.logIfInTime(func() {repository.logger.Warn("Error occurred when Remove", zap.String("key", key), zap.Error(err))})
-//		if err == gocb.ErrKeyNotFound {
-//			return nil
-//		}
-//		return err
-//	}
-//
-//	return nil
-//}
-//
-//func (repository *CouchbaseRepository) Close() {
-//	if err := repository.cluster.Close(); err != nil {
-//		repository.logger.Error("error while closing couchbase cluster", zap.Error(err))
-//	}
-//}
-//
-//func (repository CouchbaseRepository) logIfInTime(logFunc func()) {
-//	repository.metrics.CacheWarnCounter.Inc()
-//	allowed := time.Since(lastLoggedTimeStamp) > FiveMinute
-//	if allowed {
-//		logFunc()
-//		lastLoggedTimeStamp = time.Now()
-//	}
-//}
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/couchbase/gocb/v2"
+	"go.uber.org/zap"
+)
+
+// couchbaseLogInterval is the least time between two logged warnings.
+const couchbaseLogInterval = 5 * time.Minute
+
+type CouchbaseOptions struct {
+	Host     string
+	Username string
+	Password string
+	Bucket   string
+
+	// Timeout bounds a single key-value operation, a shorter context deadline takes precedence.
+	Timeout        time.Duration
+	ConnectTimeout time.Duration
+}
+
+func CouchbaseOptionsFromEnv() (CouchbaseOptions, error) {
+	env := &envReader{}
+	options := CouchbaseOptions{
+		Host:           envString("COUCHBASE_HOST", ""),
+		Username:       envString("COUCHBASE_USERNAME", ""),
+		Password:       envString("COUCHBASE_PASSWORD", ""),
+		Bucket:         envString("BUCKET_NAME", ""),
+		Timeout:        env.duration("COUCHBASE_TIMEOUT", 100*time.Millisecond),
+		ConnectTimeout: env.duration("COUCHBASE_CONNECT_TIMEOUT", 5*time.Second),
+	}
+	return options, env.err()
+}
+
+// CouchbaseCollection is the part of a couchbase collection used by the repository. Get and Remove
+// return gocb.ErrDocumentNotFound for missing documents.
+type CouchbaseCollection interface {
+	Get(key string, timeout time.Duration) ([]byte, error)
+	Upsert(key string, value []byte, expiry, timeout time.Duration) error
+	Remove(key string, timeout time.Duration) error
+}
+
+// CouchbaseRepository stores entries as binary documents of the default collection, ttls become
+// document expiries. Document ids are the hex encoded keys, so they can be looked up in the Couchbase UI
+// and tools. Backend failures are counted as warnings and logged at most every five minutes.
+type CouchbaseRepository struct {
+	collection CouchbaseCollection
+	cluster    *gocb.Cluster
+	timeout    time.Duration
+	logger     *zap.Logger
+	metrics    *metric.Prometheus
+
+	lastLoggedTimestamp int64
+}
+
+func NewCouchbaseRepository(options CouchbaseOptions, logger *zap.Logger, metrics *metric.Prometheus) (*CouchbaseRepository, error) {
+	if options.Host == "" || options.Bucket == "" {
+		return nil, errors.New("couchbase requires COUCHBASE_HOST and BUCKET_NAME")
+	}
+
+	cluster, err := gocb.Connect("couchbase://"+options.Host, gocb.ClusterOptions{
+		Username: options.Username,
+		Password: options.Password,
+		TimeoutsConfig: gocb.TimeoutsConfig{
+			ConnectTimeout: options.ConnectTimeout,
+			KVTimeout:      options.Timeout,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	bucket := cluster.Bucket(options.Bucket)
+	if err := bucket.WaitUntilReady(options.ConnectTimeout, nil); err != nil {
+		_ = cluster.Close(nil)
+		return nil, err
+	}
+
+	repository := NewCouchbaseRepositoryWithCollection(&gocbCollection{collection: bucket.DefaultCollection()}, options.Timeout, logger, metrics)
+	repository.cluster = cluster
+	return repository, nil
+}
+
+// NewCouchbaseRepositoryWithCollection creates a repository on an already opened collection.
+func NewCouchbaseRepositoryWithCollection(collection CouchbaseCollection, timeout time.Duration, logger *zap.Logger, metrics *metric.Prometheus) *CouchbaseRepository {
+	return &CouchbaseRepository{
+		collection:          collection,
+		timeout:             timeout,
+		logger:              logger,
+		metrics:             metrics,
+		lastLoggedTimestamp: time.Now().Add(-couchbaseLogInterval).UnixNano(),
+	}
+}
+
+func (repository *CouchbaseRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	timeout, err := repository.operationTimeout(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	value, err := repository.collection.Get(couchbaseKey(key), timeout)
+	if errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		repository.logIfInTime("Error occurred when Get", key, err)
+		return nil, err
+	}
+	return value, nil
+}
+
+func (repository *CouchbaseRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	timeout, err := repository.operationTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	if err := repository.collection.Upsert(couchbaseKey(key), value, ttl, timeout); err != nil {
+		repository.logIfInTime("Error occurred when Upsert", key, err)
+		return err
+	}
+	return nil
+}
+
+func (repository *CouchbaseRepository) Remove(ctx context.Context, key string) error {
+	timeout, err := repository.operationTimeout(ctx)
+	if err != nil {
+		return err
+	}
+
+	err = repository.collection.Remove(couchbaseKey(key), timeout)
+	if err == nil || errors.Is(err, gocb.ErrDocumentNotFound) {
+		return nil
+	}
+	repository.logIfInTime("Error occurred when Remove", key, err)
+	return err
+}
+
+func (repository *CouchbaseRepository) Close() {
+	if repository.cluster == nil {
+		return
+	}
+	if err := repository.cluster.Close(nil); err != nil {
+		repository.logger.Error("error while closing couchbase cluster", zap.Error(err))
+	}
+}
+
+// operationTimeout returns the configured timeout, shortened to the context deadline.
+func (repository *CouchbaseRepository) operationTimeout(ctx context.Context) (time.Duration, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	timeout := repository.timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); timeout <= 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	return timeout, nil
+}
+
+func (repository *CouchbaseRepository) logIfInTime(message, key string, err error) {
+	repository.metrics.CacheWarnCounter.Inc()
+
+	last := atomic.LoadInt64(&repository.lastLoggedTimestamp)
+	if time.Since(time.Unix(0, last)) <= couchbaseLogInterval {
+		return
+	}
+	if atomic.CompareAndSwapInt64(&repository.lastLoggedTimestamp, last, time.Now().UnixNano()) {
+		repository.logger.Warn(message, zap.String("key", couchbaseKey(key)), zap.Error(err))
+	}
+}
+
+func couchbaseKey(key string) string {
+	return hex.EncodeToString([]byte(key))
+}
+
+// gocbCollection stores values as they are with the raw binary transcoder.
+type gocbCollection struct {
+	collection *gocb.Collection
+}
+
+func (c *gocbCollection) Get(key string, timeout time.Duration) ([]byte, error) {
+	result, err := c.collection.Get(key, &gocb.GetOptions{
+		Transcoder: gocb.NewRawBinaryTranscoder(),
+		Timeout:    timeout,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	if err := result.Content(&value); err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (c *gocbCollection) Upsert(key string, value []byte, expiry, timeout time.Duration) error {
+	_, err := c.collection.Upsert(key, value, &gocb.UpsertOptions{
+		Expiry:     expiry,
+		Transcoder: gocb.NewRawBinaryTranscoder(),
+		Timeout:    timeout,
+	})
+	return err
+}
+
+func (c *gocbCollection) Remove(key string, timeout time.Duration) error {
+	_, err := c.collection.Remove(key, &gocb.RemoveOptions{Timeout: timeout})
+	return err
+}
@@ -0,0 +1,153 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/couchbase/gocb/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeCouchbaseCollection replaces a live couchbase cluster.
+type fakeCouchbaseCollection struct {
+	mu          sync.Mutex
+	documents   map[string][]byte
+	expiries    map[string]time.Duration
+	lastTimeout time.Duration
+	err         error
+}
+
+func newFakeCouchbaseCollection() *fakeCouchbaseCollection {
+	return &fakeCouchbaseCollection{documents: make(map[string][]byte), expiries: make(map[string]time.Duration)}
+}
+
+func (c *fakeCouchbaseCollection) Get(key string, timeout time.Duration) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastTimeout = timeout
+	if c.err != nil {
+		return nil, c.err
+	}
+	value, ok := c.documents[key]
+	if !ok {
+		return nil, gocb.ErrDocumentNotFound
+	}
+	return value, nil
+}
+
+func (c *fakeCouchbaseCollection) Upsert(key string, value []byte, expiry, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastTimeout = timeout
+	if c.err != nil {
+		return c.err
+	}
+	c.documents[key] = value
+	c.expiries[key] = expiry
+	return nil
+}
+
+func (c *fakeCouchbaseCollection) Remove(key string, timeout time.Duration) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastTimeout = timeout
+	if c.err != nil {
+		return c.err
+	}
+	if _, ok := c.documents[key]; !ok {
+		return gocb.ErrDocumentNotFound
+	}
+	delete(c.documents, key)
+	return nil
+}
+
+func newCouchbaseRepository(collection cache.CouchbaseCollection) (*cache.CouchbaseRepository, *metric.Prometheus, *observer.ObservedLogs) {
+	core, logs := observer.New(zapcore.WarnLevel)
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	return cache.NewCouchbaseRepositoryWithCollection(collection, 100*time.Millisecond, zap.New(core), metrics), metrics, logs
+}
+
+func TestCouchbaseRepositoryGetSetRemove(t *testing.T) {
+	collection := newFakeCouchbaseCollection()
+	repo, metrics, _ := newCouchbaseRepository(collection)
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	if err := repo.Set(ctx, "key", []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if expiry := collection.expiries[hex.EncodeToString([]byte("key"))]; expiry != time.Minute {
+		t.Errorf("expected the ttl to become the expiry of the hex encoded document, got %v", expiry)
+	}
+	if value, err := repo.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("expected value, got %s %v", value, err)
+	}
+
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatalf("expected removing a missing key to succeed, got %v", err)
+	}
+	if warnings := testutil.ToFloat64(metrics.CacheWarnCounter); warnings != 0 {
+		t.Errorf("expected misses not to be warnings, got %v", warnings)
+	}
+}
+
+func TestCouchbaseRepositoryWarningsAreRateLimited(t *testing.T) {
+	collection := newFakeCouchbaseCollection()
+	collection.err = errors.New("timeout")
+	repo, metrics, logs := newCouchbaseRepository(collection)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		if _, err := repo.Get(ctx, "key"); err == nil || cache.IsNotFound(err) {
+			t.Fatalf("expected a backend error instead of a miss, got %v", err)
+		}
+	}
+	if err := repo.Set(ctx, "key", []byte("value"), 0); err == nil {
+		t.Fatal("expected a backend error")
+	}
+
+	if warnings := testutil.ToFloat64(metrics.CacheWarnCounter); warnings != 4 {
+		t.Errorf("expected 4 warnings, got %v", warnings)
+	}
+	if logged := logs.Len(); logged != 1 {
+		t.Errorf("expected a single warning log, got %d", logged)
+	}
+}
+
+func TestCouchbaseRepositoryHonoursContextDeadline(t *testing.T) {
+	collection := newFakeCouchbaseCollection()
+	repo, _, _ := newCouchbaseRepository(collection)
+
+	_, _ = repo.Get(context.Background(), "key")
+	if collection.lastTimeout != 100*time.Millisecond {
+		t.Errorf("expected the operation timeout, got %v", collection.lastTimeout)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, _ = repo.Get(ctx, "key")
+	if collection.lastTimeout > 10*time.Millisecond {
+		t.Errorf("expected the context deadline to shorten the timeout, got %v", collection.lastTimeout)
+	}
+
+	cancel()
+	if _, err := repo.Get(ctx, "key"); err != context.Canceled {
+		t.Errorf("expected the cancelled context error, got %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+package cache
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+const (
+	DefaultDiskCacheSizeMB      = 1024
+	DefaultDiskCacheThresholdKB = 512
+
+	diskFileMagic    = "SDC1"
+	diskHeaderSize   = len(diskFileMagic) + 8 + 4
+	diskChecksumSize = 4
+	diskTempDirName  = "tmp"
+	diskTempPrefix   = "sidecache-"
+	maxDiskKeyLength = 4096
+)
+
+var errCorruptedDiskEntry = errors.New("cache: corrupted disk entry")
+
+type DiskOptions struct {
+	// Dir holds the entries, e.g. an emptyDir volume. It is created if it doesn't exist.
+	Dir      string
+	MaxBytes int64
+	// Threshold is the value size from which a SizeRoutedRepository sends entries to disk.
+	Threshold int
+}
+
+func DiskOptionsFromEnv() (DiskOptions, error) {
+	env := &envReader{}
+	options := DiskOptions{
+		Dir:       envString("DISK_CACHE_DIR", filepath.Join(os.TempDir(), "sidecache")),
+		MaxBytes:  int64(env.int("DISK_CACHE_SIZE_MB", DefaultDiskCacheSizeMB, 1)) << 20,
+		Threshold: env.int("DISK_CACHE_THRESHOLD_KB", DefaultDiskCacheThresholdKB, 1) << 10,
+	}
+	return options, env.err()
+}
+
+// DiskRepository stores every entry in its own file under Dir, named by the sha256 of the key and
+// spread over 256 subdirectories. The least recently used files are deleted once the files exceed
+// MaxBytes.
+//
+// A file is written to Dir/tmp, synced and renamed into place, and its directory is synced before Set
+// returns, so a crash leaves either the old or the new entry. Files carry their key, expiry and a crc32 checksum; on startup the entries are recovered
+// from the files, leftover temporary files are deleted and corrupted files are dropped when read.
+type DiskRepository struct {
+	dir      string
+	maxBytes int64
+	metrics  *metric.Prometheus
+
+	mu      sync.Mutex
+	bytes   int64
+	entries map[string]*diskEntry
+	lru     *list.List
+
+	stop chan struct{}
+	once sync.Once
+}
+
+type diskEntry struct {
+	key       string
+	path      string
+	size      int64
+	expiresAt int64
+	element   *list.Element
+}
+
+func NewDiskRepository(options DiskOptions, metrics *metric.Prometheus) (*DiskRepository, error) {
+	if options.Dir == "" {
+		return nil, errors.New("disk cache requires a directory")
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultDiskCacheSizeMB << 20
+	}
+
+	repository := &DiskRepository{
+		dir:      options.Dir,
+		maxBytes: options.MaxBytes,
+		metrics:  metrics,
+		entries:  make(map[string]*diskEntry),
+		lru:      list.New(),
+		stop:     make(chan struct{}),
+	}
+	if err := repository.recover(); err != nil {
+		return nil, err
+	}
+
+	go repository.expireLoop()
+	return repository, nil
+}
+
+func (repository *DiskRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	repository.mu.Lock()
+	entry, ok := repository.entries[key]
+	if ok && entry.expired(time.Now().UnixNano()) {
+		repository.removeEntry(entry)
+		ok = false
+	}
+	if ok {
+		repository.lru.MoveToFront(entry.element)
+	}
+	repository.mu.Unlock()
+
+	if !ok {
+		return nil, ErrNotFound
+	}
+
+	// The file may be replaced or removed concurrently, a replaced file is read completely either way.
+	data, err := ioutil.ReadFile(entry.path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fileKey, _, value, err := decodeDiskEntry(data)
+	if err != nil || fileKey != key {
+		repository.mu.Lock()
+		if current, ok := repository.entries[key]; ok && current == entry {
+			repository.removeEntry(entry)
+		}
+		repository.mu.Unlock()
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (repository *DiskRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	var expiresAt int64
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+
+	data := encodeDiskEntry(key, expiresAt, value)
+	if int64(len(data)) > repository.maxBytes {
+		return ErrEntryTooLarge
+	}
+
+	temp, err := repository.writeTemp(data)
+	if err != nil {
+		return err
+	}
+
+	entry := &diskEntry{key: key, path: repository.path(key), size: int64(len(data)), expiresAt: expiresAt}
+
+	repository.mu.Lock()
+	if err := os.Rename(temp, entry.path); err != nil {
+		repository.mu.Unlock()
+		_ = os.Remove(temp)
+		return err
+	}
+	if existing, ok := repository.entries[key]; ok {
+		repository.unlinkEntry(existing)
+	}
+	repository.linkEntry(entry)
+
+	for repository.bytes > repository.maxBytes {
+		victim := repository.lru.Back().Value.(*diskEntry)
+		repository.removeEntry(victim)
+		repository.metrics.CacheEvictionCounter.Inc()
+	}
+	repository.mu.Unlock()
+
+	// the rename is only durable once the directory is synced, outside the lock as it may take a while
+	return syncDir(filepath.Dir(entry.path))
+}
+
+func (repository *DiskRepository) Remove(ctx context.Context, key string) error {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if entry, ok := repository.entries[key]; ok {
+		repository.removeEntry(entry)
+	}
+	return nil
+}
+
+// Len returns the number of entries, including expired entries that were not dropped yet.
+func (repository *DiskRepository) Len() int {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	return len(repository.entries)
+}
+
+// Bytes returns the size of all entry files.
+func (repository *DiskRepository) Bytes() int64 {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	return repository.bytes
+}
+
+// Close stops the periodic expiry scan, the files are kept for the next start.
+func (repository *DiskRepository) Close() {
+	repository.once.Do(func() { close(repository.stop) })
+}
+
+func (repository *DiskRepository) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	name := hex.EncodeToString(sum[:])
+	return filepath.Join(repository.dir, name[:2], name)
+}
+
+// syncDir flushes the entries of a directory, e.g. a file renamed into it.
+func syncDir(path string) error {
+	dir, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = dir.Sync()
+	if closeErr := dir.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (repository *DiskRepository) writeTemp(data []byte) (string, error) {
+	file, err := ioutil.TempFile(filepath.Join(repository.dir, diskTempDirName), diskTempPrefix)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		_ = os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// recover creates the directory layout, deletes leftover temporary files and indexes the entry files,
+// oldest modification first in the eviction order.
+func (repository *DiskRepository) recover() error {
+	tempDir := filepath.Join(repository.dir, diskTempDirName)
+	if err := os.RemoveAll(tempDir); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(tempDir, 0755); err != nil {
+		return err
+	}
+
+	type recovered struct {
+		entry   *diskEntry
+		modTime time.Time
+	}
+	var files []recovered
+	now := time.Now().UnixNano()
+
+	// Only files named like entries are touched, in case the directory is shared.
+	for i := 0; i < 256; i++ {
+		subdir := filepath.Join(repository.dir, hex.EncodeToString([]byte{byte(i)}))
+		if err := os.MkdirAll(subdir, 0755); err != nil {
+			return err
+		}
+		infos, err := ioutil.ReadDir(subdir)
+		if err != nil {
+			return err
+		}
+		for _, info := range infos {
+			path := filepath.Join(subdir, info.Name())
+			if info.IsDir() || len(info.Name()) != 2*sha256.Size {
+				continue
+			}
+
+			key, expiresAt, err := readDiskHeader(path)
+			if err != nil || path != repository.path(key) || (expiresAt > 0 && expiresAt <= now) {
+				if err := os.Remove(path); err != nil {
+					return err
+				}
+				continue
+			}
+			files = append(files, recovered{
+				entry:   &diskEntry{key: key, path: path, size: info.Size(), expiresAt: expiresAt},
+				modTime: info.ModTime(),
+			})
+		}
+	}
+	// the subdirectories entries are renamed into must survive a crash as well
+	if err := syncDir(repository.dir); err != nil {
+		return err
+	}
+
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+	for _, file := range files {
+		repository.linkEntry(file.entry)
+	}
+	for repository.bytes > repository.maxBytes {
+		repository.removeEntry(repository.lru.Back().Value.(*diskEntry))
+	}
+	return nil
+}
+
+func (repository *DiskRepository) linkEntry(entry *diskEntry) {
+	entry.element = repository.lru.PushFront(entry)
+	repository.entries[entry.key] = entry
+	repository.bytes += entry.size
+	repository.metrics.CacheDiskSizeBytesGauge.Add(float64(entry.size))
+	repository.metrics.CacheDiskItemsGauge.Inc()
+}
+
+// unlinkEntry forgets an entry whose file was already replaced.
+func (repository *DiskRepository) unlinkEntry(entry *diskEntry) {
+	repository.lru.Remove(entry.element)
+	delete(repository.entries, entry.key)
+	repository.bytes -= entry.size
+	repository.metrics.CacheDiskSizeBytesGauge.Sub(float64(entry.size))
+	repository.metrics.CacheDiskItemsGauge.Dec()
+}
+
+func (repository *DiskRepository) removeEntry(entry *diskEntry) {
+	repository.unlinkEntry(entry)
+	_ = os.Remove(entry.path)
+}
+
+func (repository *DiskRepository) expireLoop() {
+	ticker := time.NewTicker(expiryScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-repository.stop:
+			return
+		case <-ticker.C:
+			repository.removeExpired()
+		}
+	}
+}
+
+func (repository *DiskRepository) removeExpired() {
+	now := time.Now().UnixNano()
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for _, entry := range repository.entries {
+		if entry.expired(now) {
+			repository.removeEntry(entry)
+		}
+	}
+}
+
+func (entry *diskEntry) expired(now int64) bool {
+	return entry.expiresAt > 0 && entry.expiresAt <= now
+}
+
+// encodeDiskEntry lays out an entry file as magic, expiry, key length, key, value and a crc32 of
+// everything before it.
+func encodeDiskEntry(key string, expiresAt int64, value []byte) []byte {
+	data := make([]byte, diskHeaderSize+len(key)+len(value)+diskChecksumSize)
+	copy(data, diskFileMagic)
+	binary.BigEndian.PutUint64(data[4:], uint64(expiresAt))
+	binary.BigEndian.PutUint32(data[12:], uint32(len(key)))
+	copy(data[diskHeaderSize:], key)
+	copy(data[diskHeaderSize+len(key):], value)
+
+	checksum := crc32.ChecksumIEEE(data[:len(data)-diskChecksumSize])
+	binary.BigEndian.PutUint32(data[len(data)-diskChecksumSize:], checksum)
+	return data
+}
+
+func decodeDiskEntry(data []byte) (string, int64, []byte, error) {
+	if len(data) < diskHeaderSize+diskChecksumSize || string(data[:4]) != diskFileMagic {
+		return "", 0, nil, errCorruptedDiskEntry
+	}
+	body := data[:len(data)-diskChecksumSize]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(data[len(body):]) {
+		return "", 0, nil, errCorruptedDiskEntry
+	}
+
+	keyLength := int(binary.BigEndian.Uint32(data[12:]))
+	if diskHeaderSize+keyLength > len(body) {
+		return "", 0, nil, errCorruptedDiskEntry
+	}
+	key := string(body[diskHeaderSize : diskHeaderSize+keyLength])
+	expiresAt := int64(binary.BigEndian.Uint64(data[4:]))
+	return key, expiresAt, body[diskHeaderSize+keyLength:], nil
+}
+
+// readDiskHeader reads the key and expiry of an entry file without reading its value.
+func readDiskHeader(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+
+	header := make([]byte, diskHeaderSize)
+	if _, err := io.ReadFull(file, header); err != nil || !bytes.Equal(header[:4], []byte(diskFileMagic)) {
+		return "", 0, errCorruptedDiskEntry
+	}
+	keyLength := binary.BigEndian.Uint32(header[12:])
+	if keyLength > maxDiskKeyLength {
+		return "", 0, errCorruptedDiskEntry
+	}
+	key := make([]byte, keyLength)
+	if _, err := io.ReadFull(file, key); err != nil {
+		return "", 0, errCorruptedDiskEntry
+	}
+	return string(key), int64(binary.BigEndian.Uint64(header[4:])), nil
+}
@@ -0,0 +1,176 @@
+package cache_test
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newDiskDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sidecache-disk")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func newDiskRepository(t *testing.T, options cache.DiskOptions) (*cache.DiskRepository, *metric.Prometheus) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewDiskRepository(options, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.Close)
+	return repo, metrics
+}
+
+func entryFiles(t *testing.T, dir string) []string {
+	var files []string
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			files = append(files, path)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestDiskRepositoryGetSetRemove(t *testing.T) {
+	repo, metrics := newDiskRepository(t, cache.DiskOptions{Dir: newDiskDir(t), MaxBytes: 1 << 20})
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	value := []byte{0x1f, 0x8b, 0x00, 0xff}
+	if err := repo.Set(ctx, "key", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := repo.Get(ctx, "key"); err != nil || !bytes.Equal(cached, value) {
+		t.Fatalf("expected the value, got %v %v", cached, err)
+	}
+	if items := testutil.ToFloat64(metrics.CacheDiskItemsGauge); items != 1 {
+		t.Errorf("expected 1 item, got %v", items)
+	}
+
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss after remove, got %v", err)
+	}
+}
+
+func TestDiskRepositoryRecoversEntriesOnStartup(t *testing.T) {
+	dir := newDiskDir(t)
+	ctx := context.Background()
+
+	repo, _ := newDiskRepository(t, cache.DiskOptions{Dir: dir, MaxBytes: 1 << 20})
+	_ = repo.Set(ctx, "kept", []byte("value"), time.Hour)
+	_ = repo.Set(ctx, "expiring", []byte("value"), 20*time.Millisecond)
+	_ = repo.Set(ctx, "corrupted", []byte("value"), 0)
+	repo.Close()
+
+	// a write interrupted before its rename
+	if err := ioutil.WriteFile(filepath.Join(dir, "tmp", "sidecache-1234"), []byte("partial"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range entryFiles(t, dir) {
+		data, _ := ioutil.ReadFile(file)
+		if bytes.Contains(data, []byte("corrupted")) {
+			data[len(data)-6] ^= 0xff
+			_ = ioutil.WriteFile(file, data, 0644)
+		}
+	}
+	time.Sleep(40 * time.Millisecond)
+
+	recovered, _ := newDiskRepository(t, cache.DiskOptions{Dir: dir, MaxBytes: 1 << 20})
+	if value, err := recovered.Get(ctx, "kept"); err != nil || string(value) != "value" {
+		t.Errorf("expected the entry to survive a restart, got %s %v", value, err)
+	}
+	if _, err := recovered.Get(ctx, "expiring"); !cache.IsNotFound(err) {
+		t.Errorf("expected the expired entry to be dropped, got %v", err)
+	}
+	if _, err := recovered.Get(ctx, "corrupted"); !cache.IsNotFound(err) {
+		t.Errorf("expected the corrupted entry to be a miss, got %v", err)
+	}
+	if files := entryFiles(t, dir); len(files) != 1 {
+		t.Errorf("expected only the kept entry to be left on disk, got %v", files)
+	}
+}
+
+func TestDiskRepositoryEvictsLeastRecentlyUsed(t *testing.T) {
+	dir := newDiskDir(t)
+	value := make([]byte, 1000)
+	// room for three entries including their headers
+	repo, metrics := newDiskRepository(t, cache.DiskOptions{Dir: dir, MaxBytes: 3 * 1100})
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "a", value, 0)
+	_ = repo.Set(ctx, "b", value, 0)
+	_ = repo.Set(ctx, "c", value, 0)
+	_, _ = repo.Get(ctx, "a")
+	_ = repo.Set(ctx, "d", value, 0)
+
+	if _, err := repo.Get(ctx, "b"); !cache.IsNotFound(err) {
+		t.Errorf("expected the least recently used entry to be evicted, got %v", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, err := repo.Get(ctx, key); err != nil {
+			t.Errorf("expected %s to be cached, got %v", key, err)
+		}
+	}
+	if files := entryFiles(t, dir); len(files) != 3 {
+		t.Errorf("expected the evicted file to be deleted, got %d files", len(files))
+	}
+	if evictions := testutil.ToFloat64(metrics.CacheEvictionCounter); evictions != 1 {
+		t.Errorf("expected 1 eviction, got %v", evictions)
+	}
+	if err := repo.Set(ctx, "huge", make([]byte, 4000), 0); err != cache.ErrEntryTooLarge {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestSizeRoutedRepositorySendsLargeValuesToDisk(t *testing.T) {
+	memory, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer memory.Close()
+	disk, _ := newDiskRepository(t, cache.DiskOptions{Dir: newDiskDir(t), MaxBytes: 1 << 20})
+	repo := cache.NewSizeRoutedRepository(memory, disk, 1024)
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "small", []byte("value"), 0)
+	_ = repo.Set(ctx, "large", make([]byte, 2048), 0)
+
+	if memory.Len() != 1 || disk.Len() != 1 {
+		t.Fatalf("expected one entry per tier, got %d in memory and %d on disk", memory.Len(), disk.Len())
+	}
+	if value, err := repo.Get(ctx, "large"); err != nil || len(value) != 2048 {
+		t.Errorf("expected the large value from disk, got %d bytes %v", len(value), err)
+	}
+
+	// a response that shrank moves back to memory
+	_ = repo.Set(ctx, "large", []byte("value"), 0)
+	if disk.Len() != 0 {
+		t.Errorf("expected the disk copy to be removed, %d entries left", disk.Len())
+	}
+
+	_ = repo.Remove(ctx, "small")
+	_ = repo.Remove(ctx, "large")
+	if memory.Len() != 0 {
+		t.Errorf("expected the entries to be removed, %d left", memory.Len())
+	}
+}
@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envReader reads options from the environment and collects the variables that could not be parsed
+// or are out of range. They are replaced by their defaults, err reports them so the backend isn't built.
+type envReader struct {
+	malformed []string
+}
+
+// int reads a number of at least min.
+func (env *envReader) int(name string, defaultValue, min int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min {
+		env.report(name, raw)
+		return defaultValue
+	}
+	return value
+}
+
+// duration reads a positive duration.
+func (env *envReader) duration(name string, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		env.report(name, raw)
+		return defaultValue
+	}
+	return value
+}
+
+func (env *envReader) report(name, value string) {
+	env.malformed = append(env.malformed, fmt.Sprintf("%s=%q", name, value))
+}
+
+func (env *envReader) err() error {
+	if len(env.malformed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("malformed environment variables: %s", strings.Join(env.malformed, ", "))
+}
+
+func envString(name, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
@@ -0,0 +1,38 @@
+package cache
+
+import (
+	"sync/atomic"
+)
+
+const generationSlots = 4096
+
+// Generations hands out version tokens for cache keys. A fill takes the token of its key
+// before fetching from the upstream and an invalidation bumps it, so a fill that was fetched
+// before an invalidation can tell that its response is stale.
+//
+// Keys share a fixed number of slots to keep memory bounded. A bump on a shared slot only
+// causes an unnecessary skipped fill for the other keys of the slot.
+type Generations struct {
+	slots [generationSlots]uint64
+}
+
+func NewGenerations() *Generations {
+	return &Generations{}
+}
+
+func (generations *Generations) Current(key string) uint64 {
+	return atomic.LoadUint64(&generations.slots[slot(key)])
+}
+
+func (generations *Generations) Bump(key string) {
+	atomic.AddUint64(&generations.slots[slot(key)], 1)
+}
+
+// Changed reports whether the key was invalidated after the token was taken.
+func (generations *Generations) Changed(key string, token uint64) bool {
+	return generations.Current(key) != token
+}
+
+func slot(key string) uint32 {
+	return fnv32a(key) % generationSlots
+}
@@ -0,0 +1,51 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+//go:generate mockgen -source=legacy.go -destination=mock_repository.go -package=cache -mock_names=LegacyCacheRepository=MockCacheRepository
+
+// LegacyCacheRepository is the repository interface used before contexts, ttls and errors
+// were introduced. Use FromLegacy to pass its implementations where a CacheRepository is expected.
+type LegacyCacheRepository interface {
+	SetKey(key string, value []byte)
+	Get(key string) []byte
+	Remove(key string) error
+}
+
+type legacyAdapter struct {
+	repository LegacyCacheRepository
+}
+
+// FromLegacy adapts a LegacyCacheRepository to CacheRepository. Contexts and ttls are ignored
+// and a nil value is reported as ErrNotFound.
+func FromLegacy(repository LegacyCacheRepository) CacheRepository {
+	return &legacyAdapter{repository: repository}
+}
+
+func (adapter *legacyAdapter) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	value := adapter.repository.Get(key)
+	if value == nil {
+		return nil, ErrNotFound
+	}
+	return value, nil
+}
+
+func (adapter *legacyAdapter) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	adapter.repository.SetKey(key, value)
+	return nil
+}
+
+func (adapter *legacyAdapter) Remove(ctx context.Context, key string) error {
+	return adapter.repository.Remove(key)
+}
@@ -0,0 +1,285 @@
+package cache
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/hashring"
+	"github.com/bradfitz/gomemcache/memcache"
+)
+
+const (
+	// memcached treats expirations above 30 days as unix timestamps.
+	memcachedMaxRelativeExpiration = 30 * 24 * time.Hour
+
+	// flagChunked marks an item whose value is a manifest of the chunks holding the real value.
+	flagChunked = 1
+)
+
+type MemcachedOptions struct {
+	Servers      []string
+	Timeout      time.Duration
+	MaxIdleConns int
+	// MaxItemSize is the largest value stored as a single item, larger values are split into chunks.
+	// It must stay below the item size limit of the servers (-I, 1MB by default).
+	MaxItemSize int
+}
+
+func MemcachedOptionsFromEnv() (MemcachedOptions, error) {
+	servers := envList("MEMCACHED_SERVERS")
+	if len(servers) == 0 {
+		servers = []string{"127.0.0.1:11211"}
+	}
+	env := &envReader{}
+	options := MemcachedOptions{
+		Servers:      servers,
+		Timeout:      env.duration("MEMCACHED_TIMEOUT", 100*time.Millisecond),
+		MaxIdleConns: env.int("MEMCACHED_MAX_IDLE_CONNS", 100, 1),
+		MaxItemSize:  env.int("MEMCACHED_MAX_ITEM_SIZE", 1000*1024, 1),
+	}
+	return options, env.err()
+}
+
+// MemcachedRepository distributes entries over the servers by consistent hashing, so adding or removing
+// a server only moves a small share of the keys.
+//
+// Keys are hex encoded since memcached keys can't contain control characters or spaces. The client has no
+// context support, operations are bounded by the Timeout option instead.
+type MemcachedRepository struct {
+	client      *memcache.Client
+	maxItemSize int
+}
+
+func NewMemcachedRepository(options MemcachedOptions) (*MemcachedRepository, error) {
+	selector, err := newRingSelector(options.Servers)
+	if err != nil {
+		return nil, err
+	}
+
+	client := memcache.NewFromSelector(selector)
+	client.Timeout = options.Timeout
+	client.MaxIdleConns = options.MaxIdleConns
+
+	maxItemSize := options.MaxItemSize
+	if maxItemSize <= 0 {
+		maxItemSize = 1000 * 1024
+	}
+	return &MemcachedRepository{client: client, maxItemSize: maxItemSize}, nil
+}
+
+func (repository *MemcachedRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	item, err := repository.client.Get(memcachedKey(key))
+	if err != nil {
+		return nil, memcachedError(err)
+	}
+	if item.Flags&flagChunked == 0 {
+		return item.Value, nil
+	}
+
+	chunkKeys, err := parseManifest(memcachedKey(key), item.Value)
+	if err != nil {
+		return nil, err
+	}
+	chunks, err := repository.client.GetMulti(chunkKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	var value []byte
+	for _, chunkKey := range chunkKeys {
+		chunk, ok := chunks[chunkKey]
+		if !ok {
+			// a chunk was evicted, the entry is lost
+			return nil, ErrNotFound
+		}
+		value = append(value, chunk.Value...)
+	}
+	return value, nil
+}
+
+func (repository *MemcachedRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	expiration := memcachedExpiration(ttl)
+	if len(value) <= repository.maxItemSize {
+		return repository.client.Set(&memcache.Item{Key: memcachedKey(key), Value: value, Expiration: expiration})
+	}
+
+	// Chunks are written under a fresh id before the manifest, so readers never see a manifest of a
+	// concurrent write pointing to chunks that aren't there yet.
+	id, err := newChunkID()
+	if err != nil {
+		return err
+	}
+	count := (len(value) + repository.maxItemSize - 1) / repository.maxItemSize
+	for i := 0; i < count; i++ {
+		end := (i + 1) * repository.maxItemSize
+		if end > len(value) {
+			end = len(value)
+		}
+		chunk := &memcache.Item{
+			Key:        chunkKey(memcachedKey(key), id, i),
+			Value:      value[i*repository.maxItemSize : end],
+			Expiration: expiration,
+		}
+		if err := repository.client.Set(chunk); err != nil {
+			return err
+		}
+	}
+
+	return repository.client.Set(&memcache.Item{
+		Key:        memcachedKey(key),
+		Value:      []byte(strconv.Itoa(count) + " " + id),
+		Flags:      flagChunked,
+		Expiration: expiration,
+	})
+}
+
+// Remove deletes the entry and, best effort, its chunks. Chunks left behind expire with the entry or
+// are evicted by memcached.
+func (repository *MemcachedRepository) Remove(ctx context.Context, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	item, err := repository.client.Get(memcachedKey(key))
+	if err != nil {
+		return ignoreCacheMiss(err)
+	}
+	if err := ignoreCacheMiss(repository.client.Delete(memcachedKey(key))); err != nil {
+		return err
+	}
+
+	if item.Flags&flagChunked != 0 {
+		chunkKeys, err := parseManifest(memcachedKey(key), item.Value)
+		if err != nil {
+			return nil
+		}
+		for _, chunkKey := range chunkKeys {
+			_ = repository.client.Delete(chunkKey)
+		}
+	}
+	return nil
+}
+
+// Ping checks that every server is reachable.
+func (repository *MemcachedRepository) Ping(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return repository.client.Ping()
+}
+
+func memcachedKey(key string) string {
+	return hex.EncodeToString([]byte(key))
+}
+
+func chunkKey(key, id string, i int) string {
+	return key + ":" + id + ":" + strconv.Itoa(i)
+}
+
+func newChunkID() (string, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+func parseManifest(key string, manifest []byte) ([]string, error) {
+	fields := strings.Fields(string(manifest))
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("memcached: malformed chunk manifest %q", manifest)
+	}
+	count, err := strconv.Atoi(fields[0])
+	if err != nil || count <= 0 {
+		return nil, fmt.Errorf("memcached: malformed chunk manifest %q", manifest)
+	}
+
+	keys := make([]string, count)
+	for i := range keys {
+		keys[i] = chunkKey(key, fields[1], i)
+	}
+	return keys, nil
+}
+
+// memcachedExpiration converts a ttl to memcached seconds, rounding up so that short ttls don't mean
+// no expiration.
+func memcachedExpiration(ttl time.Duration) int32 {
+	if ttl <= 0 {
+		return 0
+	}
+	if ttl > memcachedMaxRelativeExpiration {
+		return int32(time.Now().Add(ttl).Unix())
+	}
+	return int32((ttl + time.Second - 1) / time.Second)
+}
+
+func memcachedError(err error) error {
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func ignoreCacheMiss(err error) error {
+	if errors.Is(err, memcache.ErrCacheMiss) {
+		return nil
+	}
+	return err
+}
+
+// ringSelector is a memcache.ServerSelector picking servers by consistent hashing instead of the
+// modulo hashing of memcache.ServerList.
+type ringSelector struct {
+	ring  *hashring.Ring
+	addrs map[string]net.Addr
+}
+
+func newRingSelector(servers []string) (*ringSelector, error) {
+	if len(servers) == 0 {
+		return nil, errors.New("memcached requires at least one server")
+	}
+
+	addrs := make(map[string]net.Addr, len(servers))
+	for _, server := range servers {
+		var addr net.Addr
+		var err error
+		if strings.Contains(server, "/") {
+			addr, err = net.ResolveUnixAddr("unix", server)
+		} else {
+			addr, err = net.ResolveTCPAddr("tcp", server)
+		}
+		if err != nil {
+			return nil, err
+		}
+		addrs[server] = addr
+	}
+	return &ringSelector{ring: hashring.New(hashring.DefaultReplicas, servers...), addrs: addrs}, nil
+}
+
+func (selector *ringSelector) PickServer(key string) (net.Addr, error) {
+	return selector.addrs[selector.ring.Get(key)], nil
+}
+
+func (selector *ringSelector) Each(f func(net.Addr) error) error {
+	for _, addr := range selector.addrs {
+		if err := f(addr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
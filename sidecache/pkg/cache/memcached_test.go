@@ -0,0 +1,266 @@
+package cache_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+)
+
+// fakeMemcached speaks the part of the memcached text protocol used by the repository.
+type fakeMemcached struct {
+	listener net.Listener
+
+	mu    sync.Mutex
+	items map[string]fakeMemcachedItem
+}
+
+type fakeMemcachedItem struct {
+	value      []byte
+	flags      string
+	expiration int64
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeMemcached{listener: listener, items: make(map[string]fakeMemcachedItem)}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (server *fakeMemcached) Addr() string {
+	return server.listener.Addr().String()
+}
+
+func (server *fakeMemcached) Len() int {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return len(server.items)
+}
+
+func (server *fakeMemcached) Expiration(key string) int64 {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.items[key].expiration
+}
+
+func (server *fakeMemcached) Delete(key string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	delete(server.items, key)
+}
+
+func (server *fakeMemcached) Keys() []string {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	keys := make([]string, 0, len(server.items))
+	for key := range server.items {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func (server *fakeMemcached) serve(conn net.Conn) {
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+
+	for {
+		line, err := rw.ReadString('\n')
+		if err != nil {
+			return
+		}
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+
+		server.mu.Lock()
+		switch fields[0] {
+		case "get", "gets":
+			for _, key := range fields[1:] {
+				if item, ok := server.items[key]; ok {
+					fmt.Fprintf(rw, "VALUE %s %s %d 0\r\n", key, item.flags, len(item.value))
+					rw.Write(item.value)
+					rw.WriteString("\r\n")
+				}
+			}
+			rw.WriteString("END\r\n")
+		case "set":
+			size, _ := strconv.Atoi(fields[4])
+			expiration, _ := strconv.ParseInt(fields[3], 10, 64)
+			value := make([]byte, size+2)
+			if _, err := io.ReadFull(rw, value); err != nil {
+				server.mu.Unlock()
+				return
+			}
+			server.items[fields[1]] = fakeMemcachedItem{value: value[:size], flags: fields[2], expiration: expiration}
+			rw.WriteString("STORED\r\n")
+		case "delete":
+			if _, ok := server.items[fields[1]]; ok {
+				delete(server.items, fields[1])
+				rw.WriteString("DELETED\r\n")
+			} else {
+				rw.WriteString("NOT_FOUND\r\n")
+			}
+		default:
+			rw.WriteString("ERROR\r\n")
+		}
+		server.mu.Unlock()
+
+		if err := rw.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func newMemcachedRepository(t *testing.T, maxItemSize int, servers ...*fakeMemcached) *cache.MemcachedRepository {
+	addrs := make([]string, 0, len(servers))
+	for _, server := range servers {
+		addrs = append(addrs, server.Addr())
+	}
+	repo, err := cache.NewMemcachedRepository(cache.MemcachedOptions{
+		Servers:     addrs,
+		Timeout:     time.Second,
+		MaxItemSize: maxItemSize,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo
+}
+
+func TestMemcachedRepositoryGetSetRemove(t *testing.T) {
+	server := newFakeMemcached(t)
+	repo := newMemcachedRepository(t, 0, server)
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	value := []byte{0x1f, 0x8b, 0x00, 0xff, '\r', '\n'}
+	if err := repo.Set(ctx, "binary\x00key with spaces", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := repo.Get(ctx, "binary\x00key with spaces"); err != nil || !bytes.Equal(cached, value) {
+		t.Fatalf("expected the value to be stored as it is, got %v %v", cached, err)
+	}
+
+	if err := repo.Remove(ctx, "binary\x00key with spaces"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Remove(ctx, "binary\x00key with spaces"); err != nil {
+		t.Fatalf("expected removing a missing key to succeed, got %v", err)
+	}
+	if _, err := repo.Get(ctx, "binary\x00key with spaces"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss after remove, got %v", err)
+	}
+}
+
+func TestMemcachedRepositoryConvertsTTL(t *testing.T) {
+	server := newFakeMemcached(t)
+	repo := newMemcachedRepository(t, 0, server)
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "short", []byte("value"), 1500*time.Millisecond)
+	_ = repo.Set(ctx, "long", []byte("value"), 60*24*time.Hour)
+
+	if expiration := server.Expiration("73686f7274"); expiration != 2 {
+		t.Errorf("expected the ttl to be rounded up to 2 seconds, got %d", expiration)
+	}
+	expected := time.Now().Add(60 * 24 * time.Hour).Unix()
+	if expiration := server.Expiration("6c6f6e67"); expiration < expected-5 || expiration > expected+5 {
+		t.Errorf("expected ttls above 30 days to be a unix timestamp, got %d", expiration)
+	}
+}
+
+func TestMemcachedRepositorySplitsLargeValues(t *testing.T) {
+	servers := []*fakeMemcached{newFakeMemcached(t), newFakeMemcached(t)}
+	repo := newMemcachedRepository(t, 1024, servers...)
+	ctx := context.Background()
+
+	value := bytes.Repeat([]byte("0123456789"), 1000)
+	if err := repo.Set(ctx, "large", value, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if items := servers[0].Len() + servers[1].Len(); items != 11 {
+		t.Errorf("expected a manifest and 10 chunks, got %d items", items)
+	}
+	if cached, err := repo.Get(ctx, "large"); err != nil || !bytes.Equal(cached, value) {
+		t.Fatalf("expected the chunks to be joined, got %d bytes %v", len(cached), err)
+	}
+
+	// losing a chunk loses the entry
+	for _, server := range servers {
+		for _, key := range server.Keys() {
+			if strings.HasSuffix(key, ":3") {
+				server.Delete(key)
+			}
+		}
+	}
+	if _, err := repo.Get(ctx, "large"); !cache.IsNotFound(err) {
+		t.Errorf("expected a miss when a chunk is missing, got %v", err)
+	}
+
+	_ = repo.Remove(ctx, "large")
+	_ = repo.Set(ctx, "large", value, time.Minute)
+	_ = repo.Remove(ctx, "large")
+	if items := servers[0].Len() + servers[1].Len(); items != 0 {
+		t.Errorf("expected the chunks to be removed, %d items left", items)
+	}
+}
+
+func TestMemcachedRepositoryDistributesKeys(t *testing.T) {
+	servers := []*fakeMemcached{newFakeMemcached(t), newFakeMemcached(t), newFakeMemcached(t)}
+	repo := newMemcachedRepository(t, 0, servers...)
+	ctx := context.Background()
+
+	for i := 0; i < 300; i++ {
+		if err := repo.Set(ctx, fmt.Sprintf("key-%d", i), []byte("value"), 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i, server := range servers {
+		if items := server.Len(); items < 50 {
+			t.Errorf("expected server %d to hold a fair share of 300 keys, got %d", i, items)
+		}
+	}
+	for i := 0; i < 300; i++ {
+		if _, err := repo.Get(ctx, fmt.Sprintf("key-%d", i)); err != nil {
+			t.Fatalf("expected key-%d to be found, got %v", i, err)
+		}
+	}
+}
+
+func TestMemcachedRepositoryReportsBackendFailures(t *testing.T) {
+	server := newFakeMemcached(t)
+	repo := newMemcachedRepository(t, 0, server)
+	_ = server.listener.Close()
+
+	_, err := repo.Get(context.Background(), "key")
+	if err == nil || cache.IsNotFound(err) {
+		t.Fatalf("expected a backend error instead of a miss, got %v", err)
+	}
+}
@@ -0,0 +1,284 @@
+package cache
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultMemoryCacheSizeMB = 256
+	DefaultMemoryCacheShards = 64
+
+	TierMemory = "memory"
+	TierMirror = "mirror"
+
+	// entryOverhead approximates the bookkeeping memory of an entry: list element, map bucket and entry struct.
+	entryOverhead      = 128
+	expiryScanInterval = time.Minute
+)
+
+// ErrEntryTooLarge is returned by Set when a single entry does not fit into the size budget of a shard.
+var ErrEntryTooLarge = errors.New("cache: entry is larger than the cache size budget")
+
+type MemoryOptions struct {
+	// MaxBytes is the size budget of all entries, split evenly between the shards.
+	MaxBytes int64
+	Shards   int
+	// Policy is PolicyLRU or PolicyTinyLFU, empty means PolicyLRU.
+	Policy string
+	// Tier labels the size and item gauges, e.g. TierL1 or TierMirror, empty means TierMemory.
+	Tier string
+}
+
+func MemoryOptionsFromEnv() (MemoryOptions, error) {
+	env := &envReader{}
+	options := MemoryOptions{
+		MaxBytes: int64(env.int("MEMORY_CACHE_SIZE_MB", DefaultMemoryCacheSizeMB, 1)) << 20,
+		Shards:   env.int("MEMORY_CACHE_SHARDS", DefaultMemoryCacheShards, 1),
+		Policy:   os.Getenv("MEMORY_CACHE_POLICY"),
+	}
+	return options, env.err()
+}
+
+// MemoryRepository is an in-process CacheRepository. Keys are spread over shards, each guarded by its own
+// mutex and evicting entries by its eviction policy once it exceeds its share of the size budget.
+// Expired entries are dropped when they are read and by a periodic scan.
+type MemoryRepository struct {
+	shards     []*memoryShard
+	metrics    *metric.Prometheus
+	sizeGauge  prometheus.Gauge
+	itemsGauge prometheus.Gauge
+	stop       chan struct{}
+	once       sync.Once
+}
+
+type memoryShard struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	items    map[string]*memoryEntry
+	policy   evictionPolicy
+}
+
+type memoryEntry struct {
+	key       string
+	value     []byte
+	expiresAt int64
+
+	element *list.Element
+	segment uint8
+}
+
+func NewMemoryRepository(options MemoryOptions, metrics *metric.Prometheus) (*MemoryRepository, error) {
+	if options.Tier == "" {
+		options.Tier = TierMemory
+	}
+	if options.Shards <= 0 {
+		options.Shards = DefaultMemoryCacheShards
+	}
+	if options.MaxBytes <= 0 {
+		options.MaxBytes = DefaultMemoryCacheSizeMB << 20
+	}
+
+	repository := &MemoryRepository{
+		shards:     make([]*memoryShard, options.Shards),
+		metrics:    metrics,
+		sizeGauge:  metrics.CacheSizeBytesGauge.WithLabelValues(options.Tier),
+		itemsGauge: metrics.CacheItemsGauge.WithLabelValues(options.Tier),
+		stop:       make(chan struct{}),
+	}
+	shardMaxBytes := options.MaxBytes / int64(options.Shards)
+	for i := range repository.shards {
+		policy, err := newEvictionPolicy(options.Policy, shardMaxBytes)
+		if err != nil {
+			return nil, err
+		}
+		repository.shards[i] = &memoryShard{
+			maxBytes: shardMaxBytes,
+			items:    make(map[string]*memoryEntry),
+			policy:   policy,
+		}
+	}
+
+	go repository.expireLoop()
+	return repository, nil
+}
+
+func (repository *MemoryRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	shard := repository.shard(key)
+	now := time.Now().UnixNano()
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	entry, ok := shard.items[key]
+	if ok && entry.expired(now) {
+		repository.removeEntry(shard, entry)
+		entry, ok = nil, false
+	}
+
+	shard.policy.access(key, entry)
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return entry.value, nil
+}
+
+func (repository *MemoryRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	shard := repository.shard(key)
+	entry := &memoryEntry{key: key, value: value}
+	if ttl > 0 {
+		entry.expiresAt = time.Now().Add(ttl).UnixNano()
+	}
+	if entry.size() > shard.maxBytes {
+		return ErrEntryTooLarge
+	}
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if existing, ok := shard.items[key]; ok {
+		repository.removeEntry(shard, existing)
+	}
+
+	shard.items[key] = entry
+	shard.bytes += entry.size()
+	repository.sizeGauge.Add(float64(entry.size()))
+	repository.itemsGauge.Inc()
+
+	for _, evicted := range shard.policy.add(entry) {
+		repository.dropEntry(shard, evicted)
+		repository.metrics.CacheEvictionCounter.Inc()
+	}
+	return nil
+}
+
+func (repository *MemoryRepository) Remove(ctx context.Context, key string) error {
+	shard := repository.shard(key)
+
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	if entry, ok := shard.items[key]; ok {
+		repository.removeEntry(shard, entry)
+	}
+	return nil
+}
+
+// Range calls fn for the live entries until fn returns false. The entries of a shard are collected
+// under its lock and passed to fn after, so fn may use the repository.
+func (repository *MemoryRepository) Range(ctx context.Context, fn func(item Item) bool) error {
+	now := time.Now().UnixNano()
+	for _, shard := range repository.shards {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		shard.mu.Lock()
+		items := make([]Item, 0, len(shard.items))
+		for _, entry := range shard.items {
+			if entry.expired(now) {
+				continue
+			}
+			item := Item{Key: entry.key, Value: entry.value}
+			if entry.expiresAt > 0 {
+				item.ExpiresAt = time.Unix(0, entry.expiresAt)
+			}
+			items = append(items, item)
+		}
+		shard.mu.Unlock()
+
+		for _, item := range items {
+			if !fn(item) {
+				return nil
+			}
+		}
+	}
+	return nil
+}
+
+// Len returns the number of entries, including expired entries that were not dropped yet.
+func (repository *MemoryRepository) Len() int {
+	count := 0
+	for _, shard := range repository.shards {
+		shard.mu.Lock()
+		count += len(shard.items)
+		shard.mu.Unlock()
+	}
+	return count
+}
+
+// Bytes returns the accounted size of all entries.
+func (repository *MemoryRepository) Bytes() int64 {
+	var bytes int64
+	for _, shard := range repository.shards {
+		shard.mu.Lock()
+		bytes += shard.bytes
+		shard.mu.Unlock()
+	}
+	return bytes
+}
+
+// Close stops the periodic expiry scan.
+func (repository *MemoryRepository) Close() {
+	repository.once.Do(func() { close(repository.stop) })
+}
+
+func (repository *MemoryRepository) shard(key string) *memoryShard {
+	return repository.shards[fnv32a(key)%uint32(len(repository.shards))]
+}
+
+func (repository *MemoryRepository) removeEntry(shard *memoryShard, entry *memoryEntry) {
+	shard.policy.remove(entry)
+	repository.dropEntry(shard, entry)
+}
+
+// dropEntry deletes an entry that is already unlinked from the eviction policy.
+func (repository *MemoryRepository) dropEntry(shard *memoryShard, entry *memoryEntry) {
+	delete(shard.items, entry.key)
+	shard.bytes -= entry.size()
+	repository.sizeGauge.Sub(float64(entry.size()))
+	repository.itemsGauge.Dec()
+}
+
+func (repository *MemoryRepository) expireLoop() {
+	ticker := time.NewTicker(expiryScanInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-repository.stop:
+			return
+		case <-ticker.C:
+			repository.removeExpired()
+		}
+	}
+}
+
+func (repository *MemoryRepository) removeExpired() {
+	now := time.Now().UnixNano()
+	for _, shard := range repository.shards {
+		shard.mu.Lock()
+		for _, entry := range shard.items {
+			if entry.expired(now) {
+				repository.removeEntry(shard, entry)
+			}
+		}
+		shard.mu.Unlock()
+	}
+}
+
+func (entry *memoryEntry) expired(now int64) bool {
+	return entry.expiresAt > 0 && entry.expiresAt <= now
+}
+
+func (entry *memoryEntry) size() int64 {
+	return int64(len(entry.key) + len(entry.value) + entryOverhead)
+}
@@ -0,0 +1,237 @@
+package cache_test
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newMemoryRepository(t *testing.T, options cache.MemoryOptions) (*cache.MemoryRepository, *metric.Prometheus) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewMemoryRepository(options, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, metrics
+}
+
+func TestMemoryRepositoryGetSetRemove(t *testing.T) {
+	repo, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 4})
+	defer repo.Close()
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	if err := repo.Set(ctx, "key", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := repo.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("expected value, got %s %v", value, err)
+	}
+
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss after remove, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryExpiresEntries(t *testing.T) {
+	repo, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer repo.Close()
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "short", []byte("value"), 20*time.Millisecond)
+	_ = repo.Set(ctx, "long", []byte("value"), time.Hour)
+	time.Sleep(40 * time.Millisecond)
+
+	if _, err := repo.Get(ctx, "short"); !cache.IsNotFound(err) {
+		t.Errorf("expected the expired entry to be a miss, got %v", err)
+	}
+	if _, err := repo.Get(ctx, "long"); err != nil {
+		t.Errorf("expected the entry to be alive, got %v", err)
+	}
+	if items := testutil.ToFloat64(metrics.CacheItemsGauge.WithLabelValues(cache.TierMemory)); items != 1 {
+		t.Errorf("expected 1 item, got %v", items)
+	}
+}
+
+func TestMemoryRepositoryRangesOverLiveEntries(t *testing.T) {
+	repo, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 4})
+	defer repo.Close()
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "forever", []byte("value"), 0)
+	_ = repo.Set(ctx, "live", []byte("value"), time.Minute)
+	_ = repo.Set(ctx, "short", []byte("value"), 10*time.Millisecond)
+	time.Sleep(20 * time.Millisecond)
+
+	items := map[string]cache.Item{}
+	if err := repo.Range(ctx, func(item cache.Item) bool {
+		items[item.Key] = item
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || !items["forever"].ExpiresAt.IsZero() || items["live"].ExpiresAt.Before(time.Now()) {
+		t.Errorf("expected the live entries with their expiry, got %+v", items)
+	}
+
+	count := 0
+	_ = repo.Range(ctx, func(item cache.Item) bool {
+		count++
+		return false
+	})
+	if count != 1 {
+		t.Errorf("expected Range to stop when fn returns false, got %d calls", count)
+	}
+}
+
+func TestMemoryRepositoryEvictsLeastRecentlyUsed(t *testing.T) {
+	value := make([]byte, 1000)
+	// room for three entries including their overhead
+	repo, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 3 * 1200, Shards: 1})
+	defer repo.Close()
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "a", value, 0)
+	_ = repo.Set(ctx, "b", value, 0)
+	_ = repo.Set(ctx, "c", value, 0)
+	_, _ = repo.Get(ctx, "a")
+	_ = repo.Set(ctx, "d", value, 0)
+
+	if _, err := repo.Get(ctx, "b"); !cache.IsNotFound(err) {
+		t.Errorf("expected the least recently used entry to be evicted, got %v", err)
+	}
+	for _, key := range []string{"a", "c", "d"} {
+		if _, err := repo.Get(ctx, key); err != nil {
+			t.Errorf("expected %s to be cached, got %v", key, err)
+		}
+	}
+	if evictions := testutil.ToFloat64(metrics.CacheEvictionCounter); evictions != 1 {
+		t.Errorf("expected 1 eviction, got %v", evictions)
+	}
+	if err := repo.Set(ctx, "huge", make([]byte, 4000), 0); err != cache.ErrEntryTooLarge {
+		t.Errorf("expected ErrEntryTooLarge, got %v", err)
+	}
+}
+
+func TestMemoryRepositoryStaysInBudgetUnderConcurrentLoad(t *testing.T) {
+	for _, policy := range []string{cache.PolicyLRU, cache.PolicyTinyLFU} {
+		t.Run(policy, func(t *testing.T) {
+			hammerMemoryRepository(t, policy)
+		})
+	}
+}
+
+func hammerMemoryRepository(t *testing.T, policy string) {
+	const maxBytes = 256 << 10
+	repo, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: maxBytes, Shards: 8, Policy: policy})
+	defer repo.Close()
+	ctx := context.Background()
+
+	var wg sync.WaitGroup
+	for worker := 0; worker < 16; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(worker)))
+			for i := 0; i < 5000; i++ {
+				key := fmt.Sprintf("key-%d", random.Intn(2000))
+				switch random.Intn(10) {
+				case 0:
+					_ = repo.Remove(ctx, key)
+				case 1, 2, 3:
+					_ = repo.Set(ctx, key, make([]byte, random.Intn(2048)), time.Duration(random.Intn(50))*time.Millisecond)
+				default:
+					_, _ = repo.Get(ctx, key)
+				}
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	if bytes := repo.Bytes(); bytes > maxBytes {
+		t.Errorf("expected at most %d bytes, got %d", maxBytes, bytes)
+	}
+	if size := testutil.ToFloat64(metrics.CacheSizeBytesGauge.WithLabelValues(cache.TierMemory)); int64(size) != repo.Bytes() {
+		t.Errorf("expected the size gauge %v to match %d", size, repo.Bytes())
+	}
+	if items := testutil.ToFloat64(metrics.CacheItemsGauge.WithLabelValues(cache.TierMemory)); int(items) != repo.Len() {
+		t.Errorf("expected the item gauge %v to match %d", items, repo.Len())
+	}
+}
+
+func TestTinyLFUKeepsFrequentEntriesDuringScans(t *testing.T) {
+	value := make([]byte, 1000)
+	repo, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 100 * 1200, Shards: 1, Policy: cache.PolicyTinyLFU})
+	defer repo.Close()
+	ctx := context.Background()
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("hot-%d", i)
+			if _, err := repo.Get(ctx, key); err != nil {
+				_ = repo.Set(ctx, key, value, 0)
+			}
+		}
+	}
+
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("scan-%d", i)
+		_, _ = repo.Get(ctx, key)
+		_ = repo.Set(ctx, key, value, 0)
+	}
+
+	for i := 0; i < 50; i++ {
+		if _, err := repo.Get(ctx, fmt.Sprintf("hot-%d", i)); err != nil {
+			t.Fatalf("expected hot-%d to survive the scan, got %v", i, err)
+		}
+	}
+}
+
+func TestNewMemoryRepositoryRejectsUnknownPolicy(t *testing.T) {
+	if _, err := cache.NewMemoryRepository(cache.MemoryOptions{Policy: "fifo"}, metric.NewPrometheus(prometheus.NewRegistry())); err == nil {
+		t.Fatal("expected an error for an unknown policy")
+	}
+}
+
+func TestMemoryRepositoriesReportTheirTier(t *testing.T) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	l1, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1, Tier: cache.TierL1}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l1.Close()
+	mirror, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1, Tier: cache.TierMirror}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mirror.Close()
+	ctx := context.Background()
+
+	_ = l1.Set(ctx, "a", []byte("value"), 0)
+	_ = l1.Set(ctx, "b", []byte("value"), 0)
+	_ = mirror.Set(ctx, "a", []byte("value"), 0)
+
+	if items := testutil.ToFloat64(metrics.CacheItemsGauge.WithLabelValues(cache.TierL1)); items != 2 {
+		t.Errorf("expected 2 l1 items, got %v", items)
+	}
+	if items := testutil.ToFloat64(metrics.CacheItemsGauge.WithLabelValues(cache.TierMirror)); items != 1 {
+		t.Errorf("expected 1 mirror item, got %v", items)
+	}
+	if size := testutil.ToFloat64(metrics.CacheSizeBytesGauge.WithLabelValues(cache.TierL1)); int64(size) != l1.Bytes() {
+		t.Errorf("expected the l1 size gauge to be %d, got %v", l1.Bytes(), size)
+	}
+}
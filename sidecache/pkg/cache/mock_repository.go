@@ -1,5 +1,5 @@
 // Code generated by MockGen. DO NOT EDIT.
-// Source: repository.go
+// Source: legacy.go
 
 // Package mock_cache is a generated GoMock package.
 package cache
@@ -10,7 +10,7 @@ import (
 	gomock "github.com/golang/mock/gomock"
 )
 
-// MockCacheRepository is a mock of CacheRepository interface.
+// MockCacheRepository is a mock of LegacyCacheRepository interface.
 type MockCacheRepository struct {
 	ctrl     *gomock.Controller
 	recorder *MockCacheRepositoryMockRecorder
@@ -33,18 +33,6 @@ func (m *MockCacheRepository) EXPECT() *MockCacheRepositoryMockRecorder {
 	return m.recorder
 }
 
-// Close mocks base method.
-func (m *MockCacheRepository) Close() {
-	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "Close")
-}
-
-// Close indicates an expected call of Close.
-func (mr *MockCacheRepositoryMockRecorder) Close() *gomock.Call {
-	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Close", reflect.TypeOf((*MockCacheRepository)(nil).Close))
-}
-
 // Get mocks base method.
 func (m *MockCacheRepository) Get(key string) []byte {
 	m.ctrl.T.Helper()
@@ -74,13 +62,13 @@ func (mr *MockCacheRepositoryMockRecorder) Remove(key interface{}) *gomock.Call
 }
 
 // SetKey mocks base method.
-func (m *MockCacheRepository) SetKey(key string, value []byte, ttl int) {
+func (m *MockCacheRepository) SetKey(key string, value []byte) {
 	m.ctrl.T.Helper()
-	m.ctrl.Call(m, "SetKey", key, value, ttl)
+	m.ctrl.Call(m, "SetKey", key, value)
 }
 
 // SetKey indicates an expected call of SetKey.
-func (mr *MockCacheRepositoryMockRecorder) SetKey(key, value, ttl interface{}) *gomock.Call {
+func (mr *MockCacheRepositoryMockRecorder) SetKey(key, value interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
-	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetKey", reflect.TypeOf((*MockCacheRepository)(nil).SetKey), key, value, ttl)
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "SetKey", reflect.TypeOf((*MockCacheRepository)(nil).SetKey), key, value)
 }
@@ -0,0 +1,396 @@
+package cache
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/discovery"
+	"github.com/Trendyol/sidecache/pkg/hashring"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	// PeerPathPrefix is the path of the peer endpoint, followed by the hex encoded key.
+	PeerPathPrefix = "/sidecache/peer/"
+
+	PeerTokenHeaderKey = "Sidecache-Peer-Token"
+	peerTTLHeaderKey   = "Sidecache-Peer-Ttl"
+
+	PeerHit    = "hit"
+	PeerMiss   = "miss"
+	PeerMirror = "mirror"
+	PeerError  = "error"
+)
+
+type PeerOptions struct {
+	// Self is the address of this replica as the other peers reach it.
+	Self string
+	// Timeout bounds a request to another peer, a shorter context deadline takes precedence.
+	Timeout         time.Duration
+	RefreshInterval time.Duration
+	Replicas        int
+
+	// HotThreshold is the number of recent lookups, at most 15, after which a key owned by another peer
+	// is mirrored locally for MirrorTTL.
+	HotThreshold int
+	MirrorTTL    time.Duration
+	MirrorBytes  int64
+
+	// Token is sent to and required from the other peers. The peer endpoint is served on the public
+	// port of the sidecar, so it is required.
+	Token string
+}
+
+// PeerOptionsFromEnv reads the PEER_* variables, Self defaults to POD_IP on the sidecache port.
+func PeerOptionsFromEnv() (PeerOptions, error) {
+	self := os.Getenv("PEER_SELF")
+	if podIP := os.Getenv("POD_IP"); self == "" && podIP != "" {
+		self = podIP + ":9191"
+	}
+	env := &envReader{}
+	options := PeerOptions{
+		Self:            self,
+		Timeout:         env.duration("PEER_TIMEOUT", 50*time.Millisecond),
+		RefreshInterval: env.duration("PEER_REFRESH_INTERVAL", 10*time.Second),
+		Replicas:        env.int("PEER_REPLICAS", hashring.DefaultReplicas, 1),
+		HotThreshold:    env.int("PEER_HOT_THRESHOLD", 5, 1),
+		MirrorTTL:       env.duration("PEER_MIRROR_TTL", 10*time.Second),
+		MirrorBytes:     int64(env.int("PEER_MIRROR_SIZE_MB", 16, 1)) << 20,
+		Token:           os.Getenv("PEER_TOKEN"),
+	}
+	return options, env.err()
+}
+
+// PeerDiscoveryFromEnv returns the PEER_ADDRS list, or the ready endpoints of the PEER_K8S_SERVICE.
+func PeerDiscoveryFromEnv() (discovery.Discovery, error) {
+	if addrs := envList("PEER_ADDRS"); len(addrs) > 0 {
+		return discovery.Static(addrs), nil
+	}
+	if service := os.Getenv("PEER_K8S_SERVICE"); service != "" {
+		env := &envReader{}
+		port := env.int("PEER_PORT", 9191, 1)
+		if err := env.err(); err != nil {
+			return nil, err
+		}
+		return discovery.NewKubernetes(service, port)
+	}
+	return nil, errors.New("peer discovery requires PEER_ADDRS or PEER_K8S_SERVICE")
+}
+
+// PeerRepository shares the in-process caches of the replicas. Every key is owned by one peer on a
+// consistent hash ring: the owner keeps the key in its local repository, the other peers read and
+// write it through the owner's peer endpoint. A peer that can't be reached is skipped and the key is
+// cached locally meanwhile.
+//
+// Keys looked up often on a non-owner are mirrored locally for MirrorTTL to absorb skew. Purges only
+// clear the mirror of the replica that received them, so MirrorTTL bounds how stale mirrors can get.
+type PeerRepository struct {
+	local   CacheRepository
+	mirror  *MemoryRepository
+	options PeerOptions
+	logger  *zap.Logger
+	metrics *metric.Prometheus
+	client  *fasthttp.Client
+	ring    *hashring.Ring
+
+	sketchMu sync.Mutex
+	sketch   *frequencySketch
+
+	stop chan struct{}
+	once sync.Once
+}
+
+func NewPeerRepository(local CacheRepository, options PeerOptions, logger *zap.Logger, metrics *metric.Prometheus) (*PeerRepository, error) {
+	if options.Self == "" {
+		return nil, errors.New("peer sharing requires PEER_SELF or POD_IP")
+	}
+	if options.Token == "" {
+		return nil, errors.New("peer sharing requires PEER_TOKEN")
+	}
+	if options.HotThreshold <= 0 || options.HotThreshold > 15 {
+		return nil, fmt.Errorf("PEER_HOT_THRESHOLD must be between 1 and 15, got %d", options.HotThreshold)
+	}
+	if options.RefreshInterval <= 0 {
+		options.RefreshInterval = 10 * time.Second
+	}
+
+	mirror, err := NewMemoryRepository(MemoryOptions{MaxBytes: options.MirrorBytes, Shards: 4, Tier: TierMirror}, metrics)
+	if err != nil {
+		return nil, err
+	}
+
+	repository := &PeerRepository{
+		local:   local,
+		mirror:  mirror,
+		options: options,
+		logger:  logger,
+		metrics: metrics,
+		client:  &fasthttp.Client{ReadTimeout: options.Timeout, WriteTimeout: options.Timeout},
+		ring:    hashring.New(options.Replicas),
+		sketch:  newFrequencySketch(1 << 16),
+		stop:    make(chan struct{}),
+	}
+	repository.SetPeers(nil)
+	return repository, nil
+}
+
+// SetPeers replaces the peers of the ring, this replica is always one of them.
+func (repository *PeerRepository) SetPeers(peers []string) {
+	peers = append([]string{repository.options.Self}, peers...)
+	repository.ring.Set(peers...)
+	repository.metrics.CachePeersGauge.Set(float64(len(repository.ring.Nodes())))
+}
+
+// Peers returns the peers of the ring in sorted order.
+func (repository *PeerRepository) Peers() []string {
+	return repository.ring.Nodes()
+}
+
+// Owner returns the peer owning the key.
+func (repository *PeerRepository) Owner(key string) string {
+	return repository.ring.Get(key)
+}
+
+// Watch refreshes the peers from the discovery every RefreshInterval until Close. A failed refresh
+// keeps the previous peers.
+func (repository *PeerRepository) Watch(peers discovery.Discovery) {
+	repository.refresh(peers)
+
+	ticker := time.NewTicker(repository.options.RefreshInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				repository.refresh(peers)
+			case <-repository.stop:
+				return
+			}
+		}
+	}()
+}
+
+func (repository *PeerRepository) refresh(peers discovery.Discovery) {
+	ctx, cancel := context.WithTimeout(context.Background(), repository.options.RefreshInterval)
+	defer cancel()
+
+	addresses, err := peers.Addresses(ctx)
+	if err != nil {
+		repository.logger.Warn("peer discovery failed, keeping the previous peers", zap.Error(err))
+		return
+	}
+	repository.SetPeers(addresses)
+}
+
+func (repository *PeerRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	owner := repository.Owner(key)
+	if owner == repository.options.Self {
+		return repository.local.Get(ctx, key)
+	}
+
+	if value, err := repository.mirror.Get(ctx, key); err == nil {
+		repository.metrics.CachePeerRequestCounter.WithLabelValues(PeerMirror).Inc()
+		return value, nil
+	}
+
+	value, err := repository.fetch(ctx, owner, key)
+	switch {
+	case err == nil:
+		repository.metrics.CachePeerRequestCounter.WithLabelValues(PeerHit).Inc()
+		if repository.hot(key) {
+			_ = repository.mirror.Set(ctx, key, value, repository.options.MirrorTTL)
+		}
+		return value, nil
+	case IsNotFound(err):
+		repository.metrics.CachePeerRequestCounter.WithLabelValues(PeerMiss).Inc()
+		return nil, err
+	default:
+		repository.metrics.CachePeerRequestCounter.WithLabelValues(PeerError).Inc()
+		return repository.local.Get(ctx, key)
+	}
+}
+
+func (repository *PeerRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	owner := repository.Owner(key)
+	if owner == repository.options.Self {
+		return repository.local.Set(ctx, key, value, ttl)
+	}
+
+	if err := repository.store(ctx, owner, key, value, ttl); err != nil {
+		repository.metrics.CachePeerRequestCounter.WithLabelValues(PeerError).Inc()
+		return repository.local.Set(ctx, key, value, ttl)
+	}
+	return nil
+}
+
+// Remove removes the key from the owner, the local repository and the mirror, the key may be in the
+// local repository of a non-owner after the owner was unreachable or the peers changed.
+func (repository *PeerRepository) Remove(ctx context.Context, key string) error {
+	_ = repository.mirror.Remove(ctx, key)
+	err := repository.local.Remove(ctx, key)
+
+	if owner := repository.Owner(key); owner != repository.options.Self {
+		if peerErr := repository.remove(ctx, owner, key); peerErr != nil {
+			err = peerErr
+		}
+	}
+	return err
+}
+
+// Range lists the entries owned by this replica or cached locally while their owner was unreachable.
+func (repository *PeerRepository) Range(ctx context.Context, fn func(item Item) bool) error {
+	local, ok := repository.local.(Iterable)
+	if !ok {
+		return errors.New("peer: local repository can't be iterated")
+	}
+	return local.Range(ctx, fn)
+}
+
+func (repository *PeerRepository) Close() {
+	repository.once.Do(func() {
+		close(repository.stop)
+		repository.mirror.Close()
+	})
+}
+
+// hot counts a lookup of the key and reports whether the key is looked up often enough to mirror it.
+func (repository *PeerRepository) hot(key string) bool {
+	repository.sketchMu.Lock()
+	defer repository.sketchMu.Unlock()
+
+	repository.sketch.increment(key)
+	return int(repository.sketch.estimate(key)) >= repository.options.HotThreshold
+}
+
+func (repository *PeerRepository) fetch(ctx context.Context, owner, key string) ([]byte, error) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	repository.prepare(req, fasthttp.MethodGet, owner, key)
+	if err := repository.do(ctx, req, resp); err != nil {
+		return nil, err
+	}
+	switch resp.StatusCode() {
+	case http.StatusOK:
+		return append([]byte(nil), resp.Body()...), nil
+	case http.StatusNotFound:
+		return nil, ErrNotFound
+	default:
+		return nil, fmt.Errorf("peer %s: get: status %d", owner, resp.StatusCode())
+	}
+}
+
+func (repository *PeerRepository) store(ctx context.Context, owner, key string, value []byte, ttl time.Duration) error {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	repository.prepare(req, fasthttp.MethodPut, owner, key)
+	req.Header.Set(peerTTLHeaderKey, strconv.FormatInt(int64(ttl/time.Millisecond), 10))
+	req.SetBody(value)
+	if err := repository.do(ctx, req, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusNoContent {
+		return fmt.Errorf("peer %s: set: status %d", owner, resp.StatusCode())
+	}
+	return nil
+}
+
+func (repository *PeerRepository) remove(ctx context.Context, owner, key string) error {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	repository.prepare(req, fasthttp.MethodDelete, owner, key)
+	if err := repository.do(ctx, req, resp); err != nil {
+		return err
+	}
+	if resp.StatusCode() != http.StatusNoContent {
+		return fmt.Errorf("peer %s: remove: status %d", owner, resp.StatusCode())
+	}
+	return nil
+}
+
+func (repository *PeerRepository) prepare(req *fasthttp.Request, method, owner, key string) {
+	req.Header.SetMethod(method)
+	req.SetRequestURI("http://" + owner + PeerPathPrefix + hex.EncodeToString([]byte(key)))
+	req.Header.Set(PeerTokenHeaderKey, repository.options.Token)
+}
+
+// do sends the request within the peer timeout, shortened to the context deadline.
+func (repository *PeerRepository) do(ctx context.Context, req *fasthttp.Request, resp *fasthttp.Response) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	timeout := repository.options.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until(deadline); timeout <= 0 || remaining < timeout {
+			timeout = remaining
+		}
+	}
+	if timeout <= 0 {
+		return repository.client.Do(req, resp)
+	}
+	return repository.client.DoTimeout(req, resp, timeout)
+}
+
+// Handler serves the local repository to the other peers. It never forwards to another peer, so peers
+// with different views of the ring can't send a request around in circles.
+func (repository *PeerRepository) Handler(ctx *fasthttp.RequestCtx) {
+	if subtle.ConstantTimeCompare(ctx.Request.Header.Peek(PeerTokenHeaderKey), []byte(repository.options.Token)) != 1 {
+		ctx.SetStatusCode(http.StatusForbidden)
+		return
+	}
+
+	key, err := hex.DecodeString(strings.TrimPrefix(string(ctx.Path()), PeerPathPrefix))
+	if err != nil || len(key) == 0 {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		return
+	}
+
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+		value, err := repository.local.Get(ctx, string(key))
+		if IsNotFound(err) {
+			ctx.SetStatusCode(http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.SetBody(value)
+	case fasthttp.MethodPut:
+		ttl, err := strconv.ParseInt(string(ctx.Request.Header.Peek(peerTTLHeaderKey)), 10, 64)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			return
+		}
+		if err := repository.local.Set(ctx, string(key), append([]byte(nil), ctx.PostBody()...), time.Duration(ttl)*time.Millisecond); err != nil {
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.SetStatusCode(http.StatusNoContent)
+	case fasthttp.MethodDelete:
+		if err := repository.local.Remove(ctx, string(key)); err != nil {
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.SetStatusCode(http.StatusNoContent)
+	default:
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+	}
+}
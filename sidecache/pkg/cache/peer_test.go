@@ -0,0 +1,191 @@
+package cache_test
+
+import (
+	"context"
+	"encoding/hex"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+type testPeer struct {
+	repo     *cache.PeerRepository
+	local    *cache.MemoryRepository
+	metrics  *metric.Prometheus
+	listener net.Listener
+}
+
+// newTestPeers starts peers serving their peer endpoint on loopback listeners, every peer knows all.
+func newTestPeers(t *testing.T, count int, options cache.PeerOptions) []*testPeer {
+	peers := make([]*testPeer, count)
+	var addrs []string
+	for i := range peers {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		peers[i] = &testPeer{listener: listener}
+		addrs = append(addrs, listener.Addr().String())
+	}
+
+	for i, peer := range peers {
+		peer.local, peer.metrics = newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+		options.Self = addrs[i]
+		repo, err := cache.NewPeerRepository(peer.local, options, zap.NewNop(), peer.metrics)
+		if err != nil {
+			t.Fatal(err)
+		}
+		repo.SetPeers(addrs)
+		peer.repo = repo
+
+		go (&fasthttp.Server{Handler: repo.Handler}).Serve(peer.listener)
+		t.Cleanup(func() {
+			_ = peer.listener.Close()
+			repo.Close()
+			peer.local.Close()
+		})
+	}
+	return peers
+}
+
+func peerOptions() cache.PeerOptions {
+	return cache.PeerOptions{Timeout: time.Second, HotThreshold: 3, MirrorTTL: time.Minute, MirrorBytes: 1 << 20, Token: "secret"}
+}
+
+// keyOwnedBy returns a key owned by the peer.
+func keyOwnedBy(peer *testPeer) string {
+	for i := 0; ; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if peer.repo.Owner(key) == peer.listener.Addr().String() {
+			return key
+		}
+	}
+}
+
+func TestPeerRepositoryStoresKeysOnTheirOwner(t *testing.T) {
+	peers := newTestPeers(t, 2, peerOptions())
+	a, b := peers[0], peers[1]
+	ctx := context.Background()
+	key := keyOwnedBy(b)
+
+	if err := a.repo.Set(ctx, key, []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := b.local.Get(ctx, key); err != nil || string(value) != "value" {
+		t.Fatalf("expected the key in the owner's cache, got %s %v", value, err)
+	}
+	if _, err := a.local.Get(ctx, key); !cache.IsNotFound(err) {
+		t.Errorf("expected the key to be stored only on its owner, got %v", err)
+	}
+
+	if value, err := a.repo.Get(ctx, key); err != nil || string(value) != "value" {
+		t.Fatalf("expected the key from the owner, got %s %v", value, err)
+	}
+	if _, err := a.repo.Get(ctx, keyOwnedBy(b)+"-missing"); !cache.IsNotFound(err) {
+		t.Errorf("expected a miss, got %v", err)
+	}
+
+	if err := a.repo.Remove(ctx, key); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.local.Get(ctx, key); !cache.IsNotFound(err) {
+		t.Errorf("expected the remove to reach the owner, got %v", err)
+	}
+}
+
+func TestPeerRepositoryMirrorsHotKeys(t *testing.T) {
+	peers := newTestPeers(t, 2, peerOptions())
+	a, b := peers[0], peers[1]
+	ctx := context.Background()
+	key := keyOwnedBy(b)
+	_ = b.local.Set(ctx, key, []byte("value"), time.Minute)
+
+	for i := 0; i < 5; i++ {
+		if value, err := a.repo.Get(ctx, key); err != nil || string(value) != "value" {
+			t.Fatalf("expected value, got %s %v", value, err)
+		}
+	}
+
+	if hits := testutil.ToFloat64(a.metrics.CachePeerRequestCounter.WithLabelValues(cache.PeerHit)); hits != 3 {
+		t.Errorf("expected 3 lookups from the owner before the key got hot, got %v", hits)
+	}
+	if hits := testutil.ToFloat64(a.metrics.CachePeerRequestCounter.WithLabelValues(cache.PeerMirror)); hits != 2 {
+		t.Errorf("expected 2 lookups from the mirror, got %v", hits)
+	}
+
+	_ = a.repo.Remove(ctx, key)
+	if _, err := a.repo.Get(ctx, key); !cache.IsNotFound(err) {
+		t.Errorf("expected the remove to clear the mirror, got %v", err)
+	}
+}
+
+func TestPeerRepositoryFallsBackToLocalCacheWhenTheOwnerIsDown(t *testing.T) {
+	peers := newTestPeers(t, 2, peerOptions())
+	a, b := peers[0], peers[1]
+	ctx := context.Background()
+	key := keyOwnedBy(b)
+	_ = b.listener.Close()
+
+	if err := a.repo.Set(ctx, key, []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := a.repo.Get(ctx, key); err != nil || string(value) != "value" {
+		t.Fatalf("expected the key from the local cache, got %s %v", value, err)
+	}
+	if errors := testutil.ToFloat64(a.metrics.CachePeerRequestCounter.WithLabelValues(cache.PeerError)); errors != 2 {
+		t.Errorf("expected 2 peer errors, got %v", errors)
+	}
+}
+
+func TestPeerRepositoryRequiresTheToken(t *testing.T) {
+	options := peerOptions()
+	options.Self, options.Token = "127.0.0.1:9191", ""
+	local, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20})
+	defer local.Close()
+	if _, err := cache.NewPeerRepository(local, options, zap.NewNop(), metrics); err == nil {
+		t.Error("expected peer sharing without a token to be rejected")
+	}
+
+	peers := newTestPeers(t, 2, peerOptions())
+	a, b := peers[0], peers[1]
+	ctx := context.Background()
+	key := keyOwnedBy(b)
+
+	if err := a.repo.Set(ctx, key, []byte("value"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.local.Get(ctx, key); err != nil {
+		t.Fatalf("expected peers sharing the token to be served, got %v", err)
+	}
+
+	statusCode, _, err := fasthttp.Get(nil, "http://"+b.listener.Addr().String()+cache.PeerPathPrefix+"6b6579")
+	if err != nil || statusCode != fasthttp.StatusForbidden {
+		t.Errorf("expected a request without the token to be forbidden, got %d %v", statusCode, err)
+	}
+
+	for _, token := range []string{"", "wrong"} {
+		req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+		req.Header.SetMethod(fasthttp.MethodPut)
+		req.SetRequestURI("http://" + b.listener.Addr().String() + cache.PeerPathPrefix + hex.EncodeToString([]byte("forged")))
+		req.Header.Set("Sidecache-Peer-Ttl", "60000")
+		if token != "" {
+			req.Header.Set(cache.PeerTokenHeaderKey, token)
+		}
+		req.SetBodyString("forged")
+		if err := fasthttp.Do(req, resp); err != nil || resp.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("expected a put with token %q to be forbidden, got %d %v", token, resp.StatusCode(), err)
+		}
+		fasthttp.ReleaseRequest(req)
+		fasthttp.ReleaseResponse(resp)
+	}
+	if _, err := b.local.Get(ctx, "forged"); !cache.IsNotFound(err) {
+		t.Errorf("expected the forged entry not to be stored, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+)
+
+const (
+	PolicyLRU     = "lru"
+	PolicyTinyLFU = "tinylfu"
+
+	// averageEntrySize is used to size the frequency sketch from a byte budget.
+	averageEntrySize = 1024
+
+	windowPercent    = 1
+	protectedPercent = 80
+)
+
+const (
+	segmentWindow uint8 = iota
+	segmentProbation
+	segmentProtected
+)
+
+// evictionPolicy decides which entries of a shard stay within the shard's byte budget.
+// It is only called with the shard lock held.
+type evictionPolicy interface {
+	// access records a lookup, entry is nil on a miss.
+	access(key string, entry *memoryEntry)
+	// add links a new entry and returns the entries dropped to stay in budget, possibly including the new one.
+	add(entry *memoryEntry) []*memoryEntry
+	// remove unlinks an entry that is deleted or expired.
+	remove(entry *memoryEntry)
+}
+
+func newEvictionPolicy(name string, maxBytes int64) (evictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return &lruPolicy{maxBytes: maxBytes, entries: list.New()}, nil
+	case PolicyTinyLFU:
+		return newTinyLFUPolicy(maxBytes), nil
+	default:
+		return nil, fmt.Errorf("unknown cache eviction policy: %q", name)
+	}
+}
+
+type lruPolicy struct {
+	maxBytes int64
+	bytes    int64
+	entries  *list.List
+}
+
+func (policy *lruPolicy) access(key string, entry *memoryEntry) {
+	if entry != nil {
+		policy.entries.MoveToFront(entry.element)
+	}
+}
+
+func (policy *lruPolicy) add(entry *memoryEntry) []*memoryEntry {
+	entry.element = policy.entries.PushFront(entry)
+	policy.bytes += entry.size()
+
+	var evicted []*memoryEntry
+	for policy.bytes > policy.maxBytes {
+		victim := policy.entries.Back().Value.(*memoryEntry)
+		policy.remove(victim)
+		evicted = append(evicted, victim)
+	}
+	return evicted
+}
+
+func (policy *lruPolicy) remove(entry *memoryEntry) {
+	policy.entries.Remove(entry.element)
+	policy.bytes -= entry.size()
+}
+
+// tinyLFUPolicy implements W-TinyLFU: new entries go to a small LRU window and entries leaving the
+// window are only admitted to the main segmented LRU when the frequency sketch estimates them to be
+// more popular than the main victim. One-hit wonders therefore stay in the window and don't push hot
+// entries out.
+type tinyLFUPolicy struct {
+	sketch *frequencySketch
+
+	window    segment
+	probation segment
+	protected segment
+	mainMax   int64
+}
+
+type segment struct {
+	entries  *list.List
+	bytes    int64
+	maxBytes int64
+}
+
+func newTinyLFUPolicy(maxBytes int64) *tinyLFUPolicy {
+	windowMax := maxBytes * windowPercent / 100
+	mainMax := maxBytes - windowMax
+	return &tinyLFUPolicy{
+		sketch:    newFrequencySketch(int(maxBytes / averageEntrySize)),
+		window:    segment{entries: list.New(), maxBytes: windowMax},
+		probation: segment{entries: list.New()},
+		protected: segment{entries: list.New(), maxBytes: mainMax * protectedPercent / 100},
+		mainMax:   mainMax,
+	}
+}
+
+func (policy *tinyLFUPolicy) access(key string, entry *memoryEntry) {
+	policy.sketch.increment(key)
+	if entry == nil {
+		return
+	}
+
+	switch entry.segment {
+	case segmentWindow:
+		policy.window.entries.MoveToFront(entry.element)
+	case segmentProbation:
+		policy.probation.unlink(entry)
+		policy.protected.pushFront(entry, segmentProtected)
+		for policy.protected.bytes > policy.protected.maxBytes {
+			demoted := policy.protected.back()
+			policy.protected.unlink(demoted)
+			policy.probation.pushFront(demoted, segmentProbation)
+		}
+	case segmentProtected:
+		policy.protected.entries.MoveToFront(entry.element)
+	}
+}
+
+func (policy *tinyLFUPolicy) add(entry *memoryEntry) []*memoryEntry {
+	policy.window.pushFront(entry, segmentWindow)
+
+	var evicted []*memoryEntry
+	for policy.window.bytes > policy.window.maxBytes {
+		candidate := policy.window.back()
+		policy.window.unlink(candidate)
+		evicted = append(evicted, policy.admit(candidate)...)
+	}
+	return evicted
+}
+
+// admit moves a candidate leaving the window into probation if it is estimated to be accessed more
+// often than every main entry it would push out, otherwise the candidate itself is evicted.
+func (policy *tinyLFUPolicy) admit(candidate *memoryEntry) []*memoryEntry {
+	needed := policy.mainBytes() + candidate.size() - policy.mainMax
+	candidateFrequency := policy.sketch.estimate(candidate.key)
+
+	var victims []*memoryEntry
+	for _, s := range []*segment{&policy.probation, &policy.protected} {
+		for element := s.entries.Back(); element != nil && needed > 0; element = element.Prev() {
+			victim := element.Value.(*memoryEntry)
+			if candidateFrequency <= policy.sketch.estimate(victim.key) {
+				return []*memoryEntry{candidate}
+			}
+			victims = append(victims, victim)
+			needed -= victim.size()
+		}
+	}
+	if needed > 0 {
+		return []*memoryEntry{candidate}
+	}
+
+	for _, victim := range victims {
+		policy.remove(victim)
+	}
+	policy.probation.pushFront(candidate, segmentProbation)
+	return victims
+}
+
+func (policy *tinyLFUPolicy) remove(entry *memoryEntry) {
+	switch entry.segment {
+	case segmentWindow:
+		policy.window.unlink(entry)
+	case segmentProbation:
+		policy.probation.unlink(entry)
+	case segmentProtected:
+		policy.protected.unlink(entry)
+	}
+}
+
+func (policy *tinyLFUPolicy) mainBytes() int64 {
+	return policy.probation.bytes + policy.protected.bytes
+}
+
+func (s *segment) pushFront(entry *memoryEntry, id uint8) {
+	entry.segment = id
+	entry.element = s.entries.PushFront(entry)
+	s.bytes += entry.size()
+}
+
+func (s *segment) unlink(entry *memoryEntry) {
+	s.entries.Remove(entry.element)
+	s.bytes -= entry.size()
+}
+
+func (s *segment) back() *memoryEntry {
+	element := s.entries.Back()
+	if element == nil {
+		return nil
+	}
+	return element.Value.(*memoryEntry)
+}
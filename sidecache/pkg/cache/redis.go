@@ -1,51 +1,175 @@
 package cache
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"os"
-	"strconv"
 	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 )
 
-type RedisRepository struct {
-	client *redis.Client
+const (
+	RedisModeStandalone = "standalone"
+	RedisModeSentinel   = "sentinel"
+	RedisModeCluster    = "cluster"
+
+	redisScanCount = 500
+)
+
+type RedisOptions struct {
+	// Mode is RedisModeStandalone, RedisModeSentinel or RedisModeCluster, empty means standalone.
+	Mode     string
+	Addr     string
+	Password string
+	DB       int
+
+	// Addrs are the sentinel addresses in sentinel mode and the seed nodes in cluster mode.
+	Addrs            []string
+	MasterName       string
+	SentinelPassword string
+	// RouteReads sends read-only commands to the closest replica in cluster mode.
+	RouteReads bool
+
+	PoolSize     int
+	MinIdleConns int
+	MaxRetries   int
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	PoolTimeout  time.Duration
+	IdleTimeout  time.Duration
 }
 
-func NewRedisRepository() *RedisRepository {
-	client := redis.NewClient(&redis.Options{
-		Addr:     os.Getenv("redisAddr"),
-		Password: os.Getenv("redisPassword"),
-		DB:       0,
-	})
+// RedisOptionsFromEnv reads the REDIS_* variables. The former redisAddr and redisPassword
+// variables are still honoured.
+func RedisOptionsFromEnv() (RedisOptions, error) {
+	env := &envReader{}
+	options := RedisOptions{
+		Mode:             envString("REDIS_MODE", RedisModeStandalone),
+		Addr:             envString("REDIS_ADDR", envString("redisAddr", "127.0.0.1:6379")),
+		Password:         envString("REDIS_PASSWORD", envString("redisPassword", "")),
+		DB:               env.int("REDIS_DB", 0, 0),
+		Addrs:            envList("REDIS_ADDRS"),
+		MasterName:       os.Getenv("REDIS_MASTER_NAME"),
+		SentinelPassword: os.Getenv("REDIS_SENTINEL_PASSWORD"),
+		RouteReads:       os.Getenv("REDIS_ROUTE_READS") == "true",
 
-	return &RedisRepository{client: client}
+		PoolSize:     env.int("REDIS_POOL_SIZE", 0, 0),
+		MinIdleConns: env.int("REDIS_MIN_IDLE_CONNS", 0, 0),
+		MaxRetries:   env.int("REDIS_MAX_RETRIES", 0, 0),
+		DialTimeout:  env.duration("REDIS_DIAL_TIMEOUT", time.Second),
+		ReadTimeout:  env.duration("REDIS_READ_TIMEOUT", 100*time.Millisecond),
+		WriteTimeout: env.duration("REDIS_WRITE_TIMEOUT", 100*time.Millisecond),
+		PoolTimeout:  env.duration("REDIS_POOL_TIMEOUT", 0),
+		IdleTimeout:  env.duration("REDIS_IDLE_TIMEOUT", 0),
+	}
+	return options, env.err()
 }
 
-func (repository *RedisRepository) SetKey(key string, value interface{}, ttl int) {
-	byteData, err := json.Marshal(value)
+// RedisRepository stores entries with native redis ttls. Values are stored as they are.
+type RedisRepository struct {
+	client redis.UniversalClient
+}
 
+func NewRedisRepository(options RedisOptions) (*RedisRepository, error) {
+	client, err := newRedisClient(options)
 	if err != nil {
-		fmt.Println(err)
-		return
+		return nil, err
 	}
+	return &RedisRepository{client: client}, nil
+}
 
-	duration, _ := time.ParseDuration(strconv.FormatInt(int64(ttl), 10))
-	status := repository.client.Set(key, string(byteData), duration)
-	_, err = status.Result()
-	if err != nil {
-		fmt.Println(err)
+func newRedisClient(options RedisOptions) (redis.UniversalClient, error) {
+	switch options.Mode {
+	case "", RedisModeStandalone:
+		return redis.NewClient(&redis.Options{
+			Addr:         options.Addr,
+			Password:     options.Password,
+			DB:           options.DB,
+			PoolSize:     options.PoolSize,
+			MinIdleConns: options.MinIdleConns,
+			MaxRetries:   options.MaxRetries,
+			DialTimeout:  options.DialTimeout,
+			ReadTimeout:  options.ReadTimeout,
+			WriteTimeout: options.WriteTimeout,
+			PoolTimeout:  options.PoolTimeout,
+			IdleTimeout:  options.IdleTimeout,
+		}), nil
+	case RedisModeSentinel:
+		if options.MasterName == "" || len(options.Addrs) == 0 {
+			return nil, errors.New("redis sentinel mode requires REDIS_MASTER_NAME and REDIS_ADDRS")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       options.MasterName,
+			SentinelAddrs:    options.Addrs,
+			SentinelPassword: options.SentinelPassword,
+			Password:         options.Password,
+			DB:               options.DB,
+			PoolSize:         options.PoolSize,
+			MinIdleConns:     options.MinIdleConns,
+			MaxRetries:       options.MaxRetries,
+			DialTimeout:      options.DialTimeout,
+			ReadTimeout:      options.ReadTimeout,
+			WriteTimeout:     options.WriteTimeout,
+			PoolTimeout:      options.PoolTimeout,
+			IdleTimeout:      options.IdleTimeout,
+		}), nil
+	case RedisModeCluster:
+		if len(options.Addrs) == 0 {
+			return nil, errors.New("redis cluster mode requires REDIS_ADDRS")
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:          options.Addrs,
+			Password:       options.Password,
+			ReadOnly:       options.RouteReads,
+			RouteByLatency: options.RouteReads,
+			PoolSize:       options.PoolSize,
+			MinIdleConns:   options.MinIdleConns,
+			MaxRetries:     options.MaxRetries,
+			DialTimeout:    options.DialTimeout,
+			ReadTimeout:    options.ReadTimeout,
+			WriteTimeout:   options.WriteTimeout,
+			PoolTimeout:    options.PoolTimeout,
+			IdleTimeout:    options.IdleTimeout,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unknown redis mode: %q", options.Mode)
 	}
 }
 
-func (repository *RedisRepository) Get(key string) []byte {
-	status := repository.client.Get(key)
-	stringResult, err := status.Result()
-	if err != nil {
-		fmt.Println(err)
+func (repository *RedisRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := repository.client.Get(ctx, key).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return nil, ErrNotFound
 	}
+	return value, err
+}
+
+func (repository *RedisRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return repository.client.Set(ctx, key, value, ttl).Err()
+}
+
+// SetMany writes all entries in a single pipelined round trip.
+func (repository *RedisRepository) SetMany(ctx context.Context, entries []Entry) error {
+	_, err := repository.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, entry := range entries {
+			pipe.Set(ctx, entry.Key, entry.Value, entry.TTL)
+		}
+		return nil
+	})
+	return err
+}
+
+func (repository *RedisRepository) Remove(ctx context.Context, key string) error {
+	return repository.client.Del(ctx, key).Err()
+}
+
+func (repository *RedisRepository) Ping(ctx context.Context) error {
+	return repository.client.Ping(ctx).Err()
+}
 
-	return []byte(stringResult)
+func (repository *RedisRepository) Close() error {
+	return repository.client.Close()
 }
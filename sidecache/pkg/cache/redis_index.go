@@ -0,0 +1,327 @@
+package cache
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	redisIndexTimeout       = time.Second
+	redisIndexHashTagPrefix = "{sidecache-index:"
+	// redisIndexMaxTrimInterval bounds the number of adds between two trims of a large index.
+	redisIndexMaxTrimInterval = 1000
+)
+
+// RedisIndex is an invalidation.Index shared by all sidecache replicas using the same redis.
+//
+// All index keys of a cache key prefix carry the same hash tag, e.g. `{sidecache-index:users}:urls`,
+// so in cluster mode they live in a single slot and can be updated in one MULTI transaction:
+//
+//	{...}:entries     hash of cache key to its url and tags
+//	{...}:urls        sorted set of `url\x00cache key` members for prefix lookups by lexical range
+//	{...}:added       sorted set of cache keys scored by the time they were indexed, to trim old entries
+//	{...}:tag:<name>  set of the cache keys tagged with the name
+//
+// Cache keys are binary digests, they are stored hex encoded. The index is trimmed to maxEntries every
+// 1% of maxEntries adds, at most every 1000 adds, so it may briefly hold that many entries more.
+//
+// Index operations go through the circuit breaker set by WithBreaker, so they don't block fills and
+// invalidations while redis is down.
+type RedisIndex struct {
+	client       redis.UniversalClient
+	hashTag      string
+	maxEntries   int
+	trimInterval uint64
+	adds         uint64
+	breaker      *BreakerRepository
+}
+
+type redisIndexEntry struct {
+	URL  string   `json:"url"`
+	Tags []string `json:"tags,omitempty"`
+}
+
+// Index returns an index stored next to the repository's entries.
+func (repository *RedisRepository) Index(cacheKeyPrefix string, maxEntries int) *RedisIndex {
+	if maxEntries <= 0 {
+		maxEntries = invalidation.DefaultIndexSize
+	}
+	trimInterval := maxEntries / 100
+	if trimInterval < 1 {
+		trimInterval = 1
+	} else if trimInterval > redisIndexMaxTrimInterval {
+		trimInterval = redisIndexMaxTrimInterval
+	}
+	return &RedisIndex{
+		client:       repository.client,
+		hashTag:      redisIndexHashTagPrefix + redisHashTagEscaper.Replace(cacheKeyPrefix) + "}",
+		maxEntries:   maxEntries,
+		trimInterval: uint64(trimInterval),
+	}
+}
+
+// WithBreaker runs the index operations through the circuit breaker of the repository, they fail with
+// ErrCircuitOpen while it is open.
+func (index *RedisIndex) WithBreaker(breaker *BreakerRepository) *RedisIndex {
+	index.breaker = breaker
+	return index
+}
+
+// call runs an index operation with the index timeout, through the circuit breaker if there is one.
+func (index *RedisIndex) call(fn func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisIndexTimeout)
+	defer cancel()
+
+	if index.breaker == nil {
+		return fn(ctx)
+	}
+	return index.breaker.Do(ctx, OperationIndex, fn)
+}
+
+// redisHashTagEscaper keeps a `}` of the cache key prefix from closing the hash tag early, which would
+// spread the index keys over several cluster slots.
+var redisHashTagEscaper = strings.NewReplacer("%", "%25", "}", "%7D")
+
+// Range reads the indexed entries of the cache with their ttl. Only the entries of this cache key prefix
+// are visited, never the other keys of a shared redis; entries that expired since are skipped.
+func (index *RedisIndex) Range(ctx context.Context, fn func(item Item) bool) error {
+	var cursor uint64
+	for {
+		fields, next, err := index.client.HScan(ctx, index.key("entries"), cursor, "", redisScanCount).Result()
+		if err != nil {
+			return err
+		}
+
+		keys := make([]string, 0, len(fields)/2)
+		for i := 0; i+1 < len(fields); i += 2 {
+			if key, err := hex.DecodeString(fields[i]); err == nil {
+				keys = append(keys, string(key))
+			}
+		}
+
+		values := make([]*redis.StringCmd, 0, len(keys))
+		ttls := make([]*redis.DurationCmd, 0, len(keys))
+		if len(keys) > 0 {
+			pipe := index.client.Pipeline()
+			for _, key := range keys {
+				values = append(values, pipe.Get(ctx, key))
+				ttls = append(ttls, pipe.PTTL(ctx, key))
+			}
+			// a failing command doesn't fail the others, expired keys are skipped below
+			_, _ = pipe.Exec(ctx)
+		}
+
+		now := time.Now()
+		for i, key := range keys {
+			value, err := values[i].Bytes()
+			if err != nil {
+				continue
+			}
+			item := Item{Key: key, Value: value}
+			if ttl := ttls[i].Val(); ttl > 0 {
+				item.ExpiresAt = now.Add(ttl)
+			}
+			if !fn(item) {
+				return nil
+			}
+		}
+
+		if next == 0 {
+			return ctx.Err()
+		}
+		cursor = next
+	}
+}
+
+func (index *RedisIndex) Add(key, url string, tags []string) error {
+	encoded, err := json.Marshal(redisIndexEntry{URL: url, Tags: tags})
+	if err != nil {
+		return err
+	}
+
+	return index.call(func(ctx context.Context) error {
+		hexKey := hex.EncodeToString([]byte(key))
+		if err := index.remove(ctx, hexKey); err != nil {
+			return err
+		}
+
+		_, err := index.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.HSet(ctx, index.key("entries"), hexKey, encoded)
+			pipe.ZAdd(ctx, index.key("urls"), &redis.Z{Member: url + "\x00" + hexKey})
+			pipe.ZAdd(ctx, index.key("added"), &redis.Z{Score: float64(time.Now().UnixNano()), Member: hexKey})
+			for _, tag := range tags {
+				pipe.SAdd(ctx, index.tagKey(tag), hexKey)
+			}
+			return nil
+		})
+		if err != nil || atomic.AddUint64(&index.adds, 1)%index.trimInterval != 0 {
+			return err
+		}
+		return index.trim(ctx)
+	})
+}
+
+func (index *RedisIndex) Remove(key string) error {
+	return index.call(func(ctx context.Context) error {
+		return index.remove(ctx, hex.EncodeToString([]byte(key)))
+	})
+}
+
+func (index *RedisIndex) ByPrefix(prefix string) ([]invalidation.Entry, error) {
+	var members []string
+	err := index.call(func(ctx context.Context) (err error) {
+		members, err = index.client.ZRangeByLex(ctx, index.key("urls"), &redis.ZRangeBy{
+			Min: "[" + prefix,
+			Max: "[" + prefix + "\xff",
+		}).Result()
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]invalidation.Entry, 0, len(members))
+	for _, member := range members {
+		separator := strings.LastIndexByte(member, 0)
+		if separator < 0 {
+			continue
+		}
+		key, err := hex.DecodeString(member[separator+1:])
+		if err != nil {
+			continue
+		}
+		entries = append(entries, invalidation.Entry{Key: string(key), URL: member[:separator]})
+	}
+	return entries, nil
+}
+
+func (index *RedisIndex) ByTag(tag string) ([]invalidation.Entry, error) {
+	var entries []invalidation.Entry
+	err := index.call(func(ctx context.Context) error {
+		hexKeys, err := index.client.SMembers(ctx, index.tagKey(tag)).Result()
+		if err != nil || len(hexKeys) == 0 {
+			return err
+		}
+		entries, err = index.lookupEntries(ctx, hexKeys)
+		return err
+	})
+	return entries, err
+}
+
+// Recent lists the most recently indexed entries by the time they were added.
+func (index *RedisIndex) Recent(limit int) ([]invalidation.Entry, error) {
+	var entries []invalidation.Entry
+	err := index.call(func(ctx context.Context) error {
+		hexKeys, err := index.client.ZRevRange(ctx, index.key("added"), 0, int64(limit)-1).Result()
+		if err != nil || len(hexKeys) == 0 {
+			return err
+		}
+		entries, err = index.lookupEntries(ctx, hexKeys)
+		return err
+	})
+	return entries, err
+}
+
+// lookupEntries reads the urls of the hex encoded keys.
+func (index *RedisIndex) lookupEntries(ctx context.Context, hexKeys []string) ([]invalidation.Entry, error) {
+	values, err := index.client.HMGet(ctx, index.key("entries"), hexKeys...).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]invalidation.Entry, 0, len(hexKeys))
+	for i, hexKey := range hexKeys {
+		key, err := hex.DecodeString(hexKey)
+		if err != nil {
+			continue
+		}
+		entry := invalidation.Entry{Key: string(key)}
+		if value, ok := values[i].(string); ok {
+			var indexed redisIndexEntry
+			if json.Unmarshal([]byte(value), &indexed) == nil {
+				entry.URL = indexed.URL
+			}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (index *RedisIndex) Lookup(key string) (string, []string, bool, error) {
+	var value string
+	err := index.call(func(ctx context.Context) (err error) {
+		value, err = index.client.HGet(ctx, index.key("entries"), hex.EncodeToString([]byte(key))).Result()
+		if errors.Is(err, redis.Nil) {
+			return nil
+		}
+		return err
+	})
+	if err != nil || value == "" {
+		return "", nil, false, err
+	}
+
+	var indexed redisIndexEntry
+	if err := json.Unmarshal([]byte(value), &indexed); err != nil {
+		return "", nil, false, err
+	}
+	return indexed.URL, indexed.Tags, true, nil
+}
+
+func (index *RedisIndex) remove(ctx context.Context, hexKey string) error {
+	value, err := index.client.HGet(ctx, index.key("entries"), hexKey).Result()
+	if errors.Is(err, redis.Nil) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var indexed redisIndexEntry
+	_ = json.Unmarshal([]byte(value), &indexed)
+
+	_, err = index.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.HDel(ctx, index.key("entries"), hexKey)
+		pipe.ZRem(ctx, index.key("urls"), indexed.URL+"\x00"+hexKey)
+		pipe.ZRem(ctx, index.key("added"), hexKey)
+		for _, tag := range indexed.Tags {
+			pipe.SRem(ctx, index.tagKey(tag), hexKey)
+		}
+		return nil
+	})
+	return err
+}
+
+// trim forgets the oldest entries once the index holds more than maxEntries.
+func (index *RedisIndex) trim(ctx context.Context) error {
+	count, err := index.client.ZCard(ctx, index.key("added")).Result()
+	if err != nil || count <= int64(index.maxEntries) {
+		return err
+	}
+
+	oldest, err := index.client.ZRange(ctx, index.key("added"), 0, count-int64(index.maxEntries)-1).Result()
+	if err != nil {
+		return err
+	}
+	for _, hexKey := range oldest {
+		if err := index.remove(ctx, hexKey); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (index *RedisIndex) key(name string) string {
+	return index.hashTag + ":" + name
+}
+
+func (index *RedisIndex) tagKey(tag string) string {
+	return index.hashTag + ":tag:" + tag
+}
@@ -0,0 +1,280 @@
+package cache_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func newRedisRepository(t *testing.T) (*cache.RedisRepository, *miniredis.Miniredis) {
+	server, err := miniredis.Run()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	repo, err := cache.NewRedisRepository(cache.RedisOptions{Addr: server.Addr()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = repo.Close() })
+	return repo, server
+}
+
+func TestRedisRepositoryGetSetRemove(t *testing.T) {
+	repo, _ := newRedisRepository(t)
+	ctx := context.Background()
+
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss, got %v", err)
+	}
+
+	value := []byte{0x1f, 0x8b, 0x00, 0xff}
+	if err := repo.Set(ctx, "key", value, 0); err != nil {
+		t.Fatal(err)
+	}
+	if cached, err := repo.Get(ctx, "key"); err != nil || string(cached) != string(value) {
+		t.Fatalf("expected the value to be stored as it is, got %v %v", cached, err)
+	}
+
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatalf("expected removing a missing key to succeed, got %v", err)
+	}
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected a miss after remove, got %v", err)
+	}
+}
+
+func TestRedisRepositoryUsesNativeTTL(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	ctx := context.Background()
+
+	if err := repo.Set(ctx, "key", []byte("value"), 90*time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("key"); ttl != 90*time.Second {
+		t.Fatalf("expected a ttl of 90s, got %v", ttl)
+	}
+
+	server.FastForward(91 * time.Second)
+	if _, err := repo.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Fatalf("expected the entry to expire, got %v", err)
+	}
+}
+
+func TestRedisRepositorySetMany(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	ctx := context.Background()
+
+	err := repo.SetMany(ctx, []cache.Entry{
+		{Key: "a", Value: []byte("1"), TTL: time.Minute},
+		{Key: "b", Value: []byte("2")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if value, _ := server.Get("a"); value != "1" {
+		t.Errorf("expected a to be 1, got %q", value)
+	}
+	if value, _ := server.Get("b"); value != "2" {
+		t.Errorf("expected b to be 2, got %q", value)
+	}
+	if ttl := server.TTL("a"); ttl != time.Minute {
+		t.Errorf("expected a ttl of 1m, got %v", ttl)
+	}
+}
+
+func TestRedisIndexRangesOverIndexedEntries(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	index := repo.Index("", 0)
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "live", []byte("1"), time.Minute)
+	_ = repo.Set(ctx, "forever", []byte("2"), 0)
+	_ = repo.Set(ctx, "expired", []byte("3"), time.Minute)
+	_ = index.Add("live", "/products/1?", []string{"products"})
+	_ = index.Add("forever", "/products/2?", nil)
+	_ = index.Add("expired", "/products/3?", nil)
+	_ = repo.Remove(ctx, "expired")
+	server.Set("other-application", "value")
+
+	items := map[string]cache.Item{}
+	if err := index.Range(ctx, func(item cache.Item) bool {
+		items[item.Key] = item
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 2 || string(items["live"].Value) != "1" || string(items["forever"].Value) != "2" {
+		t.Fatalf("expected only the indexed cache entries, got %+v", items)
+	}
+	if ttl := time.Until(items["live"].ExpiresAt); ttl <= 50*time.Second || ttl > time.Minute {
+		t.Errorf("expected the entry to expire in a minute, got %v", ttl)
+	}
+	if !items["forever"].ExpiresAt.IsZero() {
+		t.Errorf("expected no expiry, got %v", items["forever"].ExpiresAt)
+	}
+
+	breaker := cache.NewBreakerRepository(repo, cache.BreakerOptions{}, metric.NewPrometheus(prometheus.NewRegistry()))
+	if iterable, ok := cache.Iterate(breaker, index); !ok || iterable != cache.Iterable(index) {
+		t.Errorf("expected the index of the repository to be iterated")
+	}
+	if _, ok := cache.Iterate(breaker, nil); ok {
+		t.Errorf("expected redis not to be iterable without its index")
+	}
+}
+
+func TestRedisIndexEscapesTheHashTag(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	_ = repo.Index("a}b", 0).Add("key", "/products/1?", []string{"products"})
+
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "{sidecache-index:a%7Db}:") {
+			t.Errorf("expected every index key to carry the whole hash tag, got %q", key)
+		}
+	}
+}
+
+func TestRedisRepositoryReportsBackendFailures(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	server.Close()
+
+	_, err := repo.Get(context.Background(), "key")
+	if err == nil || cache.IsNotFound(err) {
+		t.Fatalf("expected a backend error instead of a miss, got %v", err)
+	}
+}
+
+func TestNewRedisRepositoryValidatesTopology(t *testing.T) {
+	for name, options := range map[string]cache.RedisOptions{
+		"sentinel without master": {Mode: cache.RedisModeSentinel, Addrs: []string{"127.0.0.1:26379"}},
+		"sentinel without addrs":  {Mode: cache.RedisModeSentinel, MasterName: "mymaster"},
+		"cluster without addrs":   {Mode: cache.RedisModeCluster},
+		"unknown mode":            {Mode: "ring"},
+	} {
+		if _, err := cache.NewRedisRepository(options); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRedisIndex(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	index := repo.Index("users", 0)
+
+	_ = index.Add("\x01key-a", "/users/1", []string{"user:1"})
+	_ = index.Add("\x02key-b", "/users/1/orders", []string{"user:1", "orders"})
+	_ = index.Add("\x03key-c", "/products/1", nil)
+
+	entries, err := index.ByPrefix("/users/1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		urls = append(urls, entry.URL)
+	}
+	sort.Strings(urls)
+	if strings.Join(urls, ",") != "/users/1,/users/1/orders" {
+		t.Errorf("unexpected prefix entries: %v", urls)
+	}
+
+	if entries, _ := index.ByTag("user:1"); len(entries) != 2 {
+		t.Errorf("expected 2 tagged entries, got %v", entries)
+	}
+
+	if err := index.Remove("\x02key-b"); err != nil {
+		t.Fatal(err)
+	}
+	if entries, _ := index.ByTag("user:1"); len(entries) != 1 || entries[0].Key != "\x01key-a" || entries[0].URL != "/users/1" {
+		t.Errorf("expected only key-a to stay tagged, got %v", entries)
+	}
+	if entries, _ := index.ByTag("orders"); len(entries) != 0 {
+		t.Errorf("expected the orders tag to be empty, got %v", entries)
+	}
+
+	for _, key := range server.Keys() {
+		if !strings.HasPrefix(key, "{sidecache-index:users}:") {
+			t.Errorf("expected %q to share the index hash tag", key)
+		}
+	}
+}
+
+func TestRedisIndexForgetsOldestEntries(t *testing.T) {
+	repo, _ := newRedisRepository(t)
+	index := repo.Index("", 2)
+
+	_ = index.Add("a", "/a", []string{"t"})
+	_ = index.Add("b", "/b", []string{"t"})
+	_ = index.Add("c", "/c", []string{"t"})
+
+	entries, _ := index.ByTag("t")
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		keys = append(keys, entry.Key)
+	}
+	sort.Strings(keys)
+	if strings.Join(keys, ",") != "b,c" {
+		t.Errorf("expected the oldest entry to be forgotten, got %v", keys)
+	}
+
+	recent, err := index.Recent(5)
+	if err != nil || len(recent) != 2 || recent[0].Key != "c" || recent[0].URL != "/c" || recent[1].Key != "b" {
+		t.Errorf("expected the entries newest first, got %v %v", recent, err)
+	}
+}
+
+func TestRedisIndexIsTrimmedEveryHundredthOfItsSize(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	index := repo.Index("", 200)
+
+	for i := 0; i < 201; i++ {
+		_ = index.Add(fmt.Sprintf("key-%d", i), fmt.Sprintf("/products/%d", i), nil)
+	}
+	if added, _ := server.ZMembers("{sidecache-index:}:added"); len(added) != 201 {
+		t.Errorf("expected the index to be trimmed every 2 adds only, got %d entries", len(added))
+	}
+	_ = index.Add("key-201", "/products/201", nil)
+	if added, _ := server.ZMembers("{sidecache-index:}:added"); len(added) != 200 {
+		t.Errorf("expected the index to be trimmed to 200 entries, got %d", len(added))
+	}
+}
+
+func TestRedisIndexFailsFastWhileTheBreakerIsOpen(t *testing.T) {
+	repo, server := newRedisRepository(t)
+	breaker := cache.NewBreakerRepository(repo, cache.BreakerOptions{Threshold: 1, OpenTimeout: time.Minute},
+		metric.NewPrometheus(prometheus.NewRegistry()))
+	index := repo.Index("", 0).WithBreaker(breaker)
+
+	server.Close()
+	if err := index.Add("key", "/products/1", nil); err == nil || errors.Is(err, cache.ErrCircuitOpen) {
+		t.Fatalf("expected the failing redis to open the breaker, got %v", err)
+	}
+	if breaker.State() != cache.BreakerOpen {
+		t.Fatalf("expected an open breaker, got %v", breaker.State())
+	}
+
+	started := time.Now()
+	if err := index.Remove("key"); !errors.Is(err, cache.ErrCircuitOpen) {
+		t.Errorf("expected the removal to fail fast, got %v", err)
+	}
+	if _, err := index.ByTag("products"); !errors.Is(err, cache.ErrCircuitOpen) {
+		t.Errorf("expected the lookup to fail fast, got %v", err)
+	}
+	if elapsed := time.Since(started); elapsed > 50*time.Millisecond {
+		t.Errorf("expected no call to reach redis, took %v", elapsed)
+	}
+}
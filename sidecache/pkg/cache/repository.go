@@ -1,7 +1,94 @@
 package cache
 
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+// Operations of a repository, as counted by the backend error metric.
+const (
+	OperationGet    = "get"
+	OperationSet    = "set"
+	OperationRemove = "remove"
+	// OperationIndex is an operation on the invalidation index stored next to the entries.
+	OperationIndex = "index"
+)
+
+// ErrNotFound is returned by Get when the key is not in the cache. Any other error means the
+// backend could not answer.
+var ErrNotFound = errors.New("cache: key not found")
+
 type CacheRepository interface {
-	SetKey(key string, value []byte)
-	Get(key string) []byte
-	Remove(key string) error
+	// Get returns ErrNotFound on a miss.
+	Get(ctx context.Context, key string) ([]byte, error)
+	// Set stores the value for ttl, a zero ttl means the entry does not expire.
+	Set(ctx context.Context, key string, value []byte, ttl time.Duration) error
+	// Remove does not return an error when the key does not exist.
+	Remove(ctx context.Context, key string) error
+}
+
+// Entry is a single cache write.
+type Entry struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+// BatchWriter is implemented by repositories that can write several entries in one round trip.
+type BatchWriter interface {
+	SetMany(ctx context.Context, entries []Entry) error
+}
+
+// Item is a stored entry, ExpiresAt is zero for entries without ttl.
+type Item struct {
+	Key       string
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// Iterable is implemented by repositories that can list their entries, e.g. to dump them.
+type Iterable interface {
+	// Range calls fn for every live entry until fn returns false.
+	Range(ctx context.Context, fn func(item Item) bool) error
+}
+
+// Iterate returns what can range over the entries of the repository: the index of the repository if it
+// is iterable, as the index of a shared backend knows the entries of the cache key prefix, or else the
+// repository itself.
+func Iterate(repository CacheRepository, index invalidation.Index) (Iterable, bool) {
+	if iterable, ok := index.(Iterable); ok {
+		return iterable, true
+	}
+	return AsIterable(repository)
+}
+
+// AsIterable returns the repository as Iterable, looking through wrappers such as the circuit breaker.
+func AsIterable(repository CacheRepository) (Iterable, bool) {
+	for {
+		if iterable, ok := repository.(Iterable); ok {
+			return iterable, true
+		}
+		wrapper, ok := repository.(interface{ Unwrap() CacheRepository })
+		if !ok {
+			return nil, false
+		}
+		repository = wrapper.Unwrap()
+	}
+}
+
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound)
+}
+
+// recordBackendError counts err if the backend failed the operation. Misses aren't failures and
+// operations rejected by an open circuit breaker never reached the backend.
+func recordBackendError(metrics *metric.Prometheus, operation string, err error) {
+	if err == nil || IsNotFound(err) || errors.Is(err, ErrCircuitOpen) {
+		return
+	}
+	metrics.CacheBackendErrorCounter.WithLabelValues(operation).Inc()
 }
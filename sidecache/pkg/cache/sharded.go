@@ -0,0 +1,325 @@
+package cache
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/hashring"
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+// ErrNoHealthyShard is returned while every shard node is ejected.
+var ErrNoHealthyShard = errors.New("cache: no healthy shard node")
+
+type ShardedOptions struct {
+	// Replicas is the number of virtual nodes of every node on the hash ring.
+	Replicas int
+	// EjectThreshold is the number of consecutive failures that ejects a node from the ring.
+	EjectThreshold int
+	// EjectTimeout is how long an ejected node stays out of the ring before it gets keys again.
+	EjectTimeout time.Duration
+}
+
+func ShardedOptionsFromEnv() (ShardedOptions, error) {
+	env := &envReader{}
+	options := ShardedOptions{
+		Replicas:       env.int("SHARD_REPLICAS", hashring.DefaultReplicas, 1),
+		EjectThreshold: env.int("SHARD_EJECT_THRESHOLD", 3, 1),
+		EjectTimeout:   env.duration("SHARD_EJECT_TIMEOUT", 30*time.Second),
+	}
+	return options, env.err()
+}
+
+// ShardedRepository spreads keys over independent cache nodes with a consistent hash ring, so adding
+// or removing a node only moves the keys of its neighbours.
+//
+// A node failing EjectThreshold times in a row is taken off the ring and its keys move to the other
+// nodes until EjectTimeout has passed. Removes are also sent to the ejected owner of a key, so the
+// entry isn't served again once the node is back; if that fails too, the entry lives until its ttl.
+type ShardedRepository struct {
+	options ShardedOptions
+	metrics *metric.Prometheus
+
+	// healthy places the keys, all knows where a key lives while its owner is ejected.
+	healthy *hashring.Ring
+	all     *hashring.Ring
+
+	mu      sync.RWMutex
+	nodes   map[string]*shardNode
+	ejected int32
+}
+
+type shardNode struct {
+	name       string
+	repository CacheRepository
+	failures   int32
+
+	// guarded by the repository mutex
+	ejected   bool
+	ejectedAt time.Time
+}
+
+func NewShardedRepository(nodes map[string]CacheRepository, options ShardedOptions, metrics *metric.Prometheus) *ShardedRepository {
+	if options.Replicas <= 0 {
+		options.Replicas = hashring.DefaultReplicas
+	}
+	if options.EjectThreshold <= 0 {
+		options.EjectThreshold = 3
+	}
+	if options.EjectTimeout <= 0 {
+		options.EjectTimeout = 30 * time.Second
+	}
+
+	repository := &ShardedRepository{
+		options: options,
+		metrics: metrics,
+		healthy: hashring.New(options.Replicas),
+		all:     hashring.New(options.Replicas),
+		nodes:   make(map[string]*shardNode, len(nodes)),
+	}
+	for name, node := range nodes {
+		repository.AddNode(name, node)
+	}
+	return repository
+}
+
+// AddNode adds a node to the ring or replaces the repository of a known node.
+func (repository *ShardedRepository) AddNode(name string, node CacheRepository) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	if previous, ok := repository.nodes[name]; ok && previous.ejected {
+		atomic.AddInt32(&repository.ejected, -1)
+	}
+	repository.nodes[name] = &shardNode{name: name, repository: node}
+	repository.all.Add(name)
+	repository.healthy.Add(name)
+	repository.updateHealthyGauge()
+}
+
+// RemoveNode takes a node off the ring, its keys move to the remaining nodes.
+func (repository *ShardedRepository) RemoveNode(name string) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	node, ok := repository.nodes[name]
+	if !ok {
+		return
+	}
+	if node.ejected {
+		atomic.AddInt32(&repository.ejected, -1)
+	}
+	delete(repository.nodes, name)
+	repository.all.Remove(name)
+	repository.healthy.Remove(name)
+	repository.updateHealthyGauge()
+}
+
+// Owner returns the node the key is currently read from and written to.
+func (repository *ShardedRepository) Owner(key string) string {
+	repository.readmit()
+	return repository.healthy.Get(key)
+}
+
+func (repository *ShardedRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	node, err := repository.owner(key)
+	if err != nil {
+		return nil, err
+	}
+	value, err := node.repository.Get(ctx, key)
+	repository.record(node, OperationGet, err)
+	return value, err
+}
+
+func (repository *ShardedRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	node, err := repository.owner(key)
+	if err != nil {
+		return err
+	}
+	err = node.repository.Set(ctx, key, value, ttl)
+	repository.record(node, OperationSet, err)
+	return err
+}
+
+// SetMany groups the entries by node and batches the writes of nodes supporting it.
+func (repository *ShardedRepository) SetMany(ctx context.Context, entries []Entry) error {
+	groups := make(map[*shardNode][]Entry)
+	for _, entry := range entries {
+		node, err := repository.owner(entry.Key)
+		if err != nil {
+			return err
+		}
+		groups[node] = append(groups[node], entry)
+	}
+
+	var firstErr error
+	for node, group := range groups {
+		err := setMany(ctx, node.repository, group)
+		repository.record(node, OperationSet, err)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// Remove removes the key from its current owner and from its owner on the full ring, which differ
+// while the owner is ejected.
+func (repository *ShardedRepository) Remove(ctx context.Context, key string) error {
+	repository.readmit()
+	current, home := repository.healthy.Get(key), repository.all.Get(key)
+
+	repository.mu.RLock()
+	currentNode, homeNode := repository.nodes[current], repository.nodes[home]
+	repository.mu.RUnlock()
+
+	var err error
+	if currentNode != nil {
+		err = currentNode.repository.Remove(ctx, key)
+		repository.record(currentNode, OperationRemove, err)
+	}
+	if homeNode != nil && homeNode != currentNode {
+		// the home node is ejected, its failures are already known
+		homeErr := homeNode.repository.Remove(ctx, key)
+		recordBackendError(repository.metrics, OperationRemove, homeErr)
+		if homeErr != nil && err == nil {
+			err = homeErr
+		}
+	}
+	if currentNode == nil && homeNode == nil {
+		return ErrNoHealthyShard
+	}
+	return err
+}
+
+// Range ranges over the nodes one by one and skips the stale copies of keys that moved to another node.
+func (repository *ShardedRepository) Range(ctx context.Context, fn func(item Item) bool) error {
+	repository.mu.RLock()
+	names := make([]string, 0, len(repository.nodes))
+	nodes := make(map[string]*shardNode, len(repository.nodes))
+	for name, node := range repository.nodes {
+		names = append(names, name)
+		nodes[name] = node
+	}
+	repository.mu.RUnlock()
+	sort.Strings(names)
+
+	for _, name := range names {
+		iterable, ok := AsIterable(nodes[name].repository)
+		if !ok {
+			return fmt.Errorf("shard node %s can't be iterated", name)
+		}
+
+		stopped := false
+		err := iterable.Range(ctx, func(item Item) bool {
+			if repository.healthy.Get(item.Key) != name && repository.all.Get(item.Key) != name {
+				return true
+			}
+			stopped = !fn(item)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		}
+		if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+func (repository *ShardedRepository) owner(key string) (*shardNode, error) {
+	repository.readmit()
+
+	name := repository.healthy.Get(key)
+	repository.mu.RLock()
+	node, ok := repository.nodes[name]
+	repository.mu.RUnlock()
+	if !ok {
+		return nil, ErrNoHealthyShard
+	}
+	return node, nil
+}
+
+// record counts the consecutive failures of a node and ejects it at the threshold.
+func (repository *ShardedRepository) record(node *shardNode, operation string, err error) {
+	recordBackendError(repository.metrics, operation, err)
+	if err == nil || IsNotFound(err) {
+		if atomic.LoadInt32(&node.failures) != 0 {
+			atomic.StoreInt32(&node.failures, 0)
+		}
+		return
+	}
+	if atomic.AddInt32(&node.failures, 1) < int32(repository.options.EjectThreshold) {
+		return
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	// the node may have been ejected already or replaced meanwhile
+	if node.ejected || repository.nodes[node.name] != node {
+		return
+	}
+	node.ejected = true
+	node.ejectedAt = time.Now()
+	atomic.AddInt32(&repository.ejected, 1)
+	repository.healthy.Remove(node.name)
+	repository.metrics.CacheShardEjectionCounter.WithLabelValues(node.name).Inc()
+	repository.updateHealthyGauge()
+}
+
+// readmit puts the nodes ejected for longer than EjectTimeout back on the ring. A node still failing
+// is ejected again after EjectThreshold failures.
+func (repository *ShardedRepository) readmit() {
+	if atomic.LoadInt32(&repository.ejected) == 0 || !repository.readmissionDue() {
+		return
+	}
+
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+
+	for name, node := range repository.nodes {
+		if !node.ejected || time.Since(node.ejectedAt) < repository.options.EjectTimeout {
+			continue
+		}
+		node.ejected = false
+		atomic.StoreInt32(&node.failures, 0)
+		atomic.AddInt32(&repository.ejected, -1)
+		repository.healthy.Add(name)
+		repository.updateHealthyGauge()
+	}
+}
+
+func (repository *ShardedRepository) readmissionDue() bool {
+	repository.mu.RLock()
+	defer repository.mu.RUnlock()
+
+	for _, node := range repository.nodes {
+		if node.ejected && time.Since(node.ejectedAt) >= repository.options.EjectTimeout {
+			return true
+		}
+	}
+	return false
+}
+
+func (repository *ShardedRepository) updateHealthyGauge() {
+	repository.metrics.CacheShardHealthyNodesGauge.Set(float64(len(repository.healthy.Nodes())))
+}
+
+func setMany(ctx context.Context, repository CacheRepository, entries []Entry) error {
+	if writer, ok := repository.(BatchWriter); ok && len(entries) > 1 {
+		return writer.SetMany(ctx, entries)
+	}
+	for _, entry := range entries {
+		if err := repository.Set(ctx, entry.Key, entry.Value, entry.TTL); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package cache_test
+
+import (
+	"context"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func newShardNodes(t *testing.T, names ...string) map[string]cache.CacheRepository {
+	nodes := make(map[string]cache.CacheRepository, len(names))
+	for _, name := range names {
+		node, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+		t.Cleanup(node.Close)
+		nodes[name] = node
+	}
+	return nodes
+}
+
+func TestShardedRepositoryMovesFewKeysWhenANodeIsAdded(t *testing.T) {
+	repo := cache.NewShardedRepository(newShardNodes(t, "a", "b", "c", "d"), cache.ShardedOptions{}, metric.NewPrometheus(prometheus.NewRegistry()))
+
+	const keys = 10000
+	owners := make(map[string]string, keys)
+	for i := 0; i < keys; i++ {
+		key := "key-" + strconv.Itoa(i)
+		owners[key] = repo.Owner(key)
+	}
+
+	node, _ := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer node.Close()
+	repo.AddNode("e", node)
+
+	moved := 0
+	for key, owner := range owners {
+		current := repo.Owner(key)
+		if current == owner {
+			continue
+		}
+		if current != "e" {
+			t.Fatalf("expected keys to move only to the new node, %s moved from %s to %s", key, owner, current)
+		}
+		moved++
+	}
+	// a fifth of the keys belongs to the new node, a modulo placement would move four fifths
+	if moved < keys/10 || moved > keys*3/10 {
+		t.Errorf("expected about a fifth of the keys to move, %d of %d moved", moved, keys)
+	}
+}
+
+func TestShardedRepositoryStoresKeysOnTheirOwner(t *testing.T) {
+	nodes := newShardNodes(t, "a", "b", "c")
+	repo := cache.NewShardedRepository(nodes, cache.ShardedOptions{}, metric.NewPrometheus(prometheus.NewRegistry()))
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		key := "key-" + strconv.Itoa(i)
+		if err := repo.Set(ctx, key, []byte(key), time.Minute); err != nil {
+			t.Fatal(err)
+		}
+		if value, err := nodes[repo.Owner(key)].Get(ctx, key); err != nil || string(value) != key {
+			t.Fatalf("expected %s on its owner, got %s %v", key, value, err)
+		}
+	}
+
+	if err := repo.SetMany(ctx, []cache.Entry{{Key: "x", Value: []byte("x")}, {Key: "y", Value: []byte("y")}}); err != nil {
+		t.Fatal(err)
+	}
+	if value, err := repo.Get(ctx, "y"); err != nil || string(value) != "y" {
+		t.Errorf("expected the batched entry, got %s %v", value, err)
+	}
+
+	if err := repo.Remove(ctx, "key-1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := repo.Get(ctx, "key-1"); !cache.IsNotFound(err) {
+		t.Errorf("expected the removed key to be missing, got %v", err)
+	}
+}
+
+func TestShardedRepositoryRangesOverOwnedEntries(t *testing.T) {
+	nodes := newShardNodes(t, "a", "b", "c")
+	repo := cache.NewShardedRepository(nodes, cache.ShardedOptions{}, metric.NewPrometheus(prometheus.NewRegistry()))
+	ctx := context.Background()
+
+	for i := 0; i < 100; i++ {
+		_ = repo.Set(ctx, "key-"+strconv.Itoa(i), []byte("value"), time.Minute)
+	}
+	// a stale copy left behind on a node that doesn't own the key
+	for name, node := range nodes {
+		if name != repo.Owner("key-1") {
+			_ = node.Set(ctx, "key-1", []byte("stale"), time.Minute)
+			break
+		}
+	}
+
+	seen := map[string]int{}
+	if err := repo.Range(ctx, func(item cache.Item) bool {
+		seen[item.Key]++
+		if string(item.Value) != "value" {
+			t.Errorf("expected the owner's copy of %s, got %s", item.Key, item.Value)
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != 100 || seen["key-1"] != 1 {
+		t.Errorf("expected every key once, got %d keys and key-1 %d times", len(seen), seen["key-1"])
+	}
+
+	repo.AddNode("d", &flakyRepository{})
+	if err := repo.Range(ctx, func(item cache.Item) bool { return true }); err == nil {
+		t.Errorf("expected an error for a node that can't be iterated")
+	}
+}
+
+func TestShardedRepositoryEjectsFailingNodes(t *testing.T) {
+	failing := &flakyRepository{down: 1}
+	nodes := newShardNodes(t, "a", "b")
+	nodes["c"] = failing
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo := cache.NewShardedRepository(nodes, cache.ShardedOptions{EjectThreshold: 2, EjectTimeout: 50 * time.Millisecond}, metrics)
+	ctx := context.Background()
+
+	key := ""
+	for i := 0; key == ""; i++ {
+		if candidate := "key-" + strconv.Itoa(i); repo.Owner(candidate) == "c" {
+			key = candidate
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := repo.Get(ctx, key); err == nil || cache.IsNotFound(err) {
+			t.Fatalf("expected the failing node error, got %v", err)
+		}
+	}
+	if owner := repo.Owner(key); owner == "c" {
+		t.Fatal("expected the failing node to be ejected")
+	}
+	if ejections := testutil.ToFloat64(metrics.CacheShardEjectionCounter.WithLabelValues("c")); ejections != 1 {
+		t.Errorf("expected 1 ejection, got %v", ejections)
+	}
+	if healthy := testutil.ToFloat64(metrics.CacheShardHealthyNodesGauge); healthy != 2 {
+		t.Errorf("expected 2 healthy nodes, got %v", healthy)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheBackendErrorCounter.WithLabelValues(cache.OperationGet)); errors != 2 {
+		t.Errorf("expected 2 node errors, got %v", errors)
+	}
+
+	if err := repo.Set(ctx, key, []byte("value"), time.Minute); err != nil {
+		t.Fatalf("expected the key to be written to another node, got %v", err)
+	}
+	if value, err := repo.Get(ctx, key); err != nil || string(value) != "value" {
+		t.Fatalf("expected value, got %s %v", value, err)
+	}
+
+	removes := atomic.LoadInt32(&failing.removes)
+	_ = repo.Remove(ctx, key)
+	if atomic.LoadInt32(&failing.removes) != removes+1 {
+		t.Error("expected the remove to reach the ejected owner as well")
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	if owner := repo.Owner(key); owner != "c" {
+		t.Errorf("expected the node to be readmitted after the eject timeout, got %s", owner)
+	}
+}
+
+func TestShardedRepositoryFailsWithoutHealthyNodes(t *testing.T) {
+	nodes := map[string]cache.CacheRepository{"a": &flakyRepository{down: 1}}
+	repo := cache.NewShardedRepository(nodes, cache.ShardedOptions{EjectThreshold: 1, EjectTimeout: time.Hour}, metric.NewPrometheus(prometheus.NewRegistry()))
+	ctx := context.Background()
+
+	_, _ = repo.Get(ctx, "key")
+	if _, err := repo.Get(ctx, "key"); err != cache.ErrNoHealthyShard {
+		t.Errorf("expected ErrNoHealthyShard, got %v", err)
+	}
+}
@@ -0,0 +1,47 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+// SizeRoutedRepository keeps values smaller than the threshold in the small repository and larger
+// values in the large one, e.g. memory and disk. A key lives in only one of them: a write removes
+// the key from the other repository, since the size of a response can change between writes.
+type SizeRoutedRepository struct {
+	small     CacheRepository
+	large     CacheRepository
+	threshold int
+}
+
+func NewSizeRoutedRepository(small, large CacheRepository, threshold int) *SizeRoutedRepository {
+	return &SizeRoutedRepository{small: small, large: large, threshold: threshold}
+}
+
+func (repository *SizeRoutedRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	value, err := repository.small.Get(ctx, key)
+	if IsNotFound(err) {
+		return repository.large.Get(ctx, key)
+	}
+	return value, err
+}
+
+func (repository *SizeRoutedRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	target, other := repository.small, repository.large
+	if len(value) >= repository.threshold {
+		target, other = repository.large, repository.small
+	}
+
+	if err := other.Remove(ctx, key); err != nil {
+		return err
+	}
+	return target.Set(ctx, key, value, ttl)
+}
+
+func (repository *SizeRoutedRepository) Remove(ctx context.Context, key string) error {
+	smallErr := repository.small.Remove(ctx, key)
+	if err := repository.large.Remove(ctx, key); err != nil {
+		return err
+	}
+	return smallErr
+}
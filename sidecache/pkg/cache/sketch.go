@@ -0,0 +1,79 @@
+package cache
+
+const (
+	sketchDepth      = 4
+	sketchMaxCount   = 15
+	sketchSampleSize = 10
+)
+
+// frequencySketch is a count-min sketch with 4-bit counters estimating how often keys were accessed.
+// Counters are halved once the number of additions reaches ten times the width, so the sketch
+// keeps track of recent popularity instead of counting forever.
+type frequencySketch struct {
+	rows      [sketchDepth][]uint8
+	mask      uint32
+	additions int
+	resetAt   int
+}
+
+func newFrequencySketch(width int) *frequencySketch {
+	size := 64
+	for size < width {
+		size <<= 1
+	}
+
+	sketch := &frequencySketch{mask: uint32(size - 1), resetAt: size * sketchSampleSize}
+	for i := range sketch.rows {
+		sketch.rows[i] = make([]uint8, size)
+	}
+	return sketch
+}
+
+func (sketch *frequencySketch) increment(key string) {
+	h1, h2 := sketchHashes(key)
+	added := false
+	for i := range sketch.rows {
+		index := (h1 + uint32(i)*h2) & sketch.mask
+		if sketch.rows[i][index] < sketchMaxCount {
+			sketch.rows[i][index]++
+			added = true
+		}
+	}
+
+	if added {
+		sketch.additions++
+		if sketch.additions >= sketch.resetAt {
+			sketch.reset()
+		}
+	}
+}
+
+func (sketch *frequencySketch) estimate(key string) uint8 {
+	h1, h2 := sketchHashes(key)
+	min := uint8(sketchMaxCount)
+	for i := range sketch.rows {
+		if count := sketch.rows[i][(h1+uint32(i)*h2)&sketch.mask]; count < min {
+			min = count
+		}
+	}
+	return min
+}
+
+func (sketch *frequencySketch) reset() {
+	for i := range sketch.rows {
+		for j := range sketch.rows[i] {
+			sketch.rows[i][j] >>= 1
+		}
+	}
+	sketch.additions /= 2
+}
+
+// sketchHashes derives the row indexes from two halves of a 64 bit FNV-1a hash.
+func sketchHashes(key string) (uint32, uint32) {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	return uint32(hash), uint32(hash>>32) | 1
+}
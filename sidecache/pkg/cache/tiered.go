@@ -0,0 +1,135 @@
+package cache
+
+import (
+	"context"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+const (
+	TierL1 = "l1"
+	TierL2 = "l2"
+)
+
+type TieredOptions struct {
+	// L1TTL caps how long an entry is served from the in-process tier. Purges only reach the L1 of the
+	// replica that received them, so this bounds how stale the other replicas can be.
+	L1TTL time.Duration
+}
+
+func TieredOptionsFromEnv() (TieredOptions, error) {
+	env := &envReader{}
+	options := TieredOptions{
+		L1TTL: env.duration("TIERED_L1_TTL", 10*time.Second),
+	}
+	return options, env.err()
+}
+
+// TieredRepository checks a small in-process L1 before a shared L2 and copies L2 hits into L1.
+// Writes and removes go to both tiers.
+type TieredRepository struct {
+	l1      CacheRepository
+	l2      CacheRepository
+	l1TTL   time.Duration
+	metrics *metric.Prometheus
+}
+
+func NewTieredRepository(l1, l2 CacheRepository, options TieredOptions, metrics *metric.Prometheus) *TieredRepository {
+	if options.L1TTL <= 0 {
+		options.L1TTL = 10 * time.Second
+	}
+	return &TieredRepository{
+		l1:      l1,
+		l2:      l2,
+		l1TTL:   options.L1TTL,
+		metrics: metrics,
+	}
+}
+
+func (repository *TieredRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	if value, err := repository.l1.Get(ctx, key); err == nil {
+		repository.metrics.CacheTierHitCounter.WithLabelValues(TierL1).Inc()
+		return value, nil
+	}
+
+	value, err := repository.l2.Get(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	repository.metrics.CacheTierHitCounter.WithLabelValues(TierL2).Inc()
+
+	// The remaining L2 ttl is unknown, the capped L1 ttl keeps the copy from outliving it for long.
+	_ = repository.l1.Set(ctx, key, value, repository.l1TTL)
+	return value, nil
+}
+
+func (repository *TieredRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	if err := repository.l2.Set(ctx, key, value, ttl); err != nil {
+		return err
+	}
+	_ = repository.l1.Set(ctx, key, value, repository.capTTL(ttl))
+	return nil
+}
+
+// SetMany batches the L2 writes when the L2 supports it.
+func (repository *TieredRepository) SetMany(ctx context.Context, entries []Entry) error {
+	if writer, ok := repository.l2.(BatchWriter); ok {
+		if err := writer.SetMany(ctx, entries); err != nil {
+			return err
+		}
+	} else {
+		for _, entry := range entries {
+			if err := repository.l2.Set(ctx, entry.Key, entry.Value, entry.TTL); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, entry := range entries {
+		_ = repository.l1.Set(ctx, entry.Key, entry.Value, repository.capTTL(entry.TTL))
+	}
+	return nil
+}
+
+// Remove removes the key from both tiers, the L1 copy is removed even if the L2 fails.
+func (repository *TieredRepository) Remove(ctx context.Context, key string) error {
+	l1Err := repository.l1.Remove(ctx, key)
+	if err := repository.l2.Remove(ctx, key); err != nil {
+		return err
+	}
+	return l1Err
+}
+
+func (repository *TieredRepository) capTTL(ttl time.Duration) time.Duration {
+	if ttl <= 0 || ttl > repository.l1TTL {
+		return repository.l1TTL
+	}
+	return ttl
+}
+
+// L1 returns the in-process tier on its own, e.g. to snapshot or preload it. Its ttls are capped like
+// the writes through both tiers.
+func (repository *TieredRepository) L1() CacheRepository {
+	return tieredL1{repository}
+}
+
+type tieredL1 struct {
+	tiered *TieredRepository
+}
+
+func (l1 tieredL1) Get(ctx context.Context, key string) ([]byte, error) {
+	return l1.tiered.l1.Get(ctx, key)
+}
+
+func (l1 tieredL1) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	return l1.tiered.l1.Set(ctx, key, value, l1.tiered.capTTL(ttl))
+}
+
+func (l1 tieredL1) Remove(ctx context.Context, key string) error {
+	return l1.tiered.l1.Remove(ctx, key)
+}
+
+func (l1 tieredL1) Unwrap() CacheRepository {
+	return l1.tiered.l1
+}
@@ -0,0 +1,106 @@
+package cache_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestTieredRepositoryPopulatesL1FromL2(t *testing.T) {
+	l1, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer l1.Close()
+	l2, server := newRedisRepository(t)
+	repo := cache.NewTieredRepository(l1, l2, cache.TieredOptions{L1TTL: time.Minute}, metrics)
+	ctx := context.Background()
+
+	_ = server.Set("key", "value")
+
+	for i := 0; i < 3; i++ {
+		if value, err := repo.Get(ctx, "key"); err != nil || string(value) != "value" {
+			t.Fatalf("expected value, got %s %v", value, err)
+		}
+	}
+	if value, err := l1.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Fatalf("expected the l2 hit to be copied to l1, got %s %v", value, err)
+	}
+
+	if hits := testutil.ToFloat64(metrics.CacheTierHitCounter.WithLabelValues(cache.TierL2)); hits != 1 {
+		t.Errorf("expected 1 l2 hit, got %v", hits)
+	}
+	if hits := testutil.ToFloat64(metrics.CacheTierHitCounter.WithLabelValues(cache.TierL1)); hits != 2 {
+		t.Errorf("expected 2 l1 hits, got %v", hits)
+	}
+
+	if _, err := repo.Get(ctx, "missing"); !cache.IsNotFound(err) {
+		t.Errorf("expected a miss, got %v", err)
+	}
+}
+
+func TestTieredRepositoryCapsL1TTL(t *testing.T) {
+	l1, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer l1.Close()
+	l2, server := newRedisRepository(t)
+	repo := cache.NewTieredRepository(l1, l2, cache.TieredOptions{L1TTL: 20 * time.Millisecond}, metrics)
+	ctx := context.Background()
+
+	if err := repo.Set(ctx, "key", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if ttl := server.TTL("key"); ttl != time.Hour {
+		t.Errorf("expected the l2 ttl to be kept, got %v", ttl)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, err := l1.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Errorf("expected the l1 copy to expire, got %v", err)
+	}
+	if value, err := repo.Get(ctx, "key"); err != nil || string(value) != "value" {
+		t.Errorf("expected the entry to be served from l2, got %s %v", value, err)
+	}
+}
+
+func TestTieredL1OnlyReachesTheInProcessTier(t *testing.T) {
+	l1, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer l1.Close()
+	l2, server := newRedisRepository(t)
+	repo := cache.NewTieredRepository(l1, l2, cache.TieredOptions{L1TTL: 20 * time.Millisecond}, metrics)
+	ctx := context.Background()
+
+	if err := repo.L1().Set(ctx, "key", []byte("value"), time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists("key") {
+		t.Error("expected the l2 to be left alone")
+	}
+	if _, ok := cache.AsIterable(repo.L1()); !ok {
+		t.Error("expected the l1 to be iterable")
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	if _, err := l1.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Errorf("expected the l1 ttl to be capped, got %v", err)
+	}
+}
+
+func TestTieredRepositoryRemovesFromBothTiers(t *testing.T) {
+	l1, metrics := newMemoryRepository(t, cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 1})
+	defer l1.Close()
+	l2, server := newRedisRepository(t)
+	repo := cache.NewTieredRepository(l1, l2, cache.TieredOptions{L1TTL: time.Minute}, metrics)
+	ctx := context.Background()
+
+	_ = repo.Set(ctx, "key", []byte("value"), 0)
+	if err := repo.Remove(ctx, "key"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := l1.Get(ctx, "key"); !cache.IsNotFound(err) {
+		t.Errorf("expected the l1 copy to be removed, got %v", err)
+	}
+	if server.Exists("key") {
+		t.Error("expected the l2 entry to be removed")
+	}
+}
@@ -0,0 +1,161 @@
+package discovery
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+	// DefaultTimeout bounds the requests to the Kubernetes API.
+	DefaultTimeout = 5 * time.Second
+)
+
+// Discovery finds the addresses, host:port, of the sidecache replicas.
+type Discovery interface {
+	Addresses(ctx context.Context) ([]string, error)
+}
+
+// Static is a fixed list of addresses.
+type Static []string
+
+func (static Static) Addresses(ctx context.Context) ([]string, error) {
+	addresses := append([]string(nil), static...)
+	sort.Strings(addresses)
+	return addresses, nil
+}
+
+// Kubernetes lists the ready endpoints of a service through the Kubernetes API. Pods that aren't ready
+// are left out, so a replica is only discovered once its readiness probe passes.
+type Kubernetes struct {
+	APIServer string
+	Token     string
+	Namespace string
+	Service   string
+	// Port replaces the endpoint ports, the sidecache port is usually not the port of the service.
+	Port int
+	// Client defaults to a client with DefaultTimeout.
+	Client *http.Client
+}
+
+// NewKubernetes creates a discovery for a service of the namespace the process runs in, authenticated by
+// the service account of the pod. The namespace can be given as namespace/service.
+func NewKubernetes(service string, port int) (*Kubernetes, error) {
+	host, apiPort := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || apiPort == "" {
+		return nil, errors.New("kubernetes discovery requires running in a cluster")
+	}
+
+	token, err := ioutil.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, err
+	}
+	ca, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, errors.New("kubernetes discovery: invalid service account certificate")
+	}
+
+	namespace := ""
+	if i := strings.IndexByte(service, '/'); i >= 0 {
+		namespace, service = service[:i], service[i+1:]
+	} else {
+		current, err := ioutil.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, err
+		}
+		namespace = strings.TrimSpace(string(current))
+	}
+
+	return &Kubernetes{
+		APIServer: "https://" + net.JoinHostPort(host, apiPort),
+		Token:     strings.TrimSpace(string(token)),
+		Namespace: namespace,
+		Service:   service,
+		Port:      port,
+		Client: &http.Client{
+			Timeout:   DefaultTimeout,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+	}, nil
+}
+
+type endpoints struct {
+	Subsets []struct {
+		Addresses []struct {
+			IP string `json:"ip"`
+		} `json:"addresses"`
+		Ports []struct {
+			Port int `json:"port"`
+		} `json:"ports"`
+	} `json:"subsets"`
+}
+
+func (kubernetes *Kubernetes) Addresses(ctx context.Context) ([]string, error) {
+	url := fmt.Sprintf("%s/api/v1/namespaces/%s/endpoints/%s", kubernetes.APIServer, kubernetes.Namespace, kubernetes.Service)
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	if kubernetes.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+kubernetes.Token)
+	}
+
+	client := kubernetes.Client
+	if client == nil {
+		client = &http.Client{Timeout: DefaultTimeout}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("kubernetes discovery: endpoints of %s/%s: %s", kubernetes.Namespace, kubernetes.Service, resp.Status)
+	}
+
+	var result endpoints
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]struct{})
+	addresses := []string{}
+	for _, subset := range result.Subsets {
+		ports := []int{kubernetes.Port}
+		if kubernetes.Port <= 0 {
+			ports = ports[:0]
+			for _, port := range subset.Ports {
+				ports = append(ports, port.Port)
+			}
+		}
+		for _, address := range subset.Addresses {
+			for _, port := range ports {
+				hostPort := net.JoinHostPort(address.IP, strconv.Itoa(port))
+				if _, ok := seen[hostPort]; !ok {
+					seen[hostPort] = struct{}{}
+					addresses = append(addresses, hostPort)
+				}
+			}
+		}
+	}
+	sort.Strings(addresses)
+	return addresses, nil
+}
@@ -0,0 +1,50 @@
+package discovery_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/discovery"
+)
+
+func TestStaticReturnsSortedAddresses(t *testing.T) {
+	addresses, err := discovery.Static{"10.0.0.2:9191", "10.0.0.1:9191"}.Addresses(context.Background())
+	if err != nil || !reflect.DeepEqual(addresses, []string{"10.0.0.1:9191", "10.0.0.2:9191"}) {
+		t.Errorf("expected sorted addresses, got %v %v", addresses, err)
+	}
+}
+
+func TestKubernetesListsReadyEndpoints(t *testing.T) {
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v1/namespaces/shop/endpoints/products" || r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(`{"subsets": [{
+			"addresses": [{"ip": "10.0.0.2"}, {"ip": "10.0.0.1"}],
+			"notReadyAddresses": [{"ip": "10.0.0.3"}],
+			"ports": [{"port": 8080}]
+		}]}`))
+	}))
+	defer api.Close()
+
+	kubernetes := &discovery.Kubernetes{APIServer: api.URL, Token: "token", Namespace: "shop", Service: "products", Port: 9191}
+	addresses, err := kubernetes.Addresses(context.Background())
+	if err != nil || !reflect.DeepEqual(addresses, []string{"10.0.0.1:9191", "10.0.0.2:9191"}) {
+		t.Errorf("expected the ready endpoints on the sidecache port, got %v %v", addresses, err)
+	}
+
+	kubernetes.Port = 0
+	addresses, _ = kubernetes.Addresses(context.Background())
+	if !reflect.DeepEqual(addresses, []string{"10.0.0.1:8080", "10.0.0.2:8080"}) {
+		t.Errorf("expected the endpoint ports, got %v", addresses)
+	}
+
+	kubernetes.Service = "missing"
+	if _, err := kubernetes.Addresses(context.Background()); err == nil {
+		t.Error("expected an error for a missing service")
+	}
+}
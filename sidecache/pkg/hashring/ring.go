@@ -0,0 +1,126 @@
+package hashring
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const DefaultReplicas = 160
+
+// Ring maps keys to nodes by consistent hashing. Every node is placed on the ring replicas times, so
+// adding or removing a node only moves the keys between it and its neighbours.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	points   []point
+	nodes    map[string]struct{}
+}
+
+type point struct {
+	hash uint64
+	node string
+}
+
+func New(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	ring := &Ring{replicas: replicas, nodes: make(map[string]struct{})}
+	ring.Set(nodes...)
+	return ring
+}
+
+// Set replaces the nodes of the ring.
+func (ring *Ring) Set(nodes ...string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	ring.nodes = make(map[string]struct{}, len(nodes))
+	for _, node := range nodes {
+		ring.nodes[node] = struct{}{}
+	}
+	ring.rebuild()
+}
+
+func (ring *Ring) Add(node string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	if _, ok := ring.nodes[node]; ok {
+		return
+	}
+	ring.nodes[node] = struct{}{}
+	ring.rebuild()
+}
+
+func (ring *Ring) Remove(node string) {
+	ring.mu.Lock()
+	defer ring.mu.Unlock()
+
+	if _, ok := ring.nodes[node]; !ok {
+		return
+	}
+	delete(ring.nodes, node)
+	ring.rebuild()
+}
+
+// Get returns the node owning the key, or an empty string if the ring has no nodes.
+func (ring *Ring) Get(key string) string {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := Hash(key)
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i].hash >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.points[i].node
+}
+
+// Nodes returns the nodes of the ring in sorted order.
+func (ring *Ring) Nodes() []string {
+	ring.mu.RLock()
+	defer ring.mu.RUnlock()
+
+	nodes := make([]string, 0, len(ring.nodes))
+	for node := range ring.nodes {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	return nodes
+}
+
+func (ring *Ring) rebuild() {
+	points := make([]point, 0, len(ring.nodes)*ring.replicas)
+	for node := range ring.nodes {
+		for i := 0; i < ring.replicas; i++ {
+			points = append(points, point{hash: Hash(node + "#" + strconv.Itoa(i)), node: node})
+		}
+	}
+	sort.Slice(points, func(i, j int) bool {
+		if points[i].hash == points[j].hash {
+			return points[i].node < points[j].node
+		}
+		return points[i].hash < points[j].hash
+	})
+	ring.points = points
+}
+
+// Hash is fnv-1a followed by a 64 bit finalizer, fnv alone spreads similar node names poorly.
+func Hash(key string) uint64 {
+	hash := uint64(14695981039346656037)
+	for i := 0; i < len(key); i++ {
+		hash ^= uint64(key[i])
+		hash *= 1099511628211
+	}
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
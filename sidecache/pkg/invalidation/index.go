@@ -0,0 +1,166 @@
+package invalidation
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+)
+
+const DefaultIndexSize = 100000
+
+// Entry pairs a hashed cache key with the normalized url it was created for.
+type Entry struct {
+	Key string
+	URL string
+}
+
+// Index keeps track of cached urls and tags so that prefix, pattern and tag purges can be
+// resolved to hashed cache keys.
+type Index interface {
+	Add(key, url string, tags []string) error
+	Remove(key string) error
+	ByPrefix(prefix string) ([]Entry, error)
+	ByTag(tag string) ([]Entry, error)
+}
+
+// Lookup is implemented by indexes that can tell the url and tags a key was cached for.
+type Lookup interface {
+	// Lookup returns false if the key is not indexed.
+	Lookup(key string) (url string, tags []string, ok bool, err error)
+}
+
+// Recent is implemented by indexes that can list the most recently cached urls.
+type Recent interface {
+	// Recent returns at most limit entries, the most recently indexed first.
+	Recent(limit int) ([]Entry, error)
+}
+
+type indexEntry struct {
+	Entry
+	tags []string
+}
+
+// MemoryIndex is an in-process Index bounded by the number of entries.
+// When it is full the oldest entry is forgotten, so purges by prefix or tag are best effort
+// for entries older than the last maxEntries fills.
+type MemoryIndex struct {
+	mu         sync.Mutex
+	maxEntries int
+	order      *list.List
+	entries    map[string]*list.Element
+	tags       map[string]map[string]struct{}
+}
+
+func NewMemoryIndex(maxEntries int) *MemoryIndex {
+	if maxEntries <= 0 {
+		maxEntries = DefaultIndexSize
+	}
+	return &MemoryIndex{
+		maxEntries: maxEntries,
+		order:      list.New(),
+		entries:    make(map[string]*list.Element),
+		tags:       make(map[string]map[string]struct{}),
+	}
+}
+
+func (index *MemoryIndex) Add(key, url string, tags []string) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if element, ok := index.entries[key]; ok {
+		index.removeElement(element)
+	}
+
+	element := index.order.PushFront(&indexEntry{Entry: Entry{Key: key, URL: url}, tags: tags})
+	index.entries[key] = element
+	for _, tag := range tags {
+		keys, ok := index.tags[tag]
+		if !ok {
+			keys = make(map[string]struct{})
+			index.tags[tag] = keys
+		}
+		keys[key] = struct{}{}
+	}
+
+	for index.order.Len() > index.maxEntries {
+		index.removeElement(index.order.Back())
+	}
+	return nil
+}
+
+func (index *MemoryIndex) Remove(key string) error {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	if element, ok := index.entries[key]; ok {
+		index.removeElement(element)
+	}
+	return nil
+}
+
+func (index *MemoryIndex) ByPrefix(prefix string) ([]Entry, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	var result []Entry
+	for _, element := range index.entries {
+		entry := element.Value.(*indexEntry)
+		if strings.HasPrefix(entry.URL, prefix) {
+			result = append(result, entry.Entry)
+		}
+	}
+	return result, nil
+}
+
+func (index *MemoryIndex) ByTag(tag string) ([]Entry, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	keys := index.tags[tag]
+	result := make([]Entry, 0, len(keys))
+	for key := range keys {
+		result = append(result, index.entries[key].Value.(*indexEntry).Entry)
+	}
+	return result, nil
+}
+
+func (index *MemoryIndex) Lookup(key string) (string, []string, bool, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	element, ok := index.entries[key]
+	if !ok {
+		return "", nil, false, nil
+	}
+	entry := element.Value.(*indexEntry)
+	return entry.URL, entry.tags, true, nil
+}
+
+func (index *MemoryIndex) Recent(limit int) ([]Entry, error) {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+
+	var result []Entry
+	for element := index.order.Front(); element != nil && len(result) < limit; element = element.Next() {
+		result = append(result, element.Value.(*indexEntry).Entry)
+	}
+	return result, nil
+}
+
+func (index *MemoryIndex) Len() int {
+	index.mu.Lock()
+	defer index.mu.Unlock()
+	return index.order.Len()
+}
+
+func (index *MemoryIndex) removeElement(element *list.Element) {
+	entry := index.order.Remove(element).(*indexEntry)
+	delete(index.entries, entry.Key)
+	for _, tag := range entry.tags {
+		keys := index.tags[tag]
+		delete(keys, entry.Key)
+		if len(keys) == 0 {
+			delete(index.tags, tag)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package invalidation
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// Rule maps a write endpoint to the cached urls it affects.
+//
+//	{"methods": ["POST"], "path": "/products/{id}/reviews",
+//	 "purge": ["/products/{id}", "/products/{id}/reviews?page=*", "tag:product-{id}"]}
+//
+// Path segments written as {name} capture the request path segment, `*` matches any segment.
+// Captured values are substituted into the purge targets.
+type Rule struct {
+	Methods []string `json:"methods"`
+	Path    string   `json:"path"`
+	Purge   []string `json:"purge"`
+
+	segments []string
+}
+
+type Rules struct {
+	rules []Rule
+}
+
+func LoadRules(file string) (*Rules, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var rules []Rule
+	if err := json.Unmarshal(content, &rules); err != nil {
+		return nil, fmt.Errorf("could not parse invalidation rules: %w", err)
+	}
+
+	return NewRules(rules)
+}
+
+func NewRules(rules []Rule) (*Rules, error) {
+	compiled := make([]Rule, 0, len(rules))
+	for i, rule := range rules {
+		if !strings.HasPrefix(rule.Path, "/") {
+			return nil, fmt.Errorf("rule %d: path must start with a slash: %q", i, rule.Path)
+		}
+		if len(rule.Purge) == 0 {
+			return nil, fmt.Errorf("rule %d: at least one purge target is required", i)
+		}
+
+		rule.segments = strings.Split(strings.Trim(rule.Path, "/"), "/")
+		params := map[string]bool{}
+		for _, segment := range rule.segments {
+			if name, ok := paramName(segment); ok {
+				params[name] = true
+			}
+		}
+		for _, target := range rule.Purge {
+			for _, name := range placeholders(target) {
+				if !params[name] {
+					return nil, fmt.Errorf("rule %d: purge target %q uses unknown parameter {%s}", i, target, name)
+				}
+			}
+		}
+
+		for j := range rule.Methods {
+			rule.Methods[j] = strings.ToUpper(rule.Methods[j])
+		}
+		compiled = append(compiled, rule)
+	}
+
+	return &Rules{rules: compiled}, nil
+}
+
+// Match returns the purge targets of all rules matching the write request.
+func (r *Rules) Match(method, requestPath string) []Target {
+	if r == nil {
+		return nil
+	}
+
+	var targets []Target
+	segments := strings.Split(strings.Trim(requestPath, "/"), "/")
+	for _, rule := range r.rules {
+		if !rule.matchesMethod(method) {
+			continue
+		}
+		params, ok := rule.capture(segments)
+		if !ok {
+			continue
+		}
+		for _, target := range rule.Purge {
+			targets = append(targets, ParseTarget(expand(target, params)))
+		}
+	}
+
+	return targets
+}
+
+func (r *Rules) Len() int {
+	if r == nil {
+		return 0
+	}
+	return len(r.rules)
+}
+
+func (rule Rule) matchesMethod(method string) bool {
+	if len(rule.Methods) == 0 {
+		return true
+	}
+	for _, m := range rule.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (rule Rule) capture(segments []string) (map[string]string, bool) {
+	if len(segments) != len(rule.segments) {
+		return nil, false
+	}
+
+	params := map[string]string{}
+	for i, segment := range rule.segments {
+		if name, ok := paramName(segment); ok {
+			if segments[i] == "" {
+				return nil, false
+			}
+			params[name] = segments[i]
+			continue
+		}
+		if segment != "*" && segment != segments[i] {
+			return nil, false
+		}
+	}
+	return params, true
+}
+
+func paramName(segment string) (string, bool) {
+	if len(segment) > 2 && strings.HasPrefix(segment, "{") && strings.HasSuffix(segment, "}") {
+		return segment[1 : len(segment)-1], true
+	}
+	return "", false
+}
+
+func placeholders(s string) []string {
+	var names []string
+	for {
+		start := strings.Index(s, "{")
+		if start < 0 {
+			return names
+		}
+		end := strings.Index(s[start:], "}")
+		if end < 0 {
+			return names
+		}
+		names = append(names, s[start+1:start+end])
+		s = s[start+end+1:]
+	}
+}
+
+func expand(s string, params map[string]string) string {
+	for name, value := range params {
+		s = strings.Replace(s, "{"+name+"}", value, -1)
+	}
+	return s
+}
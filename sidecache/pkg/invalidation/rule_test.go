@@ -0,0 +1,91 @@
+package invalidation_test
+
+import (
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+)
+
+func TestRulesMatchExpandsCapturedParameters(t *testing.T) {
+	rules, err := invalidation.NewRules([]invalidation.Rule{
+		{
+			Methods: []string{"post"},
+			Path:    "/products/{id}/reviews",
+			Purge:   []string{"/products/{id}", "/products/{id}/reviews?page=*", "prefix:/products/{id}/", "tag:product-{id}"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	targets := rules.Match("POST", "/products/42/reviews")
+	expected := []invalidation.Target{
+		{Kind: invalidation.URLTarget, Value: "/products/42"},
+		{Kind: invalidation.URLTarget, Value: "/products/42/reviews?page=*"},
+		{Kind: invalidation.PrefixTarget, Value: "/products/42/"},
+		{Kind: invalidation.TagTarget, Value: "product-42"},
+	}
+	if len(targets) != len(expected) {
+		t.Fatalf("expected %d targets, got %v", len(expected), targets)
+	}
+	for i := range expected {
+		if targets[i] != expected[i] {
+			t.Errorf("target %d: expected %v, got %v", i, expected[i], targets[i])
+		}
+	}
+
+	if targets := rules.Match("PUT", "/products/42/reviews"); len(targets) != 0 {
+		t.Errorf("expected no targets for other methods, got %v", targets)
+	}
+	if targets := rules.Match("POST", "/products/42"); len(targets) != 0 {
+		t.Errorf("expected no targets for other paths, got %v", targets)
+	}
+}
+
+func TestNewRulesRejectsUnknownParameters(t *testing.T) {
+	_, err := invalidation.NewRules([]invalidation.Rule{
+		{Path: "/products/{id}", Purge: []string{"/sellers/{sellerId}"}},
+	})
+	if err == nil {
+		t.Fatal("expected an error for an unknown parameter")
+	}
+}
+
+func TestTargetMatches(t *testing.T) {
+	cases := []struct {
+		target string
+		url    string
+		match  bool
+	}{
+		{"/products/42/reviews?page=*", "/products/42/reviews?page=3", true},
+		{"/products/42/reviews?page=*", "/products/42/reviews?page=3&size=10", true},
+		{"/products/42/reviews?page=*", "/products/42/reviews?", false},
+		{"/products/42/reviews?page=2", "/products/42/reviews?page=3", false},
+		{"/products/*/reviews", "/products/7/reviews?page=1", true},
+		{"prefix:/products/42/", "/products/42/reviews?page=1", true},
+		{"prefix:/products/42/", "/products/421?", false},
+	}
+
+	for _, c := range cases {
+		if got := invalidation.ParseTarget(c.target).Matches(c.url); got != c.match {
+			t.Errorf("%s matches %s: expected %v, got %v", c.target, c.url, c.match, got)
+		}
+	}
+}
+
+func TestMemoryIndexForgetsOldestEntries(t *testing.T) {
+	index := invalidation.NewMemoryIndex(2)
+	_ = index.Add("k1", "/products/1?", []string{"product-1"})
+	_ = index.Add("k2", "/products/2?", []string{"product-2"})
+	_ = index.Add("k3", "/products/3?", []string{"product-3"})
+
+	if entries, _ := index.ByTag("product-1"); len(entries) != 0 {
+		t.Errorf("expected the oldest entry to be forgotten, got %v", entries)
+	}
+	if entries, _ := index.ByPrefix("/products/"); len(entries) != 2 {
+		t.Errorf("expected 2 entries, got %v", entries)
+	}
+	if entries, _ := index.Recent(1); len(entries) != 1 || entries[0].Key != "k3" {
+		t.Errorf("expected the most recent entry, got %v", entries)
+	}
+}
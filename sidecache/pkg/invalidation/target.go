@@ -0,0 +1,127 @@
+package invalidation
+
+import (
+	"net/url"
+	"path"
+	"strings"
+)
+
+const (
+	tagTargetPrefix    = "tag:"
+	prefixTargetPrefix = "prefix:"
+)
+
+type TargetKind int
+
+const (
+	// URLTarget purges a single url. The url may contain `*` wildcards in its path
+	// or query values, e.g. /products/42/reviews?page=*
+	URLTarget TargetKind = iota
+	// PrefixTarget purges every indexed url whose path starts with the value.
+	PrefixTarget
+	// TagTarget purges every indexed url tagged by the upstream with the value.
+	TagTarget
+)
+
+type Target struct {
+	Kind  TargetKind
+	Value string
+}
+
+// ParseTarget parses a purge target in the form of `/url?a=b`, `prefix:/path/` or `tag:name`.
+func ParseTarget(s string) Target {
+	s = strings.TrimSpace(s)
+	switch {
+	case strings.HasPrefix(s, tagTargetPrefix):
+		return Target{Kind: TagTarget, Value: strings.TrimSpace(strings.TrimPrefix(s, tagTargetPrefix))}
+	case strings.HasPrefix(s, prefixTargetPrefix):
+		return Target{Kind: PrefixTarget, Value: ensureSlashPrefix(strings.TrimSpace(strings.TrimPrefix(s, prefixTargetPrefix)))}
+	default:
+		return Target{Kind: URLTarget, Value: ensureSlashPrefix(s)}
+	}
+}
+
+func (t Target) String() string {
+	switch t.Kind {
+	case TagTarget:
+		return tagTargetPrefix + t.Value
+	case PrefixTarget:
+		return prefixTargetPrefix + t.Value
+	default:
+		return t.Value
+	}
+}
+
+// IsPattern reports whether the target is a url containing wildcards, which has to be
+// resolved against the index instead of being hashed directly.
+func (t Target) IsPattern() bool {
+	return t.Kind == URLTarget && strings.Contains(t.Value, "*")
+}
+
+// LiteralPrefix returns the part of the target path that precedes the first wildcard.
+// It is used to narrow down index lookups for patterns.
+func (t Target) LiteralPrefix() string {
+	p := t.Value
+	if i := strings.IndexAny(p, "?"); i >= 0 {
+		p = p[:i]
+	}
+	if i := strings.Index(p, "*"); i >= 0 {
+		p = p[:i]
+	}
+	return p
+}
+
+// Matches reports whether the given normalized url (path?query) is covered by the target.
+// Query parameters of a url target must all be present in the url; `*` matches any value.
+// Extra query parameters of the url are ignored.
+func (t Target) Matches(rawURL string) bool {
+	switch t.Kind {
+	case PrefixTarget:
+		return strings.HasPrefix(rawURL, t.Value)
+	case URLTarget:
+		pattern, err := url.Parse(t.Value)
+		if err != nil {
+			return false
+		}
+		candidate, err := url.Parse(rawURL)
+		if err != nil {
+			return false
+		}
+
+		if ok, _ := path.Match(pattern.Path, candidate.Path); !ok {
+			return false
+		}
+
+		candidateQuery := candidate.Query()
+		for key, values := range pattern.Query() {
+			candidateValues, ok := candidateQuery[key]
+			if !ok {
+				return false
+			}
+			for _, v := range values {
+				if v != "*" && !contains(candidateValues, v) {
+					return false
+				}
+			}
+		}
+		return true
+	default:
+		return false
+	}
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func ensureSlashPrefix(s string) string {
+	if !strings.HasPrefix(s, "/") {
+		return "/" + s
+	}
+	return s
+}
@@ -6,98 +6,162 @@ import (
 )
 
 var (
-	gauge = prometheus.NewGauge(
+	buildInfoGaugeVec = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: "sidecache",
-			Name:      "cache_hit",
-			Help:      "This is cache hit metric",
-		})
+			Name: "sidecache_admission_build_info",
+			Help: "Build info for sidecache admission webhook",
+		}, []string{"version"})
+)
 
-	cacheHitCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "sidecache",
-			Name:      "cache_hit_counter",
-			Help:      "Cache hit count",
-		})
+type Prometheus struct {
+	CacheHitCounter     prometheus.Counter
+	TotalRequestCounter prometheus.Counter
+	PurgeRequestCounter prometheus.Counter
+	PurgeSuccessCounter prometheus.Counter
+	CacheErrorCounter   prometheus.Counter
+	CacheWarnCounter    prometheus.Counter
+	ProxyErrorCounter   prometheus.Counter
 
-	totalRequestCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "sidecache",
-			Name:      "all_request_hit_counter",
-			Help:      "All request hit counter",
-		})
+	// CacheRequestCounter counts the proxied requests by outcome, hit, miss, bypass or error.
+	CacheRequestCounter *prometheus.CounterVec
+	// CacheBackendErrorCounter counts the failed operations of the cache backend by operation, get,
+	// set, remove or index.
+	CacheBackendErrorCounter *prometheus.CounterVec
 
-	purgeRequestCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "sidecache",
-			Name:      "purge_request_counter",
-			Help:      "Purge request counter",
-		})
+	CacheEvictionCounter prometheus.Counter
+	// CacheSizeBytesGauge and CacheItemsGauge report the in-memory caches by tier: memory, the l1 of the
+	// tiered cache or the mirror of hot peer keys.
+	CacheSizeBytesGauge *prometheus.GaugeVec
+	CacheItemsGauge     *prometheus.GaugeVec
 
-	purgeSuccessCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "sidecache",
-			Name:      "purge_success_counter",
-			Help:      "Purge success counter",
-		})
+	CacheDiskSizeBytesGauge prometheus.Gauge
+	CacheDiskItemsGauge     prometheus.Gauge
 
-	cacheErrorCounter = prometheus.NewCounter(
-		prometheus.CounterOpts{
-			Namespace: "sidecache",
-			Name:      "cache_error_counter",
-			Help:      "Cache error counter",
-		})
+	CacheWriteQueueDepthGauge prometheus.Gauge
+	CacheWriteDropCounter     prometheus.Counter
+	// CacheRefreshCounter counts the popular entries refreshed before they expired.
+	CacheRefreshCounter prometheus.Counter
+
+	// CacheBreakerStateGauge is 0 while the circuit breaker is closed, 1 while half-open and 2 while open.
+	CacheBreakerStateGauge prometheus.Gauge
+
+	// CacheTierHitCounter counts hits of the tiered repository by tier, l1 or l2.
+	CacheTierHitCounter *prometheus.CounterVec
+
+	CacheShardHealthyNodesGauge prometheus.Gauge
+	// CacheShardEjectionCounter counts the ejections of shard nodes by node.
+	CacheShardEjectionCounter *prometheus.CounterVec
+
+	CachePeersGauge prometheus.Gauge
+	// CachePeerRequestCounter counts the lookups of keys owned by other peers by result, hit, miss,
+	// mirror or error.
+	CachePeerRequestCounter *prometheus.CounterVec
+}
+
+// NewPrometheusClient creates the sidecache metrics and registers them to the default registry.
+func NewPrometheusClient() *Prometheus {
+	prometheus.MustRegister(buildInfoGaugeVec)
+	return NewPrometheus(prometheus.DefaultRegisterer)
+}
+
+// NewPrometheus creates the sidecache metrics and registers them to the given registerer.
+// Tests use it with a fresh registry to avoid duplicate registrations.
+func NewPrometheus(registerer prometheus.Registerer) *Prometheus {
+	metrics := &Prometheus{
+		CacheHitCounter:     newCounter("cache_hit_counter", "Cache hit count"),
+		TotalRequestCounter: newCounter("all_request_hit_counter", "All request hit counter"),
+		PurgeRequestCounter: newCounter("purge_request_counter", "Purge request counter"),
+		PurgeSuccessCounter: newCounter("purge_success_counter", "Purge success counter"),
+		CacheErrorCounter:   newCounter("cache_error_counter", "Cache error counter"),
+		CacheWarnCounter:    newCounter("cache_warn_counter", "Cache warn counter"),
+		ProxyErrorCounter:   newCounter("proxy_error_counter", "Proxy error counter"),
+
+		CacheRequestCounter:      newCounterVec("cache_request_counter", "Cache request count by outcome", "outcome"),
+		CacheBackendErrorCounter: newCounterVec("cache_backend_error_counter", "Cache backend error count by operation", "operation"),
+
+		CacheEvictionCounter: newCounter("cache_eviction_counter", "Cache eviction counter"),
+		CacheSizeBytesGauge:  newGaugeVec("cache_size_bytes", "Cache size in bytes by tier", "tier"),
+		CacheItemsGauge:      newGaugeVec("cache_items", "Cache item count by tier", "tier"),
+
+		CacheDiskSizeBytesGauge: newGauge("cache_disk_size_bytes", "Disk cache size in bytes"),
+		CacheDiskItemsGauge:     newGauge("cache_disk_items", "Disk cache item count"),
+
+		CacheWriteQueueDepthGauge: newGauge("cache_write_queue_depth", "Cache writes waiting in the write queue"),
+		CacheWriteDropCounter:     newCounter("cache_write_drop_counter", "Cache fills dropped because the write queue was full"),
+		CacheRefreshCounter:       newCounter("cache_refresh_counter", "Popular cache entries refreshed before they expired"),
+
+		CacheBreakerStateGauge: newGauge("cache_breaker_state", "Cache circuit breaker state, 0 closed, 1 half-open, 2 open"),
+
+		CacheTierHitCounter: newCounterVec("cache_tier_hit_counter", "Cache hit count by tier", "tier"),
+
+		CacheShardHealthyNodesGauge: newGauge("cache_shard_healthy_nodes", "Shard nodes receiving keys"),
+		CacheShardEjectionCounter:   newCounterVec("cache_shard_ejection_counter", "Shard node ejection count by node", "node"),
 
-	cacheWarnCounter = prometheus.NewCounter(
+		CachePeersGauge:         newGauge("cache_peers", "Peer replicas sharing the cache, including this one"),
+		CachePeerRequestCounter: newCounterVec("cache_peer_request_counter", "Lookups of keys owned by other peers by result", "result"),
+	}
+
+	registerer.MustRegister(metrics.CacheHitCounter,
+		metrics.TotalRequestCounter,
+		metrics.PurgeRequestCounter,
+		metrics.PurgeSuccessCounter,
+		metrics.CacheErrorCounter,
+		metrics.CacheWarnCounter,
+		metrics.ProxyErrorCounter,
+		metrics.CacheRequestCounter,
+		metrics.CacheBackendErrorCounter,
+		metrics.CacheEvictionCounter,
+		metrics.CacheSizeBytesGauge,
+		metrics.CacheItemsGauge,
+		metrics.CacheDiskSizeBytesGauge,
+		metrics.CacheDiskItemsGauge,
+		metrics.CacheWriteQueueDepthGauge,
+		metrics.CacheWriteDropCounter,
+		metrics.CacheRefreshCounter,
+		metrics.CacheBreakerStateGauge,
+		metrics.CacheTierHitCounter,
+		metrics.CacheShardHealthyNodesGauge,
+		metrics.CacheShardEjectionCounter,
+		metrics.CachePeersGauge,
+		metrics.CachePeerRequestCounter)
+
+	return metrics
+}
+
+func newCounter(name, help string) prometheus.Counter {
+	return prometheus.NewCounter(
 		prometheus.CounterOpts{
 			Namespace: "sidecache",
-			Name:      "cache_warn_counter",
-			Help:      "Cache warn counter",
+			Name:      name,
+			Help:      help,
 		})
+}
 
-	proxyErrorCounter = prometheus.NewCounter(
+func newCounterVec(name, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(
 		prometheus.CounterOpts{
 			Namespace: "sidecache",
-			Name:      "proxy_error_counter",
-			Help:      "Proxy error counter",
-		})
+			Name:      name,
+			Help:      help,
+		}, labels)
+}
 
-	buildInfoGaugeVec = prometheus.NewGaugeVec(
+func newGauge(name, help string) prometheus.Gauge {
+	return prometheus.NewGauge(
 		prometheus.GaugeOpts{
-			Name: "sidecache_admission_build_info",
-			Help: "Build info for sidecache admission webhook",
-		}, []string{"version"})
-)
-
-type Prometheus struct {
-	CacheHitCounter     prometheus.Counter
-	TotalRequestCounter prometheus.Counter
-	PurgeRequestCounter prometheus.Counter
-	PurgeSuccessCounter prometheus.Counter
-	CacheErrorCounter prometheus.Counter
-	CacheWarnCounter prometheus.Counter
-	ProxyErrorCounter prometheus.Counter
+			Namespace: "sidecache",
+			Name:      name,
+			Help:      help,
+		})
 }
 
-func NewPrometheusClient() *Prometheus {
-	prometheus.MustRegister(cacheHitCounter,
-		totalRequestCounter,
-		purgeRequestCounter,
-		purgeSuccessCounter,
-		buildInfoGaugeVec,
-		cacheErrorCounter,
-		cacheWarnCounter,
-		proxyErrorCounter)
-
-	return &Prometheus{
-		TotalRequestCounter: totalRequestCounter,
-		CacheHitCounter:     cacheHitCounter,
-		PurgeRequestCounter: purgeRequestCounter,
-		PurgeSuccessCounter: purgeSuccessCounter,
-		CacheErrorCounter:   cacheErrorCounter,
-		CacheWarnCounter:    cacheWarnCounter,
-		ProxyErrorCounter: proxyErrorCounter,
-	}
+func newGaugeVec(name, help string, labels ...string) *prometheus.GaugeVec {
+	return prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "sidecache",
+			Name:      name,
+			Help:      help,
+		}, labels)
 }
 
 func BuildInfo(admission string) {
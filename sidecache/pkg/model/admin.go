@@ -0,0 +1,69 @@
+package model
+
+import "time"
+
+// The admin endpoints with their defaults, shared by the cache server and its admin clients.
+const (
+	// AdminTokenHeaderKey carries the ADMIN_TOKEN to the admin endpoints.
+	AdminTokenHeaderKey = "Sidecache-Admin-Token"
+
+	InspectPath = "/sidecache/inspect"
+	KeysPath    = "/sidecache/keys"
+	WarmPath    = "/sidecache/warm"
+	ReadyPath   = "/sidecache/ready"
+
+	DefaultPreviewBytes = 1024
+	DefaultKeysLimit    = 20
+	MaxKeysLimit        = 1000
+
+	KeysOrderRecent = "recent"
+	KeysOrderTop    = "top"
+)
+
+// EntryInfo describes the cache entry of a url. Key is hex encoded, Size is the stored size and Preview
+// the start of the decoded body. Tags need an index that can look up keys, Hits, CachedAt, Age and
+// ExpiresAt are known for the keys tracked by this replica. Age is the time since the entry was cached, as
+// a duration like 1m30s.
+type EntryInfo struct {
+	URL       string            `json:"url"`
+	Key       string            `json:"key"`
+	Cached    bool              `json:"cached"`
+	Size      int               `json:"size,omitempty"`
+	Tags      []string          `json:"tags,omitempty"`
+	Hits      int               `json:"hits,omitempty"`
+	CachedAt  *time.Time        `json:"cachedAt,omitempty"`
+	Age       string            `json:"age,omitempty"`
+	ExpiresAt *time.Time        `json:"expiresAt,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	Preview   string            `json:"preview,omitempty"`
+	Truncated bool              `json:"truncated,omitempty"`
+}
+
+// KeyInfo is a listed cache key, hex encoded, with the url it was cached for.
+type KeyInfo struct {
+	Key  string `json:"key"`
+	URL  string `json:"url"`
+	Hits int    `json:"hits,omitempty"`
+}
+
+// WarmRequest is the body of POST /sidecache/warm, its fields override the options of the environment.
+// The url file is only taken from WARM_URLS_FILE, so a request can't read other files of the replica.
+type WarmRequest struct {
+	URLs        []string `json:"urls,omitempty"`
+	Concurrency int      `json:"concurrency,omitempty"`
+	Rate        int      `json:"rate,omitempty"`
+}
+
+// WarmProgress reports a running or the last finished warming. Fetched urls were cached from the
+// upstream, cached ones were in the cache already.
+type WarmProgress struct {
+	Running    bool       `json:"running"`
+	Source     string     `json:"source,omitempty"`
+	Total      int        `json:"total"`
+	Done       int        `json:"done"`
+	Fetched    int        `json:"fetched"`
+	Cached     int        `json:"cached"`
+	Failed     int        `json:"failed"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
@@ -4,6 +4,13 @@ import "strings"
 
 type PurgeRequest struct {
 	Url string `json:"url"`
+	// Targets are purged instead of Url when set, e.g. `/products/1`, `prefix:/products/` or `tag:product-1`.
+	Targets []string `json:"targets,omitempty"`
+}
+
+// PurgeResponse is returned for purges of targets.
+type PurgeResponse struct {
+	Removed int `json:"removed"`
 }
 
 func (pr *PurgeRequest) EnsureHasSlashPrefix() {
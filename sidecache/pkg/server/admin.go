@@ -0,0 +1,218 @@
+package server
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/klauspost/compress/gzip"
+	"github.com/valyala/fasthttp"
+)
+
+// The admin api is defined in model, so the admin clients don't depend on the server.
+const (
+	AdminTokenHeaderKey = model.AdminTokenHeaderKey
+	InspectPath         = model.InspectPath
+	KeysPath            = model.KeysPath
+
+	DefaultPreviewBytes = model.DefaultPreviewBytes
+	DefaultKeysLimit    = model.DefaultKeysLimit
+	MaxKeysLimit        = model.MaxKeysLimit
+
+	KeysOrderRecent = model.KeysOrderRecent
+	KeysOrderTop    = model.KeysOrderTop
+)
+
+// authorizeAdmin refuses the request unless it carries the admin token. The admin endpoints are served
+// on the sidecar port next to the cache, so they are refused while no token is configured.
+func (server *CacheServer) authorizeAdmin(ctx *fasthttp.RequestCtx) bool {
+	if server.AdminToken == "" {
+		ctx.SetStatusCode(http.StatusForbidden)
+		ctx.SetBodyString("the admin endpoints require ADMIN_TOKEN")
+		return false
+	}
+	if subtle.ConstantTimeCompare(ctx.Request.Header.Peek(AdminTokenHeaderKey), []byte(server.AdminToken)) != 1 {
+		ctx.SetStatusCode(http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// Inspect normalizes and hashes the url like a request for it and describes its cache entry, with up to
+// previewBytes of the decoded body.
+func (server *CacheServer) Inspect(rawURL string, previewBytes int) (model.EntryInfo, error) {
+	uri := fasthttp.AcquireURI()
+	defer fasthttp.ReleaseURI(uri)
+	if err := uri.Parse(nil, []byte(rawURL)); err != nil {
+		return model.EntryInfo{}, err
+	}
+
+	url := server.ReorderQueryStringFasthttp(uri)
+	hashedURL := server.HashURL(url)
+	info := model.EntryInfo{URL: url, Key: hex.EncodeToString([]byte(hashedURL))}
+
+	if lookup := server.lookup(); lookup != nil {
+		if _, tags, ok, err := lookup.Lookup(hashedURL); err == nil && ok {
+			info.Tags = tags
+		}
+	}
+	if tracked, ok := server.refresh.info(hashedURL); ok {
+		info.Hits = tracked.total
+		info.CachedAt = &tracked.cachedAt
+		info.Age = time.Since(tracked.cachedAt).Round(time.Millisecond).String()
+		if !tracked.expiresAt.IsZero() {
+			info.ExpiresAt = &tracked.expiresAt
+		}
+	}
+
+	value, err := server.CheckCache(hashedURL)
+	if cache.IsNotFound(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+
+	info.Cached = true
+	info.Size = len(value)
+	body := value
+	var cachedData model.CacheData
+	if cachedData.UnmarshalJSON(value) == nil {
+		// entries cached before CacheData was introduced are the bare gzipped body
+		body = cachedData.Body
+		info.Headers = cachedData.Headers
+	}
+	info.Preview, info.Truncated = previewBody(body, previewBytes)
+	return info, nil
+}
+
+// previewBody decodes the start of a cached body, which is gzipped unless it couldn't be decoded.
+func previewBody(body []byte, limit int) (string, bool) {
+	var reader io.Reader = bytes.NewReader(body)
+	if zr, err := gzip.NewReader(bytes.NewReader(body)); err == nil {
+		defer zr.Close()
+		reader = zr
+	}
+
+	preview, _ := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if len(preview) > limit {
+		return string(preview[:limit]), true
+	}
+	return string(preview), false
+}
+
+// Keys lists the most recently cached keys or the most hit keys, depending on order. It returns false
+// if the index or the hit tracking can't answer the order.
+func (server *CacheServer) Keys(order string, limit int) ([]model.KeyInfo, bool, error) {
+	switch order {
+	case "", KeysOrderRecent:
+		recent, ok := server.Index.(invalidation.Recent)
+		if !ok {
+			return nil, false, nil
+		}
+		entries, err := recent.Recent(limit)
+		if err != nil {
+			return nil, true, err
+		}
+
+		keys := make([]model.KeyInfo, 0, len(entries))
+		for _, entry := range entries {
+			key := model.KeyInfo{Key: hex.EncodeToString([]byte(entry.Key)), URL: entry.URL}
+			if tracked, ok := server.refresh.info(entry.Key); ok {
+				key.Hits = tracked.total
+			}
+			keys = append(keys, key)
+		}
+		return keys, true, nil
+	case KeysOrderTop:
+		if !server.refresh.tracking() {
+			return nil, false, nil
+		}
+
+		top := server.refresh.top(limit)
+		keys := make([]model.KeyInfo, 0, len(top))
+		for _, key := range top {
+			keys = append(keys, model.KeyInfo{Key: hex.EncodeToString([]byte(key.Key)), URL: key.URL, Hits: key.Hits})
+		}
+		return keys, true, nil
+	default:
+		return nil, false, nil
+	}
+}
+
+// InspectHandler answers GET /sidecache/inspect?url=/products?id=1&preview=1024.
+func (server *CacheServer) InspectHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	rawURL := string(args.Peek("url"))
+	if rawURL == "" {
+		ctx.SetStatusCode(http.StatusBadRequest)
+		ctx.SetBodyString("the url parameter is required")
+		return
+	}
+	previewBytes := DefaultPreviewBytes
+	if value, err := strconv.Atoi(string(args.Peek("preview"))); err == nil && value >= 0 {
+		previewBytes = value
+	}
+
+	info, err := server.Inspect(rawURL, previewBytes)
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadGateway)
+		ctx.SetBodyString(err.Error())
+		return
+	}
+	if !info.Cached {
+		ctx.SetStatusCode(http.StatusNotFound)
+	}
+	writeJSON(ctx, info)
+}
+
+// KeysHandler answers GET /sidecache/keys?order=recent|top&limit=20.
+func (server *CacheServer) KeysHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		return
+	}
+
+	args := ctx.QueryArgs()
+	limit := DefaultKeysLimit
+	if value, err := strconv.Atoi(string(args.Peek("limit"))); err == nil && value > 0 {
+		limit = value
+	}
+	if limit > MaxKeysLimit {
+		limit = MaxKeysLimit
+	}
+
+	order := string(args.Peek("order"))
+	keys, ok, err := server.Keys(order, limit)
+	if !ok {
+		ctx.SetStatusCode(http.StatusNotImplemented)
+		ctx.SetBodyString("keys can't be listed by " + strconv.Quote(order) + " with this configuration")
+		return
+	}
+	if err != nil {
+		ctx.SetStatusCode(http.StatusBadGateway)
+		ctx.SetBodyString(err.Error())
+		return
+	}
+	writeJSON(ctx, keys)
+}
+
+func writeJSON(ctx *fasthttp.RequestCtx, value interface{}) {
+	body, _ := json.Marshal(value)
+	ctx.SetContentType("application/json")
+	ctx.SetBody(body)
+}
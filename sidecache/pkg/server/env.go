@@ -0,0 +1,79 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// envReader reads options from the environment and collects the variables that could not be parsed
+// or are out of range. They are replaced by their defaults, err reports them so startup can fail.
+type envReader struct {
+	malformed []string
+}
+
+// int reads a number of at least min.
+func (env *envReader) int(name string, defaultValue, min int) int {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value < min {
+		env.report(name, raw)
+		return defaultValue
+	}
+	return value
+}
+
+// float reads a number valid reports true for.
+func (env *envReader) float(name string, defaultValue float64, valid func(float64) bool) float64 {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := strconv.ParseFloat(raw, 64)
+	if err != nil || !valid(value) {
+		env.report(name, raw)
+		return defaultValue
+	}
+	return value
+}
+
+// duration reads a positive duration.
+func (env *envReader) duration(name string, defaultValue time.Duration) time.Duration {
+	raw := os.Getenv(name)
+	if raw == "" {
+		return defaultValue
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil || value <= 0 {
+		env.report(name, raw)
+		return defaultValue
+	}
+	return value
+}
+
+func (env *envReader) report(name, value string) {
+	env.malformed = append(env.malformed, fmt.Sprintf("%s=%q", name, value))
+}
+
+func (env *envReader) err() error {
+	if len(env.malformed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("malformed environment variables: %s", strings.Join(env.malformed, ", "))
+}
+
+// ValidateEnv returns an error naming the malformed variables of the options NewServer reads from the
+// environment, or nil. NewServer replaces them by their defaults, so they are checked on startup.
+func ValidateEnv() error {
+	env := &envReader{}
+	readCacheOptions(env)
+	readWritePipelineOptions(env)
+	readSnapshotOptions(env)
+	readRefreshOptions(env)
+	return env.err()
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+)
+
+// inflightFills tracks the fills between taking their generation and being indexed. Tag, prefix and
+// pattern invalidations resolve their keys through the index, which doesn't know these fills yet, so
+// the invalidations bump the generations of the matching in-flight fills as well.
+type inflightFills struct {
+	mu    sync.Mutex
+	fills map[string]*inflightFill
+}
+
+// inflightFill is a key being filled by count requests. The tags are known once a response arrived.
+type inflightFill struct {
+	url       string
+	tags      []string
+	tagsKnown bool
+	count     int
+}
+
+func newInflightFills() *inflightFills {
+	return &inflightFills{fills: make(map[string]*inflightFill)}
+}
+
+// begin registers a fill of the key. It must be called before the generation of the key is taken.
+func (inflight *inflightFills) begin(key, url string) {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+
+	f, ok := inflight.fills[key]
+	if !ok {
+		f = &inflightFill{url: url}
+		inflight.fills[key] = f
+	}
+	f.count++
+}
+
+// received records the tags of a fetched response of the key.
+func (inflight *inflightFills) received(key string, tags []string) {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+
+	if f, ok := inflight.fills[key]; ok {
+		f.tags = append(f.tags, tags...)
+		f.tagsKnown = true
+	}
+}
+
+// end unregisters a fill of the key once it was indexed, discarded or failed.
+func (inflight *inflightFills) end(key string) {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+
+	if f, ok := inflight.fills[key]; ok {
+		if f.count--; f.count <= 0 {
+			delete(inflight.fills, key)
+		}
+	}
+}
+
+// matching returns the keys of the in-flight fills the target may cover. Fills whose response hasn't
+// arrived yet may carry any tag, so they match every tag target.
+func (inflight *inflightFills) matching(target invalidation.Target) []string {
+	inflight.mu.Lock()
+	defer inflight.mu.Unlock()
+
+	var keys []string
+	for key, f := range inflight.fills {
+		if matchesFill(target, f) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func matchesFill(target invalidation.Target, f *inflightFill) bool {
+	if target.Kind != invalidation.TagTarget {
+		return target.Matches(f.url)
+	}
+	if !f.tagsKnown {
+		return true
+	}
+	for _, tag := range f.tags {
+		if tag == target.Value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const CacheTagsHeaderKey = "Sidecache-Tags"
+const PurgeHeaderKey = "X-Sidecache-Purge"
+
+var lastInvalidationLoggedTimestamp = time.Now().Add(-fiveMinute)
+
+// applyInvalidationRules purges the urls affected by a successful write request.
+func (server *CacheServer) applyInvalidationRules(method, path string) {
+	targets := server.Rules.Match(method, path)
+	if len(targets) == 0 {
+		return
+	}
+
+	server.Metrics.PurgeRequestCounter.Inc()
+	if _, err := server.Invalidate(targets); err != nil {
+		server.logInvalidationError(err, method, path)
+		return
+	}
+	server.Metrics.PurgeSuccessCounter.Inc()
+}
+
+// applyPurgeHeader purges the targets listed by the upstream in the purge header,
+// e.g. `X-Sidecache-Purge: /a, /b?x=1, tag:product-42`. The header is not sent to the client.
+func (server *CacheServer) applyPurgeHeader(req *fasthttp.Request, resp *fasthttp.Response) {
+	headerValue := resp.Header.Peek(PurgeHeaderKey)
+	if len(headerValue) == 0 {
+		return
+	}
+
+	var targets []invalidation.Target
+	for _, value := range strings.Split(string(headerValue), ",") {
+		if strings.TrimSpace(value) != "" {
+			targets = append(targets, invalidation.ParseTarget(value))
+		}
+	}
+	resp.Header.Del(PurgeHeaderKey)
+
+	if len(targets) == 0 {
+		return
+	}
+
+	requestURI := string(req.RequestURI())
+	server.writes.enqueueRemoval(func() {
+		server.Metrics.PurgeRequestCounter.Inc()
+		if _, err := server.Invalidate(targets); err != nil {
+			server.logInvalidationError(err, PurgeHeaderKey, requestURI)
+			return
+		}
+		server.Metrics.PurgeSuccessCounter.Inc()
+	})
+}
+
+// Invalidate removes every cached entry covered by the targets and returns the number of removed keys.
+// It keeps going when a target fails and returns the last error.
+func (server *CacheServer) Invalidate(targets []invalidation.Target) (int, error) {
+	var (
+		removed int
+		lastErr error
+	)
+
+	for _, target := range targets {
+		if target.Kind != invalidation.URLTarget || target.IsPattern() {
+			// fills of matching urls that aren't indexed yet must not commit their responses either
+			for _, key := range server.inflight.matching(target) {
+				server.Generations.Bump(key)
+			}
+		}
+
+		keys, err := server.resolveTarget(target)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		for _, key := range keys {
+			if err := server.invalidateKey(key); err != nil {
+				lastErr = err
+				continue
+			}
+			removed++
+		}
+	}
+
+	return removed, lastErr
+}
+
+// invalidateKey bumps the generation of the key before removing it, so fills that were fetched
+// before the invalidation can not resurrect the entry.
+func (server *CacheServer) invalidateKey(key string) error {
+	server.Generations.Bump(key)
+	return server.removeKey(key)
+}
+
+// invalidateKeyAsync bumps the generation right away and removes the entry in the background.
+func (server *CacheServer) invalidateKeyAsync(key string) {
+	server.Generations.Bump(key)
+	server.writes.enqueueRemoval(func() {
+		if err := server.removeKey(key); err != nil {
+			server.logCacheError("cache remove error occurred", err)
+		}
+	})
+}
+
+func (server *CacheServer) removeKey(key string) error {
+	if server.Index != nil {
+		_ = server.Index.Remove(key)
+	}
+	server.refresh.forget(key)
+
+	ctx, cancel := server.cacheContext()
+	defer cancel()
+	return server.Repo.Remove(ctx, key)
+}
+
+func (server *CacheServer) resolveTarget(target invalidation.Target) ([]string, error) {
+	if target.Kind == invalidation.URLTarget && !target.IsPattern() {
+		targetURL, err := url.Parse(target.Value)
+		if err != nil {
+			return nil, err
+		}
+		return []string{server.HashURL(server.ReorderQueryString(targetURL))}, nil
+	}
+
+	if server.Index == nil {
+		return nil, nil
+	}
+
+	var (
+		entries []invalidation.Entry
+		err     error
+	)
+	switch target.Kind {
+	case invalidation.TagTarget:
+		entries, err = server.Index.ByTag(target.Value)
+	case invalidation.PrefixTarget:
+		entries, err = server.Index.ByPrefix(target.Value)
+	default:
+		entries, err = server.Index.ByPrefix(target.LiteralPrefix())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if target.Kind == invalidation.TagTarget || target.Matches(entry.URL) {
+			keys = append(keys, entry.Key)
+		}
+	}
+	return keys, nil
+}
+
+func (server *CacheServer) indexResponse(hashedURL, url string, tags []string) {
+	if server.Index == nil {
+		return
+	}
+	if err := server.Index.Add(hashedURL, url, tags); err != nil {
+		server.logInvalidationError(err, http.MethodGet, url)
+	}
+}
+
+func (server *CacheServer) logInvalidationError(err error, method, path string) {
+	allowed := time.Since(lastInvalidationLoggedTimestamp) > fiveMinute
+	if allowed {
+		server.Logger.Error("invalidation error occurred", zap.Error(err), zap.String("method", method), zap.String("path", path))
+		lastInvalidationLoggedTimestamp = time.Now()
+	}
+}
+
+func parseTags(headerValue []byte) []string {
+	if len(headerValue) == 0 {
+		return nil
+	}
+
+	var tags []string
+	for _, tag := range strings.Split(string(headerValue), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+func is2xxStatusCode(statusCode int) bool {
+	return statusCode >= 200 && statusCode < 300
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/metric"
+)
+
+const (
+	DefaultWriteWorkers      = 16
+	DefaultWriteQueueSize    = 10000
+	DefaultWriteFlushTimeout = 10 * time.Second
+)
+
+type WritePipelineOptions struct {
+	Workers   int
+	QueueSize int
+	// BatchSize is the maximum number of queued fills written at once to a backend implementing
+	// cache.BatchWriter, 1 disables batching.
+	BatchSize    int
+	FlushTimeout time.Duration
+}
+
+// WritePipelineOptionsFromEnv reads WRITE_WORKERS, WRITE_QUEUE_SIZE, WRITE_BATCH_SIZE and WRITE_FLUSH_TIMEOUT.
+func WritePipelineOptionsFromEnv() (WritePipelineOptions, error) {
+	env := &envReader{}
+	options := readWritePipelineOptions(env)
+	return options, env.err()
+}
+
+func readWritePipelineOptions(env *envReader) WritePipelineOptions {
+	return WritePipelineOptions{
+		Workers:      env.int("WRITE_WORKERS", DefaultWriteWorkers, 1),
+		QueueSize:    env.int("WRITE_QUEUE_SIZE", DefaultWriteQueueSize, 1),
+		BatchSize:    env.int("WRITE_BATCH_SIZE", 1, 1),
+		FlushTimeout: env.duration("WRITE_FLUSH_TIMEOUT", DefaultWriteFlushTimeout),
+	}
+}
+
+// writePipeline runs cache writes on a fixed number of workers instead of a goroutine per request.
+// Fills are dropped when the queue is full: losing a fill only costs a later miss. Removals are never
+// dropped, they run on the caller when the queue is full, which slows writes down instead of leaving
+// stale entries behind.
+type writePipeline struct {
+	jobs      chan writeJob
+	batchSize int
+	fill      func([]fill)
+	metrics   *metric.Prometheus
+
+	mu      sync.RWMutex
+	closed  bool
+	workers sync.WaitGroup
+}
+
+type writeJob struct {
+	fill *fill
+	run  func()
+}
+
+func newWritePipeline(options WritePipelineOptions, metrics *metric.Prometheus, fillFunc func([]fill)) *writePipeline {
+	if options.Workers <= 0 {
+		options.Workers = DefaultWriteWorkers
+	}
+	if options.QueueSize <= 0 {
+		options.QueueSize = DefaultWriteQueueSize
+	}
+	if options.BatchSize <= 0 {
+		options.BatchSize = 1
+	}
+
+	pipeline := &writePipeline{
+		jobs:      make(chan writeJob, options.QueueSize),
+		batchSize: options.BatchSize,
+		fill:      fillFunc,
+		metrics:   metrics,
+	}
+	pipeline.workers.Add(options.Workers)
+	for i := 0; i < options.Workers; i++ {
+		go pipeline.work()
+	}
+	return pipeline
+}
+
+// enqueueFill queues a fill, or drops it and returns false if the queue is full or closed.
+func (pipeline *writePipeline) enqueueFill(f fill) bool {
+	pipeline.mu.RLock()
+	defer pipeline.mu.RUnlock()
+
+	if !pipeline.closed && pipeline.push(writeJob{fill: &f}) {
+		return true
+	}
+	pipeline.metrics.CacheWriteDropCounter.Inc()
+	return false
+}
+
+// enqueueRemoval queues a removal, or runs it right away if the queue is full or closed.
+func (pipeline *writePipeline) enqueueRemoval(run func()) {
+	pipeline.mu.RLock()
+	queued := !pipeline.closed && pipeline.push(writeJob{run: run})
+	pipeline.mu.RUnlock()
+
+	if !queued {
+		run()
+	}
+}
+
+func (pipeline *writePipeline) push(job writeJob) bool {
+	select {
+	case pipeline.jobs <- job:
+		pipeline.metrics.CacheWriteQueueDepthGauge.Inc()
+		return true
+	default:
+		return false
+	}
+}
+
+// close stops accepting work and waits for the queued work to be written, at most for timeout.
+// It returns false if the timeout expired first.
+func (pipeline *writePipeline) close(timeout time.Duration) bool {
+	pipeline.mu.Lock()
+	if !pipeline.closed {
+		pipeline.closed = true
+		close(pipeline.jobs)
+	}
+	pipeline.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		pipeline.workers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+func (pipeline *writePipeline) work() {
+	defer pipeline.workers.Done()
+
+	for job := range pipeline.jobs {
+		pipeline.metrics.CacheWriteQueueDepthGauge.Dec()
+		if job.fill == nil {
+			job.run()
+			continue
+		}
+
+		// take the fills queued behind this one to write them as a batch
+		fills := []fill{*job.fill}
+		var next *writeJob
+	collect:
+		for len(fills) < pipeline.batchSize {
+			select {
+			case queued, ok := <-pipeline.jobs:
+				if !ok {
+					break collect
+				}
+				pipeline.metrics.CacheWriteQueueDepthGauge.Dec()
+				if queued.fill == nil {
+					next = &queued
+					break collect
+				}
+				fills = append(fills, *queued.fill)
+			default:
+				break collect
+			}
+		}
+
+		pipeline.fill(fills)
+		if next != nil {
+			next.run()
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/discovery"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/Trendyol/sidecache/pkg/snapshot"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	DumpPath  = "/sidecache/dump"
+	ReadyPath = model.ReadyPath
+
+	DefaultPreloadTimeout = 30 * time.Second
+)
+
+// PreloadOptions configure loading the cache before the replica reports ready. The snapshot file is
+// tried first, then the dump endpoints of the peers one by one.
+type PreloadOptions struct {
+	SnapshotFile string
+	Peers        discovery.Discovery
+	// Timeout is the deadline of the preload, the replica reports ready after it even if loading
+	// didn't finish.
+	Timeout time.Duration
+}
+
+// PreloadOptionsFromEnv reads WARM_SNAPSHOT_FILE, WARM_PEERS or WARM_K8S_SERVICE and WARM_TIMEOUT.
+// The SNAPSHOT_FILE the replica saves on shutdown is reloaded if WARM_SNAPSHOT_FILE isn't set.
+func PreloadOptionsFromEnv() (PreloadOptions, error) {
+	env := &envReader{}
+	options := PreloadOptions{
+		SnapshotFile: os.Getenv("WARM_SNAPSHOT_FILE"),
+		Timeout:      env.duration("WARM_TIMEOUT", DefaultPreloadTimeout),
+	}
+	if options.SnapshotFile == "" {
+		options.SnapshotFile = os.Getenv("SNAPSHOT_FILE")
+	}
+
+	if peers := splitList(os.Getenv("WARM_PEERS")); len(peers) > 0 {
+		options.Peers = discovery.Static(peers)
+	} else if service := os.Getenv("WARM_K8S_SERVICE"); service != "" {
+		port := env.int("WARM_PEER_PORT", 9191, 1)
+		if err := env.err(); err != nil {
+			return options, err
+		}
+		peers, err := discovery.NewKubernetes(service, port)
+		if err != nil {
+			return options, err
+		}
+		options.Peers = peers
+	}
+	return options, env.err()
+}
+
+// Enabled reports whether a preload source is configured.
+func (options PreloadOptions) Enabled() bool {
+	return options.SnapshotFile != "" || options.Peers != nil
+}
+
+// SetReady changes what the readiness endpoint reports.
+func (server *CacheServer) SetReady(ready bool) {
+	var notReady int32
+	if !ready {
+		notReady = 1
+	}
+	atomic.StoreInt32(&server.notReady, notReady)
+}
+
+func (server *CacheServer) Ready() bool {
+	return atomic.LoadInt32(&server.notReady) == 0
+}
+
+// ReadyHandler answers the readiness probe, it fails while the cache is preloaded.
+func (server *CacheServer) ReadyHandler(ctx *fasthttp.RequestCtx) {
+	if !server.Ready() {
+		ctx.SetStatusCode(http.StatusServiceUnavailable)
+		ctx.SetBodyString("warming")
+		return
+	}
+	ctx.SetBodyString("ready")
+}
+
+// Preload loads the in-process cache from the configured sources and reports ready once done or when
+// the timeout passes. Expired entries are skipped, the others keep their remaining ttl. Backends shared
+// by the replicas aren't preloaded, an old snapshot would bring back entries purged meanwhile.
+func (server *CacheServer) Preload(options PreloadOptions) {
+	server.SetReady(false)
+	defer server.SetReady(true)
+
+	if server.LocalRepo == nil {
+		server.Logger.Warn("cache preload skipped", zap.Error(errNotInProcess))
+		return
+	}
+
+	timeout := options.Timeout
+	if timeout <= 0 {
+		timeout = DefaultPreloadTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	started := time.Now()
+	source, loaded, skipped, err := server.loadPreload(ctx, options)
+	if err != nil {
+		server.Logger.Warn("cache preload failed, starting with an empty cache", zap.Error(err))
+		return
+	}
+	server.Logger.Info("cache preloaded",
+		zap.String("source", source),
+		zap.Int("loaded", loaded),
+		zap.Int("skipped", skipped),
+		zap.Duration("duration", time.Since(started)),
+		zap.Bool("complete", ctx.Err() == nil))
+}
+
+// loadPreload loads the first source that can be read and returns its name with the loaded and skipped
+// records.
+func (server *CacheServer) loadPreload(ctx context.Context, options PreloadOptions) (string, int, int, error) {
+	var errs []string
+	if options.SnapshotFile != "" {
+		loaded, skipped, err := server.loadSnapshotFile(ctx, options.SnapshotFile)
+		if err == nil {
+			return options.SnapshotFile, loaded, skipped, nil
+		}
+		// there is no snapshot before the first shutdown
+		if !os.IsNotExist(err) {
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if options.Peers != nil {
+		peers, err := options.Peers.Addresses(ctx)
+		if err != nil {
+			errs = append(errs, err.Error())
+		}
+		for _, peer := range peers {
+			loaded, skipped, err := server.loadDump(ctx, peer)
+			if err == nil {
+				return peer, loaded, skipped, nil
+			}
+			errs = append(errs, err.Error())
+		}
+	}
+
+	if len(errs) == 0 {
+		return "", 0, 0, errors.New("no preload source")
+	}
+	return "", 0, 0, fmt.Errorf("no preload source answered: %v", errs)
+}
+
+// LoadSnapshot streams the records of the snapshot that didn't expire into the in-process cache and
+// indexes their urls, verifying the checksum as it reads. The records of a corrupted snapshot are
+// removed again. Loading stops when the context is done, keeping the records loaded so far. It returns
+// the number of loaded and skipped records.
+func (server *CacheServer) LoadSnapshot(ctx context.Context, r io.Reader) (int, int, error) {
+	if server.LocalRepo == nil {
+		return 0, 0, errNotInProcess
+	}
+	reader, err := snapshot.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer reader.Close()
+
+	var keys []string
+	skipped := 0
+	for ctx.Err() == nil {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil && ctx.Err() != nil {
+			break
+		}
+		if err != nil {
+			server.unload(keys)
+			return 0, 0, err
+		}
+		now := time.Now()
+		if record.Expired(now) {
+			skipped++
+			continue
+		}
+
+		setCtx, cancel := context.WithTimeout(ctx, server.CacheTimeout)
+		err = server.LocalRepo.Set(setCtx, record.Key, record.Value, record.TTL(now))
+		cancel()
+		if err != nil {
+			skipped++
+			continue
+		}
+		if record.URL != "" {
+			server.indexResponse(record.Key, record.URL, record.Tags)
+		}
+		keys = append(keys, record.Key)
+	}
+	return len(keys), skipped, nil
+}
+
+// unload removes the loaded keys of a snapshot that turned out corrupted.
+func (server *CacheServer) unload(keys []string) {
+	for _, key := range keys {
+		ctx, cancel := context.WithTimeout(context.Background(), server.CacheTimeout)
+		_ = server.LocalRepo.Remove(ctx, key)
+		cancel()
+		if server.Index != nil {
+			_ = server.Index.Remove(key)
+		}
+	}
+}
+
+func (server *CacheServer) loadSnapshotFile(ctx context.Context, path string) (int, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	return server.LoadSnapshot(ctx, bufio.NewReader(file))
+}
+
+// loadDump streams the dump of the peer into the cache.
+func (server *CacheServer) loadDump(ctx context.Context, peer string) (int, int, error) {
+	req, err := http.NewRequest(http.MethodGet, "http://"+peer+DumpPath, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer %s: %w", peer, err)
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set(AdminTokenHeaderKey, server.AdminToken)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer %s: %w", peer, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, 0, fmt.Errorf("peer %s: status %d", peer, resp.StatusCode)
+	}
+	loaded, skipped, err := server.LoadSnapshot(ctx, resp.Body)
+	if err != nil {
+		return 0, 0, fmt.Errorf("peer %s: %w", peer, err)
+	}
+	return loaded, skipped, nil
+}
+
+// DumpHandler streams the entries of the in-process repository as a snapshot. Replicas that aren't ready
+// refuse, so a warming replica is never copied.
+func (server *CacheServer) DumpHandler(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Method()) != fasthttp.MethodGet {
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+		return
+	}
+	if !server.Ready() {
+		ctx.SetStatusCode(http.StatusServiceUnavailable)
+		return
+	}
+	if server.LocalRepo == nil {
+		ctx.SetStatusCode(http.StatusNotImplemented)
+		ctx.SetBodyString(errNotInProcess.Error())
+		return
+	}
+	iterable, ok := cache.AsIterable(server.LocalRepo)
+	if !ok {
+		ctx.SetStatusCode(http.StatusNotImplemented)
+		ctx.SetBodyString("the cache backend can't be dumped")
+		return
+	}
+
+	ctx.SetContentType("application/gzip")
+	ctx.SetBodyStreamWriter(func(w *bufio.Writer) {
+		if _, err := snapshot.Dump(context.Background(), iterable, server.lookup(), w); err != nil {
+			// the snapshot is left without trailer, so the reader rejects it
+			server.Logger.Warn("cache dump failed", zap.Error(err))
+		}
+	})
+}
+
+// lookup returns the index as invalidation.Lookup if it can tell the urls of keys.
+func (server *CacheServer) lookup() invalidation.Lookup {
+	lookup, _ := server.Index.(invalidation.Lookup)
+	return lookup
+}
+
+func splitList(value string) []string {
+	var values []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			values = append(values, item)
+		}
+	}
+	return values
+}
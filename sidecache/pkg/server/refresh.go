@@ -0,0 +1,240 @@
+package server
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	DefaultRefreshBeta    = 1.0
+	DefaultRefreshMaxKeys = 100000
+)
+
+// RefreshOptions configure tracking the hits of cached keys and refreshing popular entries before they
+// expire. The hits of up to MaxKeys keys are tracked, zero disables tracking. Keys hit at least
+// HitThreshold times are refreshed early with the XFetch algorithm: every hit refreshes the entry with
+// a probability growing as the expiry nears, scaled by the time the upstream took to answer and Beta.
+// TTLJitter shortens every ttl by a random fraction up to its value, so entries filled together don't
+// expire together.
+type RefreshOptions struct {
+	HitThreshold int
+	Beta         float64
+	MaxKeys      int
+	TTLJitter    float64
+}
+
+// RefreshOptionsFromEnv reads REFRESH_HIT_THRESHOLD, REFRESH_BETA, REFRESH_MAX_KEYS and CACHE_TTL_JITTER.
+func RefreshOptionsFromEnv() (RefreshOptions, error) {
+	env := &envReader{}
+	options := readRefreshOptions(env)
+	return options, env.err()
+}
+
+func readRefreshOptions(env *envReader) RefreshOptions {
+	return RefreshOptions{
+		HitThreshold: env.int("REFRESH_HIT_THRESHOLD", 0, 0),
+		Beta:         env.float("REFRESH_BETA", DefaultRefreshBeta, func(beta float64) bool { return beta > 0 }),
+		MaxKeys:      env.int("REFRESH_MAX_KEYS", DefaultRefreshMaxKeys, 0),
+		TTLJitter:    env.float("CACHE_TTL_JITTER", 0, func(jitter float64) bool { return jitter >= 0 && jitter < 1 }),
+	}
+}
+
+// refresher tracks the hits, fill time, expiry and fetch time of the cached keys. The tracked keys also answer
+// the top keys of the admin api.
+type refresher struct {
+	options RefreshOptions
+	random  func() float64
+
+	mu      sync.Mutex
+	entries map[string]*refreshEntry
+}
+
+type refreshEntry struct {
+	url       string
+	uri       string
+	host      string
+	cachedAt  time.Time
+	expiresAt time.Time
+	delta     time.Duration
+	// hits counts the hits since the entry was written, total since the key was first tracked
+	hits       int
+	total      int
+	refreshing bool
+}
+
+// KeyHits is a cached key with its normalized url and hit count.
+type KeyHits struct {
+	Key  string
+	URL  string
+	Hits int
+}
+
+func newRefresher(options RefreshOptions) *refresher {
+	return &refresher{options: options, random: rand.Float64, entries: map[string]*refreshEntry{}}
+}
+
+func (refresher *refresher) tracking() bool {
+	return refresher.options.MaxKeys > 0
+}
+
+// jitter shortens the ttl by up to TTLJitter of it, ttls without expiry are kept.
+func (refresher *refresher) jitter(ttl time.Duration) time.Duration {
+	if refresher.options.TTLJitter <= 0 || ttl <= 0 {
+		return ttl
+	}
+	return ttl - time.Duration(refresher.random()*refresher.options.TTLJitter*float64(ttl))
+}
+
+// track records a written entry. The hits since the write start over, so a key is only refreshed while
+// it stays popular.
+func (refresher *refresher) track(f fill) {
+	if !refresher.tracking() {
+		return
+	}
+
+	now := time.Now()
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+
+	previous, ok := refresher.entries[f.hashedURL]
+	if !ok && len(refresher.entries) >= refresher.options.MaxKeys {
+		refresher.prune(now)
+		if len(refresher.entries) >= refresher.options.MaxKeys {
+			return
+		}
+	}
+
+	entry := &refreshEntry{url: f.url, uri: f.uri, host: f.host, cachedAt: now, delta: f.fetchTime}
+	if f.ttl > 0 {
+		entry.expiresAt = now.Add(f.ttl)
+	}
+	if ok {
+		entry.total = previous.total
+	}
+	refresher.entries[f.hashedURL] = entry
+}
+
+func (refresher *refresher) prune(now time.Time) {
+	for key, entry := range refresher.entries {
+		if !entry.expiresAt.IsZero() && !entry.expiresAt.After(now) {
+			delete(refresher.entries, key)
+		}
+	}
+}
+
+// hit counts a hit of the key and reports whether the entry should be refreshed now, in which case the
+// entry is marked until done is called.
+func (refresher *refresher) hit(key string) (refreshEntry, bool) {
+	if !refresher.tracking() {
+		return refreshEntry{}, false
+	}
+
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+
+	entry, ok := refresher.entries[key]
+	if !ok {
+		return refreshEntry{}, false
+	}
+	entry.hits++
+	entry.total++
+	if refresher.options.HitThreshold <= 0 || entry.expiresAt.IsZero() || entry.refreshing ||
+		entry.hits < refresher.options.HitThreshold {
+		return refreshEntry{}, false
+	}
+
+	// XFetch: refresh once now - delta * beta * ln(rand) passes the expiry, rand in (0, 1]
+	gap := -float64(entry.delta) * refresher.options.Beta * math.Log(1-refresher.random())
+	if time.Now().Add(time.Duration(gap)).Before(entry.expiresAt) {
+		return refreshEntry{}, false
+	}
+	entry.refreshing = true
+	return *entry, true
+}
+
+// done clears the mark of a key whose refresh won't be written: the response wasn't cacheable, was dropped
+// by the write pipeline or failed to be written. Written responses replace the entry.
+func (refresher *refresher) done(key string) {
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+
+	if entry, ok := refresher.entries[key]; ok {
+		entry.refreshing = false
+	}
+}
+
+// info returns the tracked hits, fill time and expiry of the key.
+func (refresher *refresher) info(key string) (refreshEntry, bool) {
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+
+	entry, ok := refresher.entries[key]
+	if !ok {
+		return refreshEntry{}, false
+	}
+	return *entry, true
+}
+
+// top returns the limit most hit keys that didn't expire, the most hit first.
+func (refresher *refresher) top(limit int) []KeyHits {
+	now := time.Now()
+	refresher.mu.Lock()
+	keys := make([]KeyHits, 0, len(refresher.entries))
+	for key, entry := range refresher.entries {
+		if entry.expiresAt.IsZero() || entry.expiresAt.After(now) {
+			keys = append(keys, KeyHits{Key: key, URL: entry.url, Hits: entry.total})
+		}
+	}
+	refresher.mu.Unlock()
+
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Hits != keys[j].Hits {
+			return keys[i].Hits > keys[j].Hits
+		}
+		return keys[i].URL < keys[j].URL
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
+
+func (refresher *refresher) forget(key string) {
+	if !refresher.tracking() {
+		return
+	}
+
+	refresher.mu.Lock()
+	defer refresher.mu.Unlock()
+	delete(refresher.entries, key)
+}
+
+// countHit counts the hit of a cached key and refreshes the entry in the background when it is due.
+func (server *CacheServer) countHit(hashedURL string) {
+	entry, due := server.refresh.hit(hashedURL)
+	if due {
+		go server.refreshEntry(hashedURL, entry)
+	}
+}
+
+// refreshEntry fetches the entry from the upstream through the reverse proxy path.
+func (server *CacheServer) refreshEntry(hashedURL string, entry refreshEntry) {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(entry.uri)
+	req.Header.SetHost(entry.host)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	server.Metrics.CacheRefreshCounter.Inc()
+	if !server.proxy(req, resp, hashedURL, true) {
+		// the response isn't cacheable or the write pipeline dropped it
+		server.refresh.done(hashedURL)
+	}
+}
@@ -2,6 +2,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -14,6 +15,8 @@ import (
 	"time"
 
 	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
 	"github.com/Trendyol/sidecache/pkg/model"
 	"github.com/klauspost/compress/gzip"
 	"github.com/minio/highwayhash"
@@ -27,45 +30,145 @@ const CacheHeaderKey = "cachable"
 const CacheHeaderEnabledKey = "Sidecache-Headers-Enabled"
 const applicationDefaultPort = ":9191"
 const DefaultReadBufferSize = 8 * 1024
+const DefaultCacheTimeout = 100 * time.Millisecond
+
+// Outcomes of a proxied request, as counted by the cache request metric. Writes bypass the cache, errors
+// are reads served from the upstream because the cache backend failed.
+const (
+	OutcomeHit    = "hit"
+	OutcomeMiss   = "miss"
+	OutcomeBypass = "bypass"
+	OutcomeError  = "error"
+)
 
 var (
-	gzipValueBytes      = []byte("gzip")
-	hashKey             = []byte("000102030405060708090A0B0C0D0E0F")
-	fiveMinute          = time.Minute * 5
-	lastLoggedTimestamp = time.Now().Add(-fiveMinute)
+	gzipValueBytes           = []byte("gzip")
+	hashKey                  = []byte("000102030405060708090A0B0C0D0E0F")
+	fiveMinute               = time.Minute * 5
+	lastLoggedTimestamp      = time.Now().Add(-fiveMinute)
+	lastCacheLoggedTimestamp = time.Now().Add(-fiveMinute)
 )
 
 type CacheServer struct {
-	Repo           cache.CacheRepository
+	Repo cache.CacheRepository
+	// LocalRepo is the part of Repo kept in process, which snapshots, dumps and preloads work on. It is
+	// nil for backends whose entries are shared by the replicas. NewServer takes Repo as in-process.
+	LocalRepo cache.CacheRepository
+	// AdminToken is required by the admin endpoints, which are refused while it is empty.
+	AdminToken     string
 	Proxy          *fasthttp.HostClient
 	Logger         *zap.Logger
 	CacheKeyPrefix string
+	Rules          *invalidation.Rules
+	Index          invalidation.Index
+	Metrics        *metric.Prometheus
+	Generations    *cache.Generations
+	CacheTimeout   time.Duration
+
+	writes            *writePipeline
+	writeFlushTimeout time.Duration
+	routes            []route
+	notReady          int32
+	snapshots         *snapshotter
+	warming           *warmState
+	refresh           *refresher
+	inflight          *inflightFills
+}
+
+// route serves the requests whose path starts with prefix instead of the cache handler.
+type route struct {
+	prefix  string
+	handler fasthttp.RequestHandler
 }
 
-func NewServer(repo cache.CacheRepository, proxy *fasthttp.HostClient, logger *zap.Logger) *CacheServer {
-	return &CacheServer{
-		Repo:           repo,
-		Proxy:          proxy,
-		Logger:         logger,
-		CacheKeyPrefix: os.Getenv("CACHE_KEY_PREFIX"),
+// NewServer creates a cache server with the options of the environment. It records to metrics, which is
+// required, like the repositories of cache.NewBackend.
+func NewServer(repo cache.CacheRepository, proxy *fasthttp.HostClient, logger *zap.Logger, metrics *metric.Prometheus) *CacheServer {
+	// malformed variables fall back to their defaults here, ValidateEnv reports them
+	env := &envReader{}
+	indexSize, cacheTimeout := readCacheOptions(env)
+	writeOptions := readWritePipelineOptions(env)
+	server := &CacheServer{
+		Repo:              repo,
+		LocalRepo:         repo,
+		AdminToken:        os.Getenv("ADMIN_TOKEN"),
+		Proxy:             proxy,
+		Logger:            logger,
+		CacheKeyPrefix:    os.Getenv("CACHE_KEY_PREFIX"),
+		Index:             invalidation.NewMemoryIndex(indexSize),
+		Metrics:           metrics,
+		Generations:       cache.NewGenerations(),
+		CacheTimeout:      cacheTimeout,
+		writeFlushTimeout: writeOptions.FlushTimeout,
+		snapshots:         &snapshotter{options: readSnapshotOptions(env)},
+		warming:           &warmState{},
+		refresh:           newRefresher(readRefreshOptions(env)),
+		inflight:          newInflightFills(),
 	}
+	server.writes = newWritePipeline(writeOptions, metrics, server.cacheResponses)
+	return server
 }
 
-func (server *CacheServer) Start(stopChan chan os.Signal) {
+// readCacheOptions reads INVALIDATION_INDEX_SIZE and CACHE_TIMEOUT.
+func readCacheOptions(env *envReader) (indexSize int, cacheTimeout time.Duration) {
+	return env.int("INVALIDATION_INDEX_SIZE", 0, 0), env.duration("CACHE_TIMEOUT", DefaultCacheTimeout)
+}
+
+// Handle serves the paths starting with prefix by the handler, e.g. endpoints of the cache backend.
+func (server *CacheServer) Handle(prefix string, handler fasthttp.RequestHandler) {
+	server.routes = append(server.routes, route{prefix: prefix, handler: handler})
+}
+
+// Handler routes the metrics, purge, admin and registered endpoints and passes everything else to the cache.
+func (server *CacheServer) Handler() fasthttp.RequestHandler {
 	promHandler := fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
-	handler := func(ctx *fasthttp.RequestCtx) {
-		switch string(ctx.Path()) {
+	return func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		switch path {
 		case "/metrics":
 			promHandler(ctx)
+			return
 		case "/purge":
 			server.PurgeHandler(ctx)
-		default:
-			server.CacheHandler(ctx)
+			return
+		case ReadyPath:
+			server.ReadyHandler(ctx)
+			return
+		case DumpPath:
+			if server.authorizeAdmin(ctx) {
+				server.DumpHandler(ctx)
+			}
+			return
+		case WarmPath:
+			if server.authorizeAdmin(ctx) {
+				server.WarmHandler(ctx)
+			}
+			return
+		case InspectPath:
+			if server.authorizeAdmin(ctx) {
+				server.InspectHandler(ctx)
+			}
+			return
+		case KeysPath:
+			if server.authorizeAdmin(ctx) {
+				server.KeysHandler(ctx)
+			}
+			return
 		}
+
+		for _, route := range server.routes {
+			if strings.HasPrefix(path, route.prefix) {
+				route.handler(ctx)
+				return
+			}
+		}
+		server.CacheHandler(ctx)
 	}
+}
 
+func (server *CacheServer) Start(stopChan chan os.Signal) {
 	s := fasthttp.Server{
-		Handler:        handler,
+		Handler:        server.Handler(),
 		ReadBufferSize: DefaultReadBufferSize,
 	}
 	port := determinatePort()
@@ -74,6 +177,7 @@ func (server *CacheServer) Start(stopChan chan os.Signal) {
 	go func() {
 		server.Logger.Warn("Server closed: ", zap.Error(s.ListenAndServe(port)))
 	}()
+	server.startSnapshots()
 
 	<-stopChan
 	err := s.Shutdown()
@@ -81,13 +185,125 @@ func (server *CacheServer) Start(stopChan chan os.Signal) {
 		server.Logger.Error("shutdown hook error", zap.Error(err))
 	}
 
+	if !server.FlushWrites() {
+		server.Logger.Warn("queued cache writes were not flushed in time", zap.Duration("timeout", server.writeFlushTimeout))
+	}
+	server.stopSnapshots()
+
 	server.Logger.Info("http server shut down complete")
 }
 
-func (server *CacheServer) cacheResponse(hashedUrl string, headers map[string]string, body []byte) {
-	cacheData := model.CacheData{Body: body, Headers: headers}
-	cacheDataBytes, _ := cacheData.MarshalJSON()
-	server.Repo.SetKey(hashedUrl, cacheDataBytes)
+// FlushWrites stops queueing cache writes and waits for the queued writes, it returns false if they
+// were not written within the flush timeout. Writes after the flush are dropped, removals run right away.
+func (server *CacheServer) FlushWrites() bool {
+	return server.writes.close(server.writeFlushTimeout)
+}
+
+// fill is a response waiting to be written to the cache.
+type fill struct {
+	hashedURL  string
+	generation uint64
+	url        string
+	tags       []string
+	headers    map[string]string
+	body       []byte
+	ttl        time.Duration
+	// uri, host and fetchTime let popular entries be refreshed before they expire
+	uri       string
+	host      string
+	fetchTime time.Duration
+}
+
+// cacheResponses stores the responses unless their keys were invalidated after the responses were
+// fetched. The generation is checked once more after writing, because an invalidation may run between
+// the check and the write; in that case the fill removes its own entry.
+// Several fills are written with one SetMany when the repository supports batching.
+func (server *CacheServer) cacheResponses(fills []fill) {
+	defer func() {
+		for _, f := range fills {
+			server.inflight.end(f.hashedURL)
+			// written entries are tracked anew, the others may be refreshed again
+			server.refresh.done(f.hashedURL)
+		}
+	}()
+
+	var (
+		pending []fill
+		entries []cache.Entry
+	)
+	for _, f := range fills {
+		if server.Generations.Changed(f.hashedURL, f.generation) {
+			continue
+		}
+		cacheData := model.CacheData{Body: f.body, Headers: f.headers}
+		cacheDataBytes, _ := cacheData.MarshalJSON()
+
+		pending = append(pending, f)
+		entries = append(entries, cache.Entry{Key: f.hashedURL, Value: cacheDataBytes, TTL: f.ttl})
+	}
+	if len(entries) == 0 {
+		return
+	}
+
+	ctx, cancel := server.cacheContext()
+	defer cancel()
+
+	if writer, ok := server.Repo.(cache.BatchWriter); ok && len(entries) > 1 {
+		if err := writer.SetMany(ctx, entries); err != nil {
+			server.logCacheError("cache set error occurred", err)
+			return
+		}
+	} else {
+		written := pending[:0]
+		for i, entry := range entries {
+			if err := server.Repo.Set(ctx, entry.Key, entry.Value, entry.TTL); err != nil {
+				server.logCacheError("cache set error occurred", err)
+				continue
+			}
+			written = append(written, pending[i])
+		}
+		pending = written
+	}
+
+	for _, f := range pending {
+		if server.Generations.Changed(f.hashedURL, f.generation) {
+			_ = server.Repo.Remove(ctx, f.hashedURL)
+			continue
+		}
+		server.indexResponse(f.hashedURL, f.url, f.tags)
+		server.refresh.track(f)
+	}
+}
+
+// cacheContext bounds a single cache backend operation.
+func (server *CacheServer) cacheContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), server.CacheTimeout)
+}
+
+func (server *CacheServer) logCacheError(message string, err error) {
+	if errors.Is(err, cache.ErrCircuitOpen) {
+		// the failures that opened the breaker were logged already
+		return
+	}
+	server.Metrics.CacheErrorCounter.Inc()
+	allowed := time.Since(lastCacheLoggedTimestamp) > fiveMinute
+	if allowed {
+		server.Logger.Error(message, zap.Error(err))
+		lastCacheLoggedTimestamp = time.Now()
+	}
+}
+
+func (server *CacheServer) logProxyError(req *fasthttp.Request, err error) {
+	server.Metrics.ProxyErrorCounter.Inc()
+	allowed := time.Since(lastLoggedTimestamp) > fiveMinute
+	if allowed {
+		server.Logger.Error("reverse proxy error occurred", zap.Error(err), zap.ByteString("request url", req.RequestURI()))
+		lastLoggedTimestamp = time.Now()
+	}
+}
+
+func (server *CacheServer) countRequest(outcome string) {
+	server.Metrics.CacheRequestCounter.WithLabelValues(outcome).Inc()
 }
 
 func determinatePort() string {
@@ -132,75 +348,112 @@ func (server *CacheServer) CacheHandler(ctx *fasthttp.RequestCtx) {
 	req := &ctx.Request
 	resp := &ctx.Response
 	hashedURL := server.HashURL(server.ReorderQueryStringFasthttp(req.URI()))
+	server.Metrics.TotalRequestCounter.Inc()
 
 	reqMethod := string(ctx.Method())
 	if reqMethod == fasthttp.MethodPost || reqMethod == fasthttp.MethodPut || reqMethod == fasthttp.MethodPatch {
-		go server.Repo.Remove(hashedURL)
+		// the key is invalidated once the write is done, so fills of reads that ran concurrently
+		// with the write are discarded as well.
+		defer server.invalidateKeyAsync(hashedURL)
+		server.countRequest(OutcomeBypass)
 
 		if err := server.Proxy.Do(req, resp); err != nil {
-			allowed := time.Since(lastLoggedTimestamp) > fiveMinute
-			if allowed {
-				server.Logger.Error("reverse proxy error occurred", zap.Error(err), zap.ByteString("request url", req.RequestURI()))
-				lastLoggedTimestamp = time.Now()
-			}
+			server.logProxyError(req, err)
 			resp.SetStatusCode(http.StatusBadGateway)
+			return
+		}
+
+		server.applyPurgeHeader(req, resp)
+		if is2xxStatusCode(resp.StatusCode()) && server.Rules.Len() > 0 {
+			path := string(ctx.Path())
+			server.writes.enqueueRemoval(func() { server.applyInvalidationRules(reqMethod, path) })
 		}
 		return
 	}
 
-	cachedDataBytes := server.CheckCache(hashedURL)
+	cachedDataBytes, err := server.CheckCache(hashedURL)
+	if err != nil {
+		if !cache.IsNotFound(err) {
+			// the backend is failing or its circuit breaker is open, serve from the upstream without
+			// adding more load on the backend
+			server.logCacheError("cache get error occurred", err)
+			server.countRequest(OutcomeError)
+			server.proxy(req, resp, hashedURL, false)
+			return
+		}
+		server.countRequest(OutcomeMiss)
+		server.ReverseProxyHandler(req, resp, hashedURL)
+		return
+	}
+	server.countRequest(OutcomeHit)
+	server.Metrics.CacheHitCounter.Inc()
+	server.countHit(hashedURL)
 
 	requestAcceptEncodingHeaderVal := string(req.Header.Peek("Accept-Encoding"))
 
-	if cachedDataBytes != nil {
-		resp.Header.Add("X-Cache-Response-For", string(req.RequestURI()))
-		resp.Header.Add("Content-Type", "application/json;charset=UTF-8") //todo get from cache?
-
-		var cachedData model.CacheData
-		err := cachedData.UnmarshalJSON(cachedDataBytes)
-		if err != nil {
-			//backward compatibility
-			//if we can not marshall cached data to new structure
-			//we write previously cached byte data
-			if !strings.Contains(requestAcceptEncodingHeaderVal, "gzip") {
-				reader, _ := gzip.NewReader(bytes.NewReader(cachedDataBytes))
-				ctx.SetBodyStream(reader, -1)
-			} else {
-				resp.Header.Add("Content-Encoding", "gzip")
-				ctx.SetBody(cachedDataBytes)
-			}
+	resp.Header.Add("X-Cache-Response-For", string(req.RequestURI()))
+	resp.Header.Add("Content-Type", "application/json;charset=UTF-8") //todo get from cache?
+
+	var cachedData model.CacheData
+	err = cachedData.UnmarshalJSON(cachedDataBytes)
+	if err != nil {
+		//backward compatibility
+		//if we can not marshall cached data to new structure
+		//we write previously cached byte data
+		if !strings.Contains(requestAcceptEncodingHeaderVal, "gzip") {
+			reader, _ := gzip.NewReader(bytes.NewReader(cachedDataBytes))
+			ctx.SetBodyStream(reader, -1)
 		} else {
-			if !strings.Contains(requestAcceptEncodingHeaderVal, "gzip") {
-				reader, _ := gzip.NewReader(bytes.NewReader(cachedData.Body))
-				delete(cachedData.Headers, "Content-Encoding")
-				writeHeaders(&resp.Header, cachedData.Headers)
-				ctx.SetBodyStream(reader, -1)
-			} else {
-				writeHeaders(&resp.Header, cachedData.Headers)
-				if _, ok := cachedData.Headers["Content-Encoding"]; !ok {
-					resp.Header.Add("Content-Encoding", "gzip")
-				}
-				ctx.SetBody(cachedData.Body)
-			}
+			resp.Header.Add("Content-Encoding", "gzip")
+			ctx.SetBody(cachedDataBytes)
 		}
 	} else {
-		server.ReverseProxyHandler(req, resp, hashedURL)
+		if !strings.Contains(requestAcceptEncodingHeaderVal, "gzip") {
+			reader, _ := gzip.NewReader(bytes.NewReader(cachedData.Body))
+			delete(cachedData.Headers, "Content-Encoding")
+			writeHeaders(&resp.Header, cachedData.Headers)
+			ctx.SetBodyStream(reader, -1)
+		} else {
+			writeHeaders(&resp.Header, cachedData.Headers)
+			if _, ok := cachedData.Headers["Content-Encoding"]; !ok {
+				resp.Header.Add("Content-Encoding", "gzip")
+			}
+			ctx.SetBody(cachedData.Body)
+		}
 	}
 }
 
 func (server *CacheServer) ReverseProxyHandler(req *fasthttp.Request, resp *fasthttp.Response, hashedURL string) {
+	server.proxy(req, resp, hashedURL, true)
+}
+
+// proxy forwards the request to the upstream and, if cacheable is set, caches the response. It reports
+// whether the response was queued to be written.
+func (server *CacheServer) proxy(req *fasthttp.Request, resp *fasthttp.Response, hashedURL string, cacheable bool) (queued bool) {
+	normalizedURL := server.ReorderQueryStringFasthttp(req.URI())
+	if cacheable {
+		// registered before the generation is taken, so an invalidation can't slip in between
+		server.inflight.begin(hashedURL, normalizedURL)
+		defer func() {
+			if !queued {
+				server.inflight.end(hashedURL)
+			}
+		}()
+	}
+	generation := server.Generations.Current(hashedURL)
+
+	started := time.Now()
 	if err := server.Proxy.Do(req, resp); err != nil {
-		allowed := time.Since(lastLoggedTimestamp) > fiveMinute
-		if allowed {
-			server.Logger.Error("reverse proxy error occurred", zap.Error(err), zap.ByteString("request url", req.RequestURI()))
-			lastLoggedTimestamp = time.Now()
-		}
+		server.logProxyError(req, err)
 		resp.SetStatusCode(http.StatusBadGateway)
 		return
 	}
 
+	fetchTime := time.Since(started)
+	server.applyPurgeHeader(req, resp)
+
 	cacheHeaderValue := resp.Header.Peek(CacheHeaderKey)
-	shouldCache := len(cacheHeaderValue) > 0 && !is5xxStatusCode(resp.StatusCode())
+	shouldCache := cacheable && len(cacheHeaderValue) > 0 && !is5xxStatusCode(resp.StatusCode())
 
 	if shouldCache {
 		var (
@@ -210,7 +463,8 @@ func (server *CacheServer) ReverseProxyHandler(req *fasthttp.Request, resp *fast
 		)
 
 		if responseGzipped {
-			gzippedRespBody = respBody
+			// the fill is written after the response is released
+			gzippedRespBody = append([]byte(nil), respBody...)
 		} else {
 			gzippedRespBody = server.gzipWriter(respBody).Bytes()
 		}
@@ -232,8 +486,22 @@ func (server *CacheServer) ReverseProxyHandler(req *fasthttp.Request, resp *fast
 			})
 		}
 
-		go server.cacheResponse(hashedURL, headers, gzippedRespBody)
+		tags := parseTags(resp.Header.Peek(CacheTagsHeaderKey))
+		server.inflight.received(hashedURL, tags)
+		queued = server.writes.enqueueFill(fill{
+			hashedURL:  hashedURL,
+			generation: generation,
+			url:        normalizedURL,
+			tags:       tags,
+			headers:    headers,
+			body:       gzippedRespBody,
+			ttl:        server.refresh.jitter(time.Duration(server.GetHeaderTTL(string(cacheHeaderValue))) * time.Second),
+			uri:        string(req.RequestURI()),
+			host:       string(req.Host()),
+			fetchTime:  fetchTime,
+		})
 	}
+	return queued
 }
 
 func (server *CacheServer) PurgeHandler(ctx *fasthttp.RequestCtx) {
@@ -269,6 +537,12 @@ func (server *CacheServer) PurgeHandler(ctx *fasthttp.RequestCtx) {
 		resp.SetBodyString("could not parse the request body")
 		return
 	}
+	server.Metrics.PurgeRequestCounter.Inc()
+
+	if len(purgeRequest.Targets) > 0 {
+		server.purgeTargets(ctx, purgeRequest.Targets)
+		return
+	}
 
 	purgeRequest.EnsureHasSlashPrefix()
 
@@ -282,13 +556,33 @@ func (server *CacheServer) PurgeHandler(ctx *fasthttp.RequestCtx) {
 
 	hashedURL := server.HashURL(server.ReorderQueryString(purgeUrl))
 
-	err = server.Repo.Remove(hashedURL)
+	err = server.invalidateKey(hashedURL)
 	if err != nil {
 		resp.SetStatusCode(http.StatusInternalServerError)
 		resp.SetBodyString("error occurred while removing the cache")
 		return
 	}
+	server.Metrics.PurgeSuccessCounter.Inc()
+}
+
+// purgeTargets purges the targets of a purge request and answers the number of removed keys.
+func (server *CacheServer) purgeTargets(ctx *fasthttp.RequestCtx, values []string) {
+	targets := make([]invalidation.Target, 0, len(values))
+	for _, value := range values {
+		if strings.TrimSpace(value) != "" {
+			targets = append(targets, invalidation.ParseTarget(value))
+		}
+	}
 
+	removed, err := server.Invalidate(targets)
+	if err != nil {
+		server.Logger.Info("Failed to purge targets", zap.Strings("targets", values), zap.Error(err))
+		ctx.SetStatusCode(http.StatusInternalServerError)
+		ctx.SetBodyString("error occurred while removing the cache")
+		return
+	}
+	server.Metrics.PurgeSuccessCounter.Inc()
+	writeJSON(ctx, model.PurgeResponse{Removed: removed})
 }
 
 func writeHeaders(header *fasthttp.ResponseHeader, headers map[string]string) {
@@ -309,16 +603,25 @@ func (server CacheServer) GetHeaderTTL(cacheHeaderValue string) int {
 }
 
 func (server CacheServer) HashURL(url string) string {
-	keyToHash := []byte(server.CacheKeyPrefix + "/" + url)
+	return HashKey(server.CacheKeyPrefix, url)
+}
+
+// HashKey returns the cache key of a normalized url under the cache key prefix.
+func HashKey(prefix, url string) string {
+	keyToHash := []byte(prefix + "/" + url)
 	sum := highwayhash.Sum(keyToHash, hashKey)
 	return string(sum[:])
 }
 
-func (server CacheServer) CheckCache(url string) []byte {
+// CheckCache returns cache.ErrNotFound on a miss and the backend error when the lookup fails.
+func (server CacheServer) CheckCache(url string) ([]byte, error) {
 	if server.Repo == nil {
-		return nil
+		return nil, cache.ErrNotFound
 	}
-	return server.Repo.Get(url)
+
+	ctx, cancel := server.cacheContext()
+	defer cancel()
+	return server.Repo.Get(ctx, url)
 }
 
 func (server CacheServer) ReorderQueryString(url *url.URL) string {
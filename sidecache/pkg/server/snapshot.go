@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/snapshot"
+	"go.uber.org/zap"
+)
+
+// SnapshotOptions configure persisting the cache to a file, on shutdown and every Interval if set.
+type SnapshotOptions struct {
+	File     string
+	Interval time.Duration
+}
+
+// SnapshotOptionsFromEnv reads SNAPSHOT_FILE and SNAPSHOT_INTERVAL.
+func SnapshotOptionsFromEnv() (SnapshotOptions, error) {
+	env := &envReader{}
+	options := readSnapshotOptions(env)
+	return options, env.err()
+}
+
+func readSnapshotOptions(env *envReader) SnapshotOptions {
+	return SnapshotOptions{
+		File:     os.Getenv("SNAPSHOT_FILE"),
+		Interval: env.duration("SNAPSHOT_INTERVAL", 0),
+	}
+}
+
+// errNotInProcess refuses snapshots, dumps and preloads of backends shared by the replicas: they would
+// scan the shared keyspace and could bring back entries purged meanwhile.
+var errNotInProcess = errors.New("the cache backend is shared by the replicas")
+
+type snapshotter struct {
+	options SnapshotOptions
+	mu      sync.Mutex
+	stop    chan struct{}
+}
+
+// SaveSnapshot writes the live entries of the cache with their expiry to the file. The snapshot is
+// written to a temporary file first and renamed, so a crash never leaves a partial snapshot behind.
+func (server *CacheServer) SaveSnapshot(file string) (int, error) {
+	if server.LocalRepo == nil {
+		return 0, errNotInProcess
+	}
+	iterable, ok := cache.AsIterable(server.LocalRepo)
+	if !ok {
+		return 0, errors.New("the cache backend can't be iterated")
+	}
+
+	server.snapshots.mu.Lock()
+	defer server.snapshots.mu.Unlock()
+
+	temp, err := ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(temp.Name())
+	defer temp.Close()
+
+	buffered := bufio.NewWriter(temp)
+	count, err := snapshot.Dump(context.Background(), iterable, server.lookup(), buffered)
+	if err != nil {
+		return 0, err
+	}
+	if err := buffered.Flush(); err != nil {
+		return 0, err
+	}
+	if err := temp.Sync(); err != nil {
+		return 0, err
+	}
+	if err := temp.Close(); err != nil {
+		return 0, err
+	}
+	return count, os.Rename(temp.Name(), file)
+}
+
+// startSnapshots saves the cache every interval until stopSnapshots.
+func (server *CacheServer) startSnapshots() {
+	options := server.snapshots.options
+	if options.File == "" {
+		return
+	}
+	if server.LocalRepo == nil {
+		server.Logger.Warn("cache snapshots are disabled", zap.String("file", options.File), zap.Error(errNotInProcess))
+		return
+	}
+	if options.Interval <= 0 {
+		return
+	}
+
+	server.snapshots.stop = make(chan struct{})
+	ticker := time.NewTicker(options.Interval)
+	go func(stop chan struct{}) {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				server.saveSnapshot()
+			case <-stop:
+				return
+			}
+		}
+	}(server.snapshots.stop)
+}
+
+// stopSnapshots stops the periodic snapshots and saves a last one.
+func (server *CacheServer) stopSnapshots() {
+	if server.snapshots.options.File == "" || server.LocalRepo == nil {
+		return
+	}
+	if server.snapshots.stop != nil {
+		close(server.snapshots.stop)
+	}
+	server.saveSnapshot()
+}
+
+func (server *CacheServer) saveSnapshot() {
+	started := time.Now()
+	count, err := server.SaveSnapshot(server.snapshots.options.File)
+	if err != nil {
+		server.Logger.Error("cache snapshot failed", zap.String("file", server.snapshots.options.File), zap.Error(err))
+		return
+	}
+	server.Logger.Info("cache snapshot saved",
+		zap.String("file", server.snapshots.options.File),
+		zap.Int("entries", count),
+		zap.Duration("duration", time.Since(started)))
+}
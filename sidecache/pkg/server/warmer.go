@@ -0,0 +1,322 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const (
+	WarmPath = model.WarmPath
+
+	DefaultWarmConcurrency = 4
+	// MaxWarmConcurrency is the highest number of urls fetched at once, each fetch runs in its own goroutine.
+	MaxWarmConcurrency = 256
+	// MaxWarmRate is the highest limit of fetches per second, beyond it warming runs without a limit.
+	MaxWarmRate = 10000
+)
+
+// ErrWarmRunning is returned when warming is started while another warming runs.
+var ErrWarmRunning = errors.New("cache warming is already running")
+
+// WarmOptions configure fetching a list of urls into the cache. URLs are read from URLFile unless
+// they are given directly. Rate limits the fetches per second up to MaxWarmRate, zero means no limit.
+type WarmOptions struct {
+	URLFile     string
+	URLs        []string
+	Concurrency int
+	Rate        int
+}
+
+// WarmOptionsFromEnv reads WARM_URLS_FILE, WARM_CONCURRENCY and WARM_RATE.
+func WarmOptionsFromEnv() (WarmOptions, error) {
+	env := &envReader{}
+	options := WarmOptions{
+		URLFile:     os.Getenv("WARM_URLS_FILE"),
+		Concurrency: env.int("WARM_CONCURRENCY", 0, 0),
+		Rate:        env.int("WARM_RATE", 0, 0),
+	}
+	if options.Concurrency > MaxWarmConcurrency {
+		env.report("WARM_CONCURRENCY", os.Getenv("WARM_CONCURRENCY"))
+		options.Concurrency = 0
+	}
+	if options.Rate > MaxWarmRate {
+		env.report("WARM_RATE", os.Getenv("WARM_RATE"))
+		options.Rate = 0
+	}
+	return options, env.err()
+}
+
+type warmState struct {
+	mu       sync.Mutex
+	progress model.WarmProgress
+}
+
+type warmResult int
+
+const (
+	warmFetched warmResult = iota
+	warmCached
+	warmFailed
+)
+
+// WarmProgress returns the progress of the running or the last warming.
+func (server *CacheServer) WarmProgress() model.WarmProgress {
+	server.warming.mu.Lock()
+	defer server.warming.mu.Unlock()
+	return server.warming.progress
+}
+
+// Warm fetches the urls through the reverse proxy path, so every cacheable response is cached as if
+// it was requested by a client. It blocks until all urls are fetched.
+func (server *CacheServer) Warm(options WarmOptions) (model.WarmProgress, error) {
+	urls, source, err := loadWarmURLs(options)
+	if err != nil {
+		return model.WarmProgress{}, err
+	}
+	if err := server.beginWarm(source, len(urls)); err != nil {
+		return model.WarmProgress{}, err
+	}
+	server.runWarm(urls, options)
+	return server.WarmProgress(), nil
+}
+
+func loadWarmURLs(options WarmOptions) ([]string, string, error) {
+	if len(options.URLs) > 0 {
+		return ReadWarmURLs(strings.NewReader(strings.Join(options.URLs, "\n"))), "request", nil
+	}
+	if options.URLFile == "" {
+		return nil, "", errors.New("no urls to warm")
+	}
+
+	file, err := os.Open(options.URLFile)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return ReadWarmURLs(file), options.URLFile, nil
+}
+
+// ReadWarmURLs reads one url per line, either a request uri, an absolute url or an access log line
+// whose quoted request is a GET. Other lines, comments and duplicates are skipped.
+func ReadWarmURLs(r io.Reader) []string {
+	var (
+		urls    []string
+		seen    = map[string]bool{}
+		scanner = bufio.NewScanner(r)
+	)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		uri, ok := parseWarmURL(scanner.Text())
+		if ok && !seen[uri] {
+			seen[uri] = true
+			urls = append(urls, uri)
+		}
+	}
+	return urls
+}
+
+func parseWarmURL(line string) (string, bool) {
+	line = strings.TrimSpace(line)
+	if line == "" || strings.HasPrefix(line, "#") {
+		return "", false
+	}
+
+	var target string
+	if start := strings.IndexByte(line, '"'); start >= 0 {
+		// access log, e.g. 10.0.0.1 - - [10/Oct/2021:13:55:36 +0000] "GET /products?page=1 HTTP/1.1" 200 512
+		request := line[start+1:]
+		if end := strings.IndexByte(request, '"'); end >= 0 {
+			request = request[:end]
+		}
+		fields := strings.Fields(request)
+		if len(fields) < 2 || fields[0] != fasthttp.MethodGet {
+			return "", false
+		}
+		target = fields[1]
+	} else {
+		target = strings.Fields(line)[0]
+	}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		parsed, err := url.Parse(target)
+		if err != nil {
+			return "", false
+		}
+		target = parsed.RequestURI()
+	}
+	return target, strings.HasPrefix(target, "/")
+}
+
+func (server *CacheServer) beginWarm(source string, total int) error {
+	server.warming.mu.Lock()
+	defer server.warming.mu.Unlock()
+
+	if server.warming.progress.Running {
+		return ErrWarmRunning
+	}
+	now := time.Now()
+	server.warming.progress = model.WarmProgress{Running: true, Source: source, Total: total, StartedAt: &now}
+	return nil
+}
+
+func (server *CacheServer) runWarm(urls []string, options WarmOptions) {
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultWarmConcurrency
+	} else if concurrency > MaxWarmConcurrency {
+		concurrency = MaxWarmConcurrency
+	}
+	server.Logger.Info("cache warming started",
+		zap.String("source", server.WarmProgress().Source),
+		zap.Int("urls", len(urls)),
+		zap.Int("concurrency", concurrency),
+		zap.Int("rate", options.Rate))
+
+	jobs := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uri := range jobs {
+				server.recordWarm(server.warmURL(uri))
+			}
+		}()
+	}
+
+	var tick <-chan time.Time
+	if options.Rate > 0 && options.Rate <= MaxWarmRate {
+		ticker := time.NewTicker(time.Second / time.Duration(options.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	for _, uri := range urls {
+		if tick != nil {
+			<-tick
+		}
+		jobs <- uri
+	}
+	close(jobs)
+	wg.Wait()
+
+	server.warming.mu.Lock()
+	now := time.Now()
+	server.warming.progress.Running = false
+	server.warming.progress.FinishedAt = &now
+	progress := server.warming.progress
+	server.warming.mu.Unlock()
+
+	server.Logger.Info("cache warming finished",
+		zap.String("source", progress.Source),
+		zap.Int("fetched", progress.Fetched),
+		zap.Int("cached", progress.Cached),
+		zap.Int("failed", progress.Failed),
+		zap.Duration("duration", now.Sub(*progress.StartedAt)))
+}
+
+func (server *CacheServer) recordWarm(result warmResult) {
+	server.warming.mu.Lock()
+	defer server.warming.mu.Unlock()
+
+	server.warming.progress.Done++
+	switch result {
+	case warmFetched:
+		server.warming.progress.Fetched++
+	case warmCached:
+		server.warming.progress.Cached++
+	default:
+		server.warming.progress.Failed++
+	}
+}
+
+// warmURL requests the uri from the upstream unless it is cached already.
+func (server *CacheServer) warmURL(uri string) warmResult {
+	req, resp := fasthttp.AcquireRequest(), fasthttp.AcquireResponse()
+	defer fasthttp.ReleaseRequest(req)
+	defer fasthttp.ReleaseResponse(resp)
+
+	req.SetRequestURI(uri)
+	req.Header.SetHost(server.Proxy.Addr)
+	req.Header.Set("Accept-Encoding", "gzip")
+
+	hashedURL := server.HashURL(server.ReorderQueryStringFasthttp(req.URI()))
+	if _, err := server.CheckCache(hashedURL); err == nil {
+		return warmCached
+	} else if !cache.IsNotFound(err) {
+		server.logCacheError("cache get error occurred", err)
+		return warmFailed
+	}
+
+	server.ReverseProxyHandler(req, resp, hashedURL)
+	if resp.StatusCode() >= http.StatusBadRequest {
+		return warmFailed
+	}
+	return warmFetched
+}
+
+// WarmHandler reports the warming progress on GET and starts warming on POST with a model.WarmRequest as
+// body; the options missing in the body are taken from the environment.
+func (server *CacheServer) WarmHandler(ctx *fasthttp.RequestCtx) {
+	switch string(ctx.Method()) {
+	case fasthttp.MethodGet:
+		writeJSON(ctx, server.WarmProgress())
+	case fasthttp.MethodPost:
+		// the environment was validated on startup
+		options, _ := WarmOptionsFromEnv()
+		var request model.WarmRequest
+		if body := ctx.PostBody(); len(body) > 0 {
+			if err := json.Unmarshal(body, &request); err != nil {
+				ctx.SetStatusCode(http.StatusBadRequest)
+				ctx.SetBodyString("could not parse the request body")
+				return
+			}
+		}
+		if request.Concurrency < 0 || request.Concurrency > MaxWarmConcurrency || request.Rate < 0 || request.Rate > MaxWarmRate {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetBodyString(fmt.Sprintf("concurrency must be between 0 and %d and rate between 0 and %d",
+				MaxWarmConcurrency, MaxWarmRate))
+			return
+		}
+		if len(request.URLs) > 0 {
+			options.URLs = request.URLs
+		}
+		if request.Concurrency > 0 {
+			options.Concurrency = request.Concurrency
+		}
+		if request.Rate > 0 {
+			options.Rate = request.Rate
+		}
+
+		urls, source, err := loadWarmURLs(options)
+		if err != nil {
+			ctx.SetStatusCode(http.StatusBadRequest)
+			ctx.SetBodyString(err.Error())
+			return
+		}
+		if err := server.beginWarm(source, len(urls)); err != nil {
+			ctx.SetStatusCode(http.StatusConflict)
+			ctx.SetBodyString(err.Error())
+			return
+		}
+		go server.runWarm(urls, options)
+
+		ctx.SetStatusCode(http.StatusAccepted)
+		writeJSON(ctx, server.WarmProgress())
+	default:
+		ctx.SetStatusCode(http.StatusMethodNotAllowed)
+	}
+}
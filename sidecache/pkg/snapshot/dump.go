@@ -0,0 +1,35 @@
+package snapshot
+
+import (
+	"context"
+	"io"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+)
+
+// Dump writes the entries of the repository as a snapshot and returns their number. The urls and tags
+// are added from lookup if it is set.
+func Dump(ctx context.Context, iterable cache.Iterable, lookup invalidation.Lookup, w io.Writer) (int, error) {
+	writer, err := NewWriter(w)
+	if err != nil {
+		return 0, err
+	}
+
+	var writeErr error
+	err = iterable.Range(ctx, func(item cache.Item) bool {
+		record := Record{Key: item.Key, Value: item.Value, ExpiresAt: item.ExpiresAt}
+		if lookup != nil {
+			record.URL, record.Tags, _, _ = lookup.Lookup(item.Key)
+		}
+		writeErr = writer.Write(record)
+		return writeErr == nil
+	})
+	if err == nil {
+		err = writeErr
+	}
+	if err != nil {
+		return writer.Count(), err
+	}
+	return writer.Count(), writer.Close()
+}
@@ -0,0 +1,216 @@
+// Package snapshot reads and writes portable copies of cache entries.
+//
+// A snapshot is a gzip compressed stream of json lines: a header, one line per record and a trailer
+// holding the record count and the sha256 checksum of the record lines. Snapshots missing the
+// trailer, e.g. cut off by a crash, or failing the checksum are rejected as a whole.
+package snapshot
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+)
+
+const Version = 1
+
+// ErrCorrupted is returned for snapshots that are truncated or fail the checksum.
+var ErrCorrupted = errors.New("snapshot: corrupted")
+
+// Record is a cache entry with the url and tags it was cached for, ExpiresAt is zero for entries
+// without ttl.
+type Record struct {
+	Key       string
+	URL       string
+	Tags      []string
+	Value     []byte
+	ExpiresAt time.Time
+}
+
+// Expired reports whether the record expired at now.
+func (record Record) Expired(now time.Time) bool {
+	return !record.ExpiresAt.IsZero() && !record.ExpiresAt.After(now)
+}
+
+// TTL returns the time left until the record expires at now, zero for records without ttl.
+func (record Record) TTL(now time.Time) time.Duration {
+	if record.ExpiresAt.IsZero() {
+		return 0
+	}
+	return record.ExpiresAt.Sub(now)
+}
+
+// line is the union of the header, record and trailer lines. Keys are binary digests, so they are
+// stored as base64 like the values.
+type line struct {
+	Version   int    `json:"version,omitempty"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+	Checksum  string `json:"checksum,omitempty"`
+	Count     int    `json:"count,omitempty"`
+
+	Key       []byte   `json:"key,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Tags      []string `json:"tags,omitempty"`
+	Value     []byte   `json:"value,omitempty"`
+	ExpiresAt int64    `json:"expiresAt,omitempty"`
+}
+
+type Writer struct {
+	gzip  *gzip.Writer
+	hash  hash.Hash
+	count int
+}
+
+// NewWriter writes the header of a snapshot to w. The snapshot is only complete after Close.
+func NewWriter(w io.Writer) (*Writer, error) {
+	writer := &Writer{gzip: gzip.NewWriter(w), hash: sha256.New()}
+	if err := writer.writeLine(line{Version: Version, CreatedAt: time.Now().UnixNano() / int64(time.Millisecond)}); err != nil {
+		return nil, err
+	}
+	return writer, nil
+}
+
+func (writer *Writer) Write(record Record) error {
+	encoded := line{Key: []byte(record.Key), URL: record.URL, Tags: record.Tags, Value: record.Value}
+	if !record.ExpiresAt.IsZero() {
+		encoded.ExpiresAt = record.ExpiresAt.UnixNano() / int64(time.Millisecond)
+	}
+
+	data, err := json.Marshal(encoded)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	writer.hash.Write(data)
+	writer.count++
+	_, err = writer.gzip.Write(data)
+	return err
+}
+
+// Count returns the number of records written.
+func (writer *Writer) Count() int {
+	return writer.count
+}
+
+// Close writes the trailer and flushes the compressed stream, it doesn't close the underlying writer.
+func (writer *Writer) Close() error {
+	if err := writer.writeLine(line{Count: writer.count, Checksum: hex.EncodeToString(writer.hash.Sum(nil))}); err != nil {
+		return err
+	}
+	return writer.gzip.Close()
+}
+
+func (writer *Writer) writeLine(value line) error {
+	data, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = writer.gzip.Write(append(data, '\n'))
+	return err
+}
+
+// Read reads a whole snapshot and returns its records once the trailer and the checksum are verified.
+func Read(r io.Reader) ([]Record, error) {
+	reader, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	var records []Record
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			return records, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, record)
+	}
+}
+
+// Reader streams the records of a snapshot. The checksum can only be verified at the end, so the
+// records are returned before the snapshot is known to be intact; read it twice or use Read when a
+// corrupted snapshot must not be used at all.
+type Reader struct {
+	zr     *gzip.Reader
+	reader *bufio.Reader
+	digest hash.Hash
+	count  int
+}
+
+// NewReader reads the header of a snapshot from r.
+func NewReader(r io.Reader) (*Reader, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+
+	reader := &Reader{zr: zr, reader: bufio.NewReader(zr), digest: sha256.New()}
+	header, err := readLine(reader.reader)
+	if err != nil {
+		zr.Close()
+		return nil, err
+	}
+	if header.Version != Version {
+		zr.Close()
+		return nil, fmt.Errorf("snapshot: unsupported version %d", header.Version)
+	}
+	return reader, nil
+}
+
+// Next returns the next record, or io.EOF once the trailer and the checksum are verified.
+func (reader *Reader) Next() (Record, error) {
+	data, err := reader.reader.ReadBytes('\n')
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: missing trailer: %v", ErrCorrupted, err)
+	}
+
+	var decoded line
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return Record{}, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	if decoded.Checksum != "" {
+		if decoded.Count != reader.count || decoded.Checksum != hex.EncodeToString(reader.digest.Sum(nil)) {
+			return Record{}, fmt.Errorf("%w: checksum mismatch", ErrCorrupted)
+		}
+		// reading to the end verifies the gzip footer too
+		if _, err := io.Copy(ioutil.Discard, reader.reader); err != nil {
+			return Record{}, fmt.Errorf("%w: %v", ErrCorrupted, err)
+		}
+		return Record{}, io.EOF
+	}
+
+	reader.digest.Write(data)
+	reader.count++
+	record := Record{Key: string(decoded.Key), URL: decoded.URL, Tags: decoded.Tags, Value: decoded.Value}
+	if decoded.ExpiresAt > 0 {
+		record.ExpiresAt = time.Unix(0, decoded.ExpiresAt*int64(time.Millisecond))
+	}
+	return record, nil
+}
+
+func (reader *Reader) Close() error {
+	return reader.zr.Close()
+}
+
+func readLine(reader *bufio.Reader) (line, error) {
+	var decoded line
+	data, err := reader.ReadBytes('\n')
+	if err != nil {
+		return decoded, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return decoded, fmt.Errorf("%w: %v", ErrCorrupted, err)
+	}
+	return decoded, nil
+}
@@ -0,0 +1,118 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/snapshot"
+)
+
+func writeSnapshot(t *testing.T, records ...snapshot.Record) []byte {
+	var buf bytes.Buffer
+	writer, err := snapshot.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, record := range records {
+		if err := writer.Write(record); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestSnapshotRoundTrip(t *testing.T) {
+	expiresAt := time.Unix(1700000000, 123000000)
+	records := []snapshot.Record{
+		{Key: "\x00\xffbinary", URL: "/products/42?", Tags: []string{"product-42"}, Value: []byte("value"), ExpiresAt: expiresAt},
+		{Key: "forever", Value: []byte("value")},
+	}
+
+	read, err := snapshot.Read(bytes.NewReader(writeSnapshot(t, records...)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(read) != 2 || !reflect.DeepEqual(read[1], records[1]) || read[0].Key != records[0].Key ||
+		!read[0].ExpiresAt.Equal(expiresAt) || read[0].URL != records[0].URL || !reflect.DeepEqual(read[0].Tags, records[0].Tags) {
+		t.Errorf("expected the written records, got %+v", read)
+	}
+
+	if read, err := snapshot.Read(bytes.NewReader(writeSnapshot(t))); err != nil || len(read) != 0 {
+		t.Errorf("expected an empty snapshot, got %v %v", read, err)
+	}
+}
+
+func TestSnapshotRejectsCorruptedFiles(t *testing.T) {
+	data := writeSnapshot(t, snapshot.Record{Key: "a", Value: []byte("a")}, snapshot.Record{Key: "b", Value: []byte("b")})
+
+	if _, err := snapshot.Read(bytes.NewReader(data[:len(data)/2])); !errors.Is(err, snapshot.ErrCorrupted) {
+		t.Errorf("expected a truncated snapshot to be rejected, got %v", err)
+	}
+
+	flipped := append([]byte(nil), data...)
+	flipped[len(flipped)/2] ^= 0xff
+	if _, err := snapshot.Read(bytes.NewReader(flipped)); err == nil {
+		t.Error("expected a damaged snapshot to be rejected")
+	}
+
+	if _, err := snapshot.Read(bytes.NewReader([]byte("not a snapshot"))); !errors.Is(err, snapshot.ErrCorrupted) {
+		t.Errorf("expected garbage to be rejected, got %v", err)
+	}
+}
+
+func TestReaderStreamsRecords(t *testing.T) {
+	data := writeSnapshot(t, snapshot.Record{Key: "a", Value: []byte("a")}, snapshot.Record{Key: "b", Value: []byte("b")})
+
+	reader, err := snapshot.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+
+	var keys []string
+	for {
+		record, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys = append(keys, record.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("expected the records in order, got %v", keys)
+	}
+
+	truncated, err := snapshot.NewReader(bytes.NewReader(data[:len(data)-4]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer truncated.Close()
+	for err == nil {
+		_, err = truncated.Next()
+	}
+	if !errors.Is(err, snapshot.ErrCorrupted) {
+		t.Errorf("expected the truncated snapshot to fail at the end, got %v", err)
+	}
+}
+
+func TestRecordTTL(t *testing.T) {
+	now := time.Now()
+	if record := (snapshot.Record{}); record.Expired(now) || record.TTL(now) != 0 {
+		t.Error("expected a record without expiry to never expire")
+	}
+	if record := (snapshot.Record{ExpiresAt: now.Add(-time.Second)}); !record.Expired(now) {
+		t.Error("expected a past expiry to be expired")
+	}
+	if record := (snapshot.Record{ExpiresAt: now.Add(time.Minute)}); record.Expired(now) || record.TTL(now) != time.Minute {
+		t.Errorf("expected the remaining ttl, got %v", record.TTL(now))
+	}
+}
@@ -0,0 +1,138 @@
+package tests
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/admin"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/valyala/fasthttp"
+)
+
+func listen(t *testing.T, cacheServer *server.CacheServer) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	go (&fasthttp.Server{Handler: cacheServer.Handler()}).Serve(listener)
+	return listener.Addr().String()
+}
+
+func TestAdminClientPurgesEveryReplica(t *testing.T) {
+	first, firstRepo := newMemoryServer(t)
+	second, secondRepo := newMemoryServer(t)
+	fillServer(t, first, firstRepo, "/products/1", "/products/2")
+	fillServer(t, second, secondRepo, "/products/1")
+	addresses := []string{listen(t, second), listen(t, first)}
+
+	client := admin.NewClient(time.Second, testAdminToken)
+	results := admin.FanOut(context.Background(), addresses, func(ctx context.Context, address string) (interface{}, error) {
+		return client.Purge(ctx, address, []string{"tag:products"})
+	})
+
+	if len(results) != 2 || results[0].Address > results[1].Address {
+		t.Fatalf("expected a result per replica ordered by address, got %+v", results)
+	}
+	removed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			t.Fatalf("%s: %s", result.Address, result.Error)
+		}
+		removed += result.Result.(model.PurgeResponse).Removed
+	}
+	if removed != 3 || firstRepo.Len() != 0 || secondRepo.Len() != 0 {
+		t.Errorf("expected every replica to be purged, removed %d, left %d and %d", removed, firstRepo.Len(), secondRepo.Len())
+	}
+}
+
+func TestAdminClientInspectsAndListsKeys(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1")
+	address := listen(t, cacheServer)
+	client := admin.NewClient(time.Second, testAdminToken)
+
+	info, err := client.Inspect(context.Background(), address, "/products/1", 1)
+	if err != nil || !info.Cached || info.Preview != "{" || !info.Truncated {
+		t.Errorf("expected the cached entry, got %+v %v", info, err)
+	}
+	info, err = client.Inspect(context.Background(), address, "/products/2", 1)
+	if err != nil || info.Cached || info.URL != "/products/2?" {
+		t.Errorf("expected an uncached url to be described without an error, got %+v %v", info, err)
+	}
+
+	keys, err := client.Keys(context.Background(), address, server.KeysOrderRecent, 10)
+	if err != nil || len(keys) != 1 || keys[0].URL != "/products/1?" {
+		t.Errorf("expected the cached key, got %+v %v", keys, err)
+	}
+	if _, err := client.Keys(context.Background(), address, "size", 10); err == nil {
+		t.Error("expected an error for an unsupported order")
+	}
+}
+
+func TestAdminClientWarmsAndReportsStats(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	address := listen(t, cacheServer)
+	client := admin.NewClient(time.Second, testAdminToken)
+
+	if _, err := client.Warm(context.Background(), address, model.WarmRequest{URLs: []string{"/products/1", "/products/2"}}); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool {
+		progress, err := client.WarmProgress(context.Background(), address)
+		return err == nil && !progress.Running && progress.Fetched == 2
+	})
+	waitFor(t, func() bool { return repo.Len() == 2 })
+
+	stats, err := client.Stats(context.Background(), address)
+	if err != nil || !stats.Ready {
+		t.Errorf("expected the replica to be ready, got %+v %v", stats, err)
+	}
+}
+
+func TestAdminClientHitRatioOnlyCountsLookups(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&fasthttp.Server{Handler: func(ctx *fasthttp.RequestCtx) {
+		if string(ctx.Path()) == "/metrics" {
+			ctx.SetBodyString(`sidecache_all_request_hit_counter 10
+sidecache_cache_request_counter{outcome="bypass"} 6
+sidecache_cache_request_counter{outcome="hit"} 3
+sidecache_cache_request_counter{outcome="miss"} 1
+`)
+		}
+	}}).Serve(listener)
+
+	stats, err := admin.NewClient(time.Second, testAdminToken).Stats(context.Background(), listener.Addr().String())
+	if err != nil || stats.Requests != 4 || stats.Hits != 3 || stats.HitRatio != 0.75 {
+		t.Errorf("expected the hit ratio of the hits and misses, got %+v %v", stats, err)
+	}
+}
+
+func TestAdminFanOutReportsFailedReplicas(t *testing.T) {
+	cacheServer, _ := newMemoryServer(t)
+	address := listen(t, cacheServer)
+	client := admin.NewClient(time.Second, testAdminToken)
+
+	results := admin.FanOut(context.Background(), []string{address, "127.0.0.1:1"}, func(ctx context.Context, address string) (interface{}, error) {
+		return client.WarmProgress(ctx, address)
+	})
+	failed := 0
+	for _, result := range results {
+		if result.Error != "" {
+			failed++
+			if result.Address != "127.0.0.1:1" || result.Result != nil {
+				t.Errorf("expected only the unreachable replica to fail, got %+v", result)
+			}
+		}
+	}
+	if failed != 1 {
+		t.Errorf("expected one failed replica, got %+v", results)
+	}
+}
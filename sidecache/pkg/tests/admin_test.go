@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/valyala/fasthttp"
+)
+
+func adminGet(t *testing.T, cacheServer *server.CacheServer, uri string, value interface{}) int {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.Set(server.AdminTokenHeaderKey, testAdminToken)
+	cacheServer.Handler()(ctx)
+	if value != nil && ctx.Response.StatusCode() < http.StatusBadRequest {
+		if err := json.Unmarshal(ctx.Response.Body(), value); err != nil {
+			t.Fatalf("%s: %v %s", uri, err, ctx.Response.Body())
+		}
+	}
+	return ctx.Response.StatusCode()
+}
+
+func TestInspectNormalizesTheURL(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1?b=2&a=1")
+	serve(cacheServer, fasthttp.MethodGet, "/products/1?a=1&b=2")
+
+	var info model.EntryInfo
+	status := adminGet(t, cacheServer, server.InspectPath+"?url="+url.QueryEscape("/products/1?b=2&a=1"), &info)
+	if status != http.StatusOK || !info.Cached {
+		t.Fatalf("expected the entry to be cached, got %d %+v", status, info)
+	}
+	if info.URL != "/products/1?a=1&b=2" || info.Key != hex.EncodeToString([]byte(cacheServer.HashURL(info.URL))) {
+		t.Errorf("expected the normalized url and its key, got %s %s", info.URL, info.Key)
+	}
+	if info.Preview != "{}" || info.Truncated || info.Size == 0 {
+		t.Errorf("expected the decoded body, got %q truncated %v size %d", info.Preview, info.Truncated, info.Size)
+	}
+	if len(info.Tags) != 1 || info.Tags[0] != "products" || info.Hits != 1 || info.ExpiresAt == nil {
+		t.Errorf("expected the tags, hits and expiry, got %+v", info)
+	}
+	if info.CachedAt == nil || time.Since(*info.CachedAt) > time.Minute || !info.CachedAt.Before(*info.ExpiresAt) {
+		t.Errorf("expected the time the entry was cached, got %v", info.CachedAt)
+	}
+	if age, err := time.ParseDuration(info.Age); err != nil || age < 0 || age > time.Minute {
+		t.Errorf("expected the age of the entry, got %q %v", info.Age, err)
+	}
+
+	adminGet(t, cacheServer, server.InspectPath+"?preview=1&url="+url.QueryEscape("/products/1?a=1&b=2"), &info)
+	if info.Preview != "{" || !info.Truncated {
+		t.Errorf("expected a truncated preview, got %q", info.Preview)
+	}
+
+	if status := adminGet(t, cacheServer, server.InspectPath+"?url=/products/2", nil); status != http.StatusNotFound {
+		t.Errorf("expected an uncached url to be not found, got %d", status)
+	}
+	if status := adminGet(t, cacheServer, server.InspectPath, nil); status != http.StatusBadRequest {
+		t.Errorf("expected the url to be required, got %d", status)
+	}
+}
+
+func TestKeysListsRecentAndTopKeys(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1")
+	fillServer(t, cacheServer, repo, "/products/1", "/products/2")
+	fillServer(t, cacheServer, repo, "/products/1", "/products/2", "/products/3")
+	for i := 0; i < 3; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/2")
+	}
+
+	var recent []model.KeyInfo
+	adminGet(t, cacheServer, server.KeysPath+"?order=recent&limit=2", &recent)
+	if len(recent) != 2 || recent[0].URL != "/products/3?" || recent[1].URL != "/products/2?" {
+		t.Errorf("expected the two most recent urls, got %+v", recent)
+	}
+
+	var top []model.KeyInfo
+	adminGet(t, cacheServer, server.KeysPath+"?order=top", &top)
+	if len(top) != 3 || top[0].URL != "/products/2?" || top[0].Hits != 4 || top[1].URL != "/products/1?" {
+		t.Errorf("expected the keys by hits, got %+v", top)
+	}
+
+	if status := adminGet(t, cacheServer, server.KeysPath+"?order=size", nil); status != http.StatusNotImplemented {
+		t.Errorf("expected an unknown order to be refused, got %d", status)
+	}
+}
+
+func TestAdminEndpointsRequireTheAdminToken(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1")
+	handler := cacheServer.Handler()
+
+	for _, uri := range []string{server.InspectPath + "?url=/products/1", server.KeysPath, server.WarmPath} {
+		for _, token := range []string{"", "wrong"} {
+			ctx := &fasthttp.RequestCtx{}
+			ctx.Request.SetRequestURI(uri)
+			ctx.Request.Header.Set(server.AdminTokenHeaderKey, token)
+			handler(ctx)
+			if ctx.Response.StatusCode() != http.StatusForbidden {
+				t.Errorf("%s: expected token %q to be forbidden, got %d", uri, token, ctx.Response.StatusCode())
+			}
+		}
+	}
+}
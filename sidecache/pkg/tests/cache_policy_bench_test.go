@@ -0,0 +1,84 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	traceLength    = 500000
+	traceKeySpace  = 100000
+	policyCacheMax = 2000 * 512
+)
+
+var policyValue = make([]byte, 256)
+
+func zipfTrace() []string {
+	random := rand.New(rand.NewSource(1))
+	zipf := rand.NewZipf(random, 1.01, 1, traceKeySpace)
+	trace := make([]string, traceLength)
+	for i := range trace {
+		trace[i] = fmt.Sprintf("/products/%d", zipf.Uint64())
+	}
+	return trace
+}
+
+// scanTrace mixes the zipf trace with crawler-like scans over urls that are requested only once.
+func scanTrace() []string {
+	trace := zipfTrace()
+	scanned := 0
+	for i := 0; i < len(trace); i += 10000 {
+		for j := i; j < i+3000 && j < len(trace); j++ {
+			trace[j] = fmt.Sprintf("/crawled/%d", scanned)
+			scanned++
+		}
+	}
+	return trace
+}
+
+// replayTrace requests the urls of the trace from an empty cache of the policy, filling it on misses, and
+// returns the number of hits.
+func replayTrace(b *testing.B, policy string, trace []string) int {
+	repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: policyCacheMax, Shards: 1, Policy: policy},
+		metric.NewPrometheus(prometheus.NewRegistry()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer repo.Close()
+
+	ctx := context.Background()
+	hits := 0
+	for _, key := range trace {
+		if _, err := repo.Get(ctx, key); err == nil {
+			hits++
+		} else {
+			_ = repo.Set(ctx, key, policyValue, 0)
+		}
+	}
+	return hits
+}
+
+// BenchmarkCachePolicyHitRatio reports the hit ratio of the eviction policies as hit% next to the usual timings.
+// Every iteration replays the whole trace on an empty cache, so the ratio doesn't depend on b.N.
+func BenchmarkCachePolicyHitRatio(b *testing.B) {
+	traces := map[string][]string{"zipf": zipfTrace(), "scan": scanTrace()}
+
+	for _, traceName := range []string{"zipf", "scan"} {
+		for _, policy := range []string{cache.PolicyLRU, cache.PolicyTinyLFU} {
+			trace := traces[traceName]
+			b.Run(traceName+"/"+policy, func(b *testing.B) {
+				hits := 0
+				for i := 0; i < b.N; i++ {
+					hits = replayTrace(b, policy, trace)
+				}
+				b.ReportMetric(float64(hits)*100/float64(len(trace)), "hit%")
+			})
+		}
+	}
+}
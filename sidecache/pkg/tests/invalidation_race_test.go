@@ -0,0 +1,278 @@
+package tests
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/invalidation"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/golang/mock/gomock"
+	"github.com/klauspost/compress/gzip"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// mapBackedMock makes the mock behave like a concurrency-safe store.
+func mapBackedMock(ctrl *gomock.Controller) (*cache.MockCacheRepository, func(key string) ([]byte, bool)) {
+	var (
+		mu   sync.Mutex
+		data = map[string][]byte{}
+	)
+
+	repo := cache.NewMockCacheRepository(ctrl)
+	repo.EXPECT().Get(gomock.Any()).AnyTimes().DoAndReturn(func(key string) []byte {
+		mu.Lock()
+		defer mu.Unlock()
+		return data[key]
+	})
+	repo.EXPECT().SetKey(gomock.Any(), gomock.Any()).AnyTimes().Do(func(key string, value []byte) {
+		mu.Lock()
+		defer mu.Unlock()
+		data[key] = value
+	})
+	repo.EXPECT().Remove(gomock.Any()).AnyTimes().DoAndReturn(func(key string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		delete(data, key)
+		return nil
+	})
+
+	return repo, func(key string) ([]byte, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		value, ok := data[key]
+		return value, ok
+	}
+}
+
+func newCachingServer(t *testing.T, repo cache.LegacyCacheRepository, handler fasthttp.RequestHandler) *server.CacheServer {
+	return server.NewServer(cache.FromLegacy(repo), newUpstream(t, handler), zap.NewNop(), metric.NewPrometheus(prometheus.NewRegistry()))
+}
+
+func waitFor(t *testing.T, condition func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition was not met in time")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFillFetchedBeforeWriteIsDiscarded(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo := cache.NewMockCacheRepository(ctrl)
+	repo.EXPECT().Get(gomock.Any()).Return(nil).AnyTimes()
+	repo.EXPECT().Remove(gomock.Any()).Return(nil).AnyTimes()
+	repo.EXPECT().SetKey(gomock.Any(), gomock.Any()).Times(0)
+
+	getStarted := make(chan struct{})
+	releaseGet := make(chan struct{})
+	cacheServer := newCachingServer(t, repo, func(ctx *fasthttp.RequestCtx) {
+		if ctx.IsGet() {
+			close(getStarted)
+			<-releaseGet
+			ctx.Response.Header.Set(server.CacheHeaderKey, "true")
+			ctx.SetBodyString("old")
+		}
+	})
+
+	getDone := make(chan struct{})
+	go func() {
+		serve(cacheServer, fasthttp.MethodGet, "/products/42")
+		close(getDone)
+	}()
+
+	<-getStarted
+	serve(cacheServer, fasthttp.MethodPut, "/products/42")
+	close(releaseGet)
+	<-getDone
+
+	// give the background fill a chance to run before the controller verifies SetKey was not called
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestInvalidationDuringFillRemovesTheEntry(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	var (
+		mu          sync.Mutex
+		data        = map[string][]byte{}
+		filled      = make(chan struct{})
+		removed     = make(chan struct{}, 10)
+		cacheServer *server.CacheServer
+	)
+
+	repo := cache.NewMockCacheRepository(ctrl)
+	repo.EXPECT().Get(gomock.Any()).Return(nil).AnyTimes()
+	repo.EXPECT().Remove(gomock.Any()).AnyTimes().DoAndReturn(func(key string) error {
+		mu.Lock()
+		delete(data, key)
+		mu.Unlock()
+		removed <- struct{}{}
+		return nil
+	})
+	repo.EXPECT().SetKey(gomock.Any(), gomock.Any()).Times(1).Do(func(key string, value []byte) {
+		// a write is fully invalidated after the fill checked its generation but before its value is stored
+		serve(cacheServer, fasthttp.MethodPut, "/products/42")
+		<-removed
+
+		mu.Lock()
+		data[key] = value
+		mu.Unlock()
+		close(filled)
+	})
+
+	cacheServer = newCachingServer(t, repo, func(ctx *fasthttp.RequestCtx) {
+		if ctx.IsGet() {
+			ctx.Response.Header.Set(server.CacheHeaderKey, "true")
+			ctx.SetBodyString("old")
+		}
+	})
+
+	serve(cacheServer, fasthttp.MethodGet, "/products/42")
+	<-filled
+
+	waitFor(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(data) == 0
+	})
+}
+
+func TestConcurrentReadsAndWritesNeverLeaveStaleEntries(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+
+	repo, lookup := mapBackedMock(ctrl)
+
+	var (
+		mu       sync.Mutex
+		versions = map[string]int{}
+	)
+	cacheServer := newCachingServer(t, repo, func(ctx *fasthttp.RequestCtx) {
+		path := string(ctx.Path())
+		mu.Lock()
+		if !ctx.IsGet() {
+			versions[path]++
+		}
+		version := versions[path]
+		mu.Unlock()
+
+		if ctx.IsGet() {
+			time.Sleep(time.Duration(rand.Intn(200)) * time.Microsecond)
+			ctx.Response.Header.Set(server.CacheHeaderKey, "true")
+			ctx.SetBodyString(strconv.Itoa(version))
+		}
+	})
+
+	paths := []string{"/products/1", "/products/2", "/products/3"}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			random := rand.New(rand.NewSource(int64(worker)))
+			for j := 0; j < 100; j++ {
+				path := paths[random.Intn(len(paths))]
+				method := fasthttp.MethodGet
+				if random.Intn(4) == 0 {
+					method = fasthttp.MethodPut
+				}
+				serve(cacheServer, method, path)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// background fills and removals are done once nothing changes anymore
+	time.Sleep(200 * time.Millisecond)
+
+	for _, path := range paths {
+		value, ok := lookup(cacheServer.HashURL(path + "?"))
+		if !ok {
+			continue
+		}
+
+		mu.Lock()
+		latest := versions[path]
+		mu.Unlock()
+
+		if cached := cachedBody(t, value); cached != strconv.Itoa(latest) {
+			t.Errorf("%s: stale entry survived, cached version %s, latest version %d", path, cached, latest)
+		}
+	}
+}
+
+func cachedBody(t *testing.T, value []byte) string {
+	var cacheData model.CacheData
+	if err := cacheData.UnmarshalJSON(value); err != nil {
+		t.Fatal(err)
+	}
+
+	reader, err := gzip.NewReader(bytes.NewReader(cacheData.Body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := ioutil.ReadAll(reader)
+	if err != nil {
+		t.Fatal(fmt.Errorf("could not read cached body: %w", err))
+	}
+	return string(body)
+}
+
+func TestTagAndPrefixInvalidationsDiscardInFlightFills(t *testing.T) {
+	for _, target := range []string{"tag:product-42", "prefix:/products/", "/products/*"} {
+		t.Run(target, func(t *testing.T) {
+			metrics := metric.NewPrometheus(prometheus.NewRegistry())
+			repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20}, metrics)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer repo.Close()
+
+			getStarted := make(chan struct{})
+			releaseGet := make(chan struct{})
+			cacheServer := server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+				close(getStarted)
+				<-releaseGet
+				ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+				ctx.Response.Header.Set(server.CacheTagsHeaderKey, "product-42")
+				ctx.SetBodyString("old")
+			}), zap.NewNop(), metrics)
+
+			getDone := make(chan struct{})
+			go func() {
+				serve(cacheServer, fasthttp.MethodGet, "/products/42")
+				close(getDone)
+			}()
+
+			// the fill isn't indexed yet, so only its in-flight registration can be found
+			<-getStarted
+			if _, err := cacheServer.Invalidate([]invalidation.Target{invalidation.ParseTarget(target)}); err != nil {
+				t.Fatal(err)
+			}
+			close(releaseGet)
+			<-getDone
+
+			cacheServer.FlushWrites()
+			if repo.Len() != 0 {
+				t.Errorf("expected the fill fetched before the invalidation to be discarded, got %d entries", repo.Len())
+			}
+		})
+	}
+}
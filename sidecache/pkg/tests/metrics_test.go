@@ -0,0 +1,109 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+func purge(cacheServer *server.CacheServer, body string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+	ctx.Request.SetRequestURI("/purge")
+	ctx.Request.SetBodyString(body)
+	cacheServer.PurgeHandler(ctx)
+	return ctx
+}
+
+func TestRequestsAreCountedByOutcome(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1", "/products/2")
+	serve(cacheServer, fasthttp.MethodGet, "/products/1")
+	serve(cacheServer, fasthttp.MethodPost, "/products/1")
+
+	requests := cacheServer.Metrics.CacheRequestCounter
+	for outcome, expected := range map[string]float64{
+		server.OutcomeHit:    1,
+		server.OutcomeMiss:   2,
+		server.OutcomeBypass: 1,
+		server.OutcomeError:  0,
+	} {
+		if count := testutil.ToFloat64(requests.WithLabelValues(outcome)); count != expected {
+			t.Errorf("expected %v %s requests, got %v", expected, outcome, count)
+		}
+	}
+	if hits := testutil.ToFloat64(cacheServer.Metrics.CacheHitCounter); hits != 1 {
+		t.Errorf("expected 1 hit, got %v", hits)
+	}
+	if total := testutil.ToFloat64(cacheServer.Metrics.TotalRequestCounter); total != 4 {
+		t.Errorf("expected 4 requests, got %v", total)
+	}
+}
+
+type removeFailingRepository struct {
+	*cache.MemoryRepository
+}
+
+func (repository removeFailingRepository) Remove(ctx context.Context, key string) error {
+	return errors.New("backend down")
+}
+
+func TestPurgesAreCountedWhenRequestedAndSucceeded(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1", "/products/2")
+
+	if ctx := purge(cacheServer, `{"url": "/products/1"}`); ctx.Response.StatusCode() != http.StatusOK {
+		t.Fatalf("expected the url to be purged, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := purge(cacheServer, `{"targets": ["tag:products"]}`); ctx.Response.StatusCode() != http.StatusOK {
+		t.Fatalf("expected the tag to be purged, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := purge(cacheServer, `{`); ctx.Response.StatusCode() != http.StatusBadRequest {
+		t.Fatalf("expected a malformed purge to be rejected, got %d", ctx.Response.StatusCode())
+	}
+
+	cacheServer.Repo = removeFailingRepository{repo}
+	if ctx := purge(cacheServer, `{"url": "/products/2"}`); ctx.Response.StatusCode() != http.StatusInternalServerError {
+		t.Fatalf("expected the failed purge to be reported, got %d", ctx.Response.StatusCode())
+	}
+
+	if requested := testutil.ToFloat64(cacheServer.Metrics.PurgeRequestCounter); requested != 3 {
+		t.Errorf("expected 3 requested purges, got %v", requested)
+	}
+	if succeeded := testutil.ToFloat64(cacheServer.Metrics.PurgeSuccessCounter); succeeded != 2 {
+		t.Errorf("expected 2 succeeded purges, got %v", succeeded)
+	}
+}
+
+func TestProxyErrorsAreCounted(t *testing.T) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+	upstream := &fasthttp.HostClient{
+		Addr: "upstream",
+		Dial: func(addr string) (net.Conn, error) { return nil, errors.New("connection refused") },
+	}
+	cacheServer := server.NewServer(repo, upstream, zap.NewNop(), metrics)
+
+	for _, method := range []string{fasthttp.MethodGet, fasthttp.MethodPost} {
+		if ctx := serve(cacheServer, method, "/products/1"); ctx.Response.StatusCode() != http.StatusBadGateway {
+			t.Fatalf("%s: expected a bad gateway, got %d", method, ctx.Response.StatusCode())
+		}
+	}
+	if errors := testutil.ToFloat64(metrics.ProxyErrorCounter); errors != 2 {
+		t.Errorf("expected 2 proxy errors, got %v", errors)
+	}
+}
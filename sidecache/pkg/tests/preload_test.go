@@ -0,0 +1,184 @@
+package tests
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/discovery"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/Trendyol/sidecache/pkg/snapshot"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+const testAdminToken = "secret"
+
+// newMemoryServer creates a server on an in-memory cache whose upstream caches every response for a minute.
+func newMemoryServer(t *testing.T) (*server.CacheServer, *cache.MemoryRepository) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 2}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.Close)
+
+	cacheServer := server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.Response.Header.Set(server.CacheTagsHeaderKey, "products")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+	cacheServer.AdminToken = testAdminToken
+	return cacheServer, repo
+}
+
+func fillServer(t *testing.T, cacheServer *server.CacheServer, repo *cache.MemoryRepository, uris ...string) {
+	for _, uri := range uris {
+		serve(cacheServer, fasthttp.MethodGet, uri)
+	}
+	waitFor(t, func() bool { return repo.Len() == len(uris) })
+}
+
+func TestPreloadFromPeerDump(t *testing.T) {
+	source, sourceRepo := newMemoryServer(t)
+	fillServer(t, source, sourceRepo, "/products/1", "/products/2")
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go (&fasthttp.Server{Handler: source.Handler()}).Serve(listener)
+
+	target, targetRepo := newMemoryServer(t)
+	target.Preload(server.PreloadOptions{
+		Peers:   discovery.Static{"127.0.0.1:1", listener.Addr().String()},
+		Timeout: 5 * time.Second,
+	})
+
+	if !target.Ready() || targetRepo.Len() != 2 {
+		t.Fatalf("expected the peer's entries to be preloaded, got %d entries", targetRepo.Len())
+	}
+	if _, err := targetRepo.Get(context.Background(), target.HashURL("/products/1?")); err != nil {
+		t.Errorf("expected the preloaded entry, got %v", err)
+	}
+	entries, _ := target.Index.ByTag("products")
+	if len(entries) != 2 {
+		t.Errorf("expected the preloaded urls and tags to be indexed, got %v", entries)
+	}
+}
+
+func TestPreloadFromSnapshotFileSkipsExpiredEntries(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sidecache-preload")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var buf bytes.Buffer
+	writer, _ := snapshot.NewWriter(&buf)
+	_ = writer.Write(snapshot.Record{Key: "live", Value: []byte("live"), ExpiresAt: time.Now().Add(time.Minute)})
+	_ = writer.Write(snapshot.Record{Key: "expired", Value: []byte("expired"), ExpiresAt: time.Now().Add(-time.Second)})
+	_ = writer.Close()
+	file := filepath.Join(dir, "cache.snapshot")
+	_ = ioutil.WriteFile(file, buf.Bytes(), 0644)
+
+	target, targetRepo := newMemoryServer(t)
+	target.Preload(server.PreloadOptions{SnapshotFile: file})
+
+	if targetRepo.Len() != 1 {
+		t.Fatalf("expected only the live entry, got %d entries", targetRepo.Len())
+	}
+	if _, err := targetRepo.Get(context.Background(), "live"); err != nil {
+		t.Errorf("expected the live entry, got %v", err)
+	}
+}
+
+func TestReadinessAndDumpWhileWarming(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1")
+	handler := cacheServer.Handler()
+
+	request := func(path string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(path)
+		ctx.Request.Header.Set(server.AdminTokenHeaderKey, testAdminToken)
+		handler(ctx)
+		return ctx
+	}
+
+	cacheServer.SetReady(false)
+	if status := request(server.ReadyPath).Response.StatusCode(); status != fasthttp.StatusServiceUnavailable {
+		t.Errorf("expected not ready while warming, got %d", status)
+	}
+	if status := request(server.DumpPath).Response.StatusCode(); status != fasthttp.StatusServiceUnavailable {
+		t.Errorf("expected no dump while warming, got %d", status)
+	}
+
+	cacheServer.SetReady(true)
+	if status := request(server.ReadyPath).Response.StatusCode(); status != fasthttp.StatusOK {
+		t.Errorf("expected ready, got %d", status)
+	}
+	records, err := snapshot.Read(bytes.NewReader(request(server.DumpPath).Response.Body()))
+	if err != nil || len(records) != 1 || records[0].URL != "/products/1?" {
+		t.Errorf("expected the dumped entry with its url, got %+v %v", records, err)
+	}
+}
+
+func TestDumpRequiresTheAdminToken(t *testing.T) {
+	cacheServer, repo := newMemoryServer(t)
+	fillServer(t, cacheServer, repo, "/products/1")
+	handler := cacheServer.Handler()
+
+	for _, token := range []string{"", "wrong"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(server.DumpPath)
+		ctx.Request.Header.Set(server.AdminTokenHeaderKey, token)
+		handler(ctx)
+		if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+			t.Errorf("expected a dump with token %q to be forbidden, got %d", token, ctx.Response.StatusCode())
+		}
+	}
+
+	cacheServer.AdminToken = ""
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(server.DumpPath)
+	handler(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusForbidden {
+		t.Errorf("expected no dump without ADMIN_TOKEN, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestPreloadGivesUpAfterTheTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	// accepts connections but never answers
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	target, _ := newMemoryServer(t)
+	started := time.Now()
+	target.Preload(server.PreloadOptions{Peers: discovery.Static{listener.Addr().String()}, Timeout: 100 * time.Millisecond})
+
+	if !target.Ready() || time.Since(started) > time.Second {
+		t.Errorf("expected the replica to be ready after the timeout, took %v", time.Since(started))
+	}
+}
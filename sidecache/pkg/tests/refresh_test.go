@@ -0,0 +1,125 @@
+package tests
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+func setRefreshEnv(t *testing.T, values map[string]string) {
+	for name, value := range values {
+		name := name
+		_ = os.Setenv(name, value)
+		t.Cleanup(func() { _ = os.Unsetenv(name) })
+	}
+}
+
+// newRefreshServer creates a server on an in-memory cache whose upstream takes delay to answer and
+// caches for maxAge seconds. It returns the number of upstream requests.
+func newRefreshServer(t *testing.T, delay time.Duration, maxAge int) (*server.CacheServer, *cache.MemoryRepository, *metric.Prometheus, *int32) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 2}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(repo.Close)
+
+	var requests int32
+	cacheServer := server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&requests, 1)
+		time.Sleep(delay)
+		ctx.Response.Header.Set(server.CacheHeaderKey, fmt.Sprintf("max-age=%d", maxAge))
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+	return cacheServer, repo, metrics, &requests
+}
+
+func TestPopularEntriesAreRefreshedBeforeTheyExpire(t *testing.T) {
+	// with a 50ms fetch and beta 100 most hits fall into the refresh window of a one second entry
+	setRefreshEnv(t, map[string]string{"REFRESH_HIT_THRESHOLD": "3", "REFRESH_BETA": "100"})
+	cacheServer, repo, metrics, requests := newRefreshServer(t, 50*time.Millisecond, 1)
+
+	fillServer(t, cacheServer, repo, "/products/1")
+	serve(cacheServer, fasthttp.MethodGet, "/products/1")
+	serve(cacheServer, fasthttp.MethodGet, "/products/1")
+	time.Sleep(100 * time.Millisecond)
+	if count := atomic.LoadInt32(requests); count != 1 {
+		t.Fatalf("expected no refresh below the hit threshold, got %d upstream requests", count)
+	}
+
+	for i := 0; i < 50 && atomic.LoadInt32(requests) == 1; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/1")
+		time.Sleep(10 * time.Millisecond)
+	}
+	waitFor(t, func() bool { return atomic.LoadInt32(requests) == 2 })
+	if refreshes := testutil.ToFloat64(metrics.CacheRefreshCounter); refreshes != 1 {
+		t.Errorf("expected 1 refresh, got %v", refreshes)
+	}
+}
+
+func TestUnpopularEntriesAreNotRefreshed(t *testing.T) {
+	setRefreshEnv(t, map[string]string{"REFRESH_HIT_THRESHOLD": "1000", "REFRESH_BETA": "100"})
+	cacheServer, repo, _, requests := newRefreshServer(t, 50*time.Millisecond, 1)
+
+	fillServer(t, cacheServer, repo, "/products/1")
+	for i := 0; i < 20; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/1")
+	}
+	time.Sleep(100 * time.Millisecond)
+	if count := atomic.LoadInt32(requests); count != 1 {
+		t.Errorf("expected no refresh, got %d upstream requests", count)
+	}
+}
+
+func TestDroppedRefreshesAreRetried(t *testing.T) {
+	setRefreshEnv(t, map[string]string{"REFRESH_HIT_THRESHOLD": "1", "REFRESH_BETA": "100"})
+	cacheServer, repo, metrics, requests := newRefreshServer(t, 50*time.Millisecond, 1)
+
+	fillServer(t, cacheServer, repo, "/products/1")
+	// the write pipeline drops every fill once it is flushed
+	cacheServer.FlushWrites()
+
+	for i := 0; i < 100 && atomic.LoadInt32(requests) < 3; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/1")
+		time.Sleep(10 * time.Millisecond)
+	}
+	if refreshes := testutil.ToFloat64(metrics.CacheRefreshCounter); refreshes < 2 {
+		t.Errorf("expected the entry to be refreshed again after a dropped refresh, got %v refreshes", refreshes)
+	}
+}
+
+func TestTTLJitterShortensExpiry(t *testing.T) {
+	setRefreshEnv(t, map[string]string{"CACHE_TTL_JITTER": "0.5"})
+	cacheServer, repo, _, _ := newRefreshServer(t, 0, 60)
+
+	var uris []string
+	for i := 0; i < 20; i++ {
+		uris = append(uris, fmt.Sprintf("/products/%d", i))
+	}
+	fillServer(t, cacheServer, repo, uris...)
+
+	now := time.Now()
+	expiries := map[time.Duration]bool{}
+	_ = repo.Range(context.Background(), func(item cache.Item) bool {
+		ttl := item.ExpiresAt.Sub(now)
+		if ttl < 29*time.Second || ttl > 60*time.Second {
+			t.Errorf("expected the ttl to be between 30s and 60s, got %v", ttl)
+		}
+		expiries[ttl.Round(time.Second)] = true
+		return true
+	})
+	if len(expiries) < 2 {
+		t.Errorf("expected jittered expiries, got %v", expiries)
+	}
+}
@@ -0,0 +1,190 @@
+package tests
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+	"go.uber.org/zap"
+)
+
+type memoryRepository struct {
+	mu      sync.Mutex
+	data    map[string][]byte
+	removed chan string
+}
+
+func newMemoryRepository() *memoryRepository {
+	return &memoryRepository{data: map[string][]byte{}, removed: make(chan string, 100)}
+}
+
+func (repository *memoryRepository) SetKey(key string, value []byte) {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	repository.data[key] = value
+}
+
+func (repository *memoryRepository) Get(key string) []byte {
+	repository.mu.Lock()
+	defer repository.mu.Unlock()
+	return repository.data[key]
+}
+
+func (repository *memoryRepository) Remove(key string) error {
+	repository.mu.Lock()
+	delete(repository.data, key)
+	repository.mu.Unlock()
+	repository.removed <- key
+	return nil
+}
+
+func newUpstream(t *testing.T, handler fasthttp.RequestHandler) *fasthttp.HostClient {
+	listener := fasthttputil.NewInmemoryListener()
+	upstream := &fasthttp.Server{Handler: handler}
+	go upstream.Serve(listener)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	return &fasthttp.HostClient{
+		Addr: "upstream",
+		Dial: func(addr string) (net.Conn, error) { return listener.Dial() },
+	}
+}
+
+func newTestServer(t *testing.T, repo *memoryRepository, handler fasthttp.RequestHandler) *server.CacheServer {
+	return server.NewServer(cache.FromLegacy(repo), newUpstream(t, handler), zap.NewNop(), metric.NewPrometheus(prometheus.NewRegistry()))
+}
+
+func serve(cacheServer *server.CacheServer, method, uri string) *fasthttp.RequestCtx {
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.Header.SetMethod(method)
+	ctx.Request.SetRequestURI(uri)
+	ctx.Request.Header.SetHost("sidecache")
+	cacheServer.CacheHandler(ctx)
+	return ctx
+}
+
+func TestPurgeHeaderIsAppliedAndStripped(t *testing.T) {
+	repo := newMemoryRepository()
+	cacheServer := newTestServer(t, repo, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set(server.PurgeHeaderKey, "/products/42, /products/42/reviews?page=*")
+		ctx.SetBodyString("{}")
+	})
+
+	ctx := serve(cacheServer, fasthttp.MethodGet, "/products/42/reviews")
+
+	if value := ctx.Response.Header.Peek(server.PurgeHeaderKey); len(value) != 0 {
+		t.Errorf("expected purge header to be stripped, got %s", value)
+	}
+
+	select {
+	case key := <-repo.removed:
+		if key != cacheServer.HashURL("/products/42?") {
+			t.Errorf("unexpected key removed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("expected the purge header url to be removed")
+	}
+}
+
+type failingRepository struct {
+	sets int32
+}
+
+func (repository *failingRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, errors.New("backend down")
+}
+
+func (repository *failingRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	atomic.AddInt32(&repository.sets, 1)
+	return nil
+}
+
+func (repository *failingRepository) Remove(ctx context.Context, key string) error {
+	return nil
+}
+
+func TestBackendFailureIsServedFromUpstreamWithoutFilling(t *testing.T) {
+	repo := &failingRepository{}
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	cacheServer := server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+
+	ctx := serve(cacheServer, fasthttp.MethodGet, "/products/42")
+
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Body()) != "{}" {
+		t.Fatalf("expected the upstream response, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sets := atomic.LoadInt32(&repo.sets); sets != 0 {
+		t.Errorf("expected no fill while the backend is failing, got %d", sets)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheErrorCounter); errors != 1 {
+		t.Errorf("expected the backend error to be counted, got %v", errors)
+	}
+}
+
+func TestOpenBreakerBypassesTheCache(t *testing.T) {
+	repo := &failingRepository{}
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	breaker := cache.NewBreakerRepository(repo, cache.BreakerOptions{Threshold: 1, OpenTimeout: time.Hour}, metrics)
+	cacheServer := server.NewServer(breaker, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+
+	serve(cacheServer, fasthttp.MethodGet, "/products/42")
+	if state := breaker.State(); state != cache.BreakerOpen {
+		t.Fatalf("expected the failure to open the breaker, got %v", state)
+	}
+
+	ctx := serve(cacheServer, fasthttp.MethodGet, "/products/42")
+	if ctx.Response.StatusCode() != fasthttp.StatusOK || string(ctx.Response.Body()) != "{}" {
+		t.Fatalf("expected the upstream response, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	time.Sleep(50 * time.Millisecond)
+	if sets := atomic.LoadInt32(&repo.sets); sets != 0 {
+		t.Errorf("expected no fill while the breaker is open, got %d", sets)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheErrorCounter); errors != 1 {
+		t.Errorf("expected only the failure that opened the breaker to be counted, got %v", errors)
+	}
+	if errors := testutil.ToFloat64(metrics.CacheBackendErrorCounter.WithLabelValues(cache.OperationGet)); errors != 1 {
+		t.Errorf("expected the backend failure to be counted once, got %v", errors)
+	}
+	if requests := testutil.ToFloat64(metrics.CacheRequestCounter.WithLabelValues(server.OutcomeError)); requests != 2 {
+		t.Errorf("expected both requests to be served around the cache, got %v", requests)
+	}
+}
+
+func TestRegisteredRoutesAreServedBeforeTheCache(t *testing.T) {
+	cacheServer := newTestServer(t, newMemoryRepository(), func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("upstream")
+	})
+	cacheServer.Handle("/sidecache/test/", func(ctx *fasthttp.RequestCtx) {
+		ctx.SetBodyString("route")
+	})
+	handler := cacheServer.Handler()
+
+	for uri, expected := range map[string]string{"/sidecache/test/key": "route", "/products/42": "upstream"} {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(uri)
+		ctx.Request.Header.SetHost("sidecache")
+		handler(ctx)
+		if body := string(ctx.Response.Body()); body != expected {
+			t.Errorf("%s: expected %s, got %s", uri, expected, body)
+		}
+	}
+}
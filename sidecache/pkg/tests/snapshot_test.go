@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/valyala/fasthttp"
+)
+
+func newSnapshotDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "sidecache-snapshot")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.RemoveAll(dir) })
+	return dir
+}
+
+func TestSavedSnapshotIsReloadedOnBoot(t *testing.T) {
+	file := filepath.Join(newSnapshotDir(t), "cache.snapshot")
+	source, sourceRepo := newMemoryServer(t)
+	fillServer(t, source, sourceRepo, "/products/1", "/products/2")
+
+	count, err := source.SaveSnapshot(file)
+	if err != nil || count != 2 {
+		t.Fatalf("expected 2 entries to be saved, got %d %v", count, err)
+	}
+	if matches, _ := filepath.Glob(file + ".tmp*"); len(matches) != 0 {
+		t.Errorf("expected the temporary file to be renamed, got %v", matches)
+	}
+
+	target, targetRepo := newMemoryServer(t)
+	target.Preload(server.PreloadOptions{SnapshotFile: file})
+
+	if targetRepo.Len() != 2 {
+		t.Fatalf("expected the saved entries to be reloaded, got %d entries", targetRepo.Len())
+	}
+	if _, err := targetRepo.Get(context.Background(), target.HashURL("/products/2?")); err != nil {
+		t.Errorf("expected the reloaded entry, got %v", err)
+	}
+	if entries, _ := target.Index.ByTag("products"); len(entries) != 2 {
+		t.Errorf("expected the reloaded urls and tags to be indexed, got %v", entries)
+	}
+}
+
+func TestCorruptedSnapshotIsRejected(t *testing.T) {
+	file := filepath.Join(newSnapshotDir(t), "cache.snapshot")
+	source, sourceRepo := newMemoryServer(t)
+	fillServer(t, source, sourceRepo, "/products/1")
+	if _, err := source.SaveSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	data, _ := ioutil.ReadFile(file)
+	_ = ioutil.WriteFile(file, data[:len(data)-8], 0644)
+
+	target, targetRepo := newMemoryServer(t)
+	target.Preload(server.PreloadOptions{SnapshotFile: file})
+
+	if !target.Ready() || targetRepo.Len() != 0 {
+		t.Fatalf("expected the corrupted snapshot to be rejected, got %d entries", targetRepo.Len())
+	}
+}
+
+func TestMissingSnapshotStartsEmpty(t *testing.T) {
+	target, targetRepo := newMemoryServer(t)
+	target.Preload(server.PreloadOptions{SnapshotFile: filepath.Join(newSnapshotDir(t), "cache.snapshot")})
+
+	if !target.Ready() || targetRepo.Len() != 0 {
+		t.Fatalf("expected an empty ready cache, got %d entries", targetRepo.Len())
+	}
+}
+
+func TestSharedBackendsAreNotSnapshotted(t *testing.T) {
+	file := filepath.Join(newSnapshotDir(t), "cache.snapshot")
+	source, sourceRepo := newMemoryServer(t)
+	fillServer(t, source, sourceRepo, "/products/1")
+	source.LocalRepo = nil
+
+	if _, err := source.SaveSnapshot(file); err == nil {
+		t.Error("expected the snapshot of a shared backend to be refused")
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("expected no snapshot file, got %v", err)
+	}
+
+	ctx := &fasthttp.RequestCtx{}
+	ctx.Request.SetRequestURI(server.DumpPath)
+	ctx.Request.Header.Set(server.AdminTokenHeaderKey, testAdminToken)
+	source.Handler()(ctx)
+	if ctx.Response.StatusCode() != fasthttp.StatusNotImplemented {
+		t.Errorf("expected the dump of a shared backend to be refused, got %d", ctx.Response.StatusCode())
+	}
+}
+
+func TestSharedBackendsAreNotPreloaded(t *testing.T) {
+	file := filepath.Join(newSnapshotDir(t), "cache.snapshot")
+	source, sourceRepo := newMemoryServer(t)
+	fillServer(t, source, sourceRepo, "/products/1")
+	if _, err := source.SaveSnapshot(file); err != nil {
+		t.Fatal(err)
+	}
+
+	target, targetRepo := newMemoryServer(t)
+	target.LocalRepo = nil
+	target.Preload(server.PreloadOptions{SnapshotFile: file})
+
+	if !target.Ready() || targetRepo.Len() != 0 {
+		t.Fatalf("expected a shared backend to start without the snapshot, got %d entries", targetRepo.Len())
+	}
+}
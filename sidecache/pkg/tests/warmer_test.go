@@ -0,0 +1,157 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/model"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+func TestReadWarmURLsFromListsAndAccessLogs(t *testing.T) {
+	input := strings.Join([]string{
+		"# recorded on monday",
+		"/products/1",
+		"http://shop.example.com/products/2?page=1",
+		`10.0.0.1 - - [10/Oct/2021:13:55:36 +0000] "GET /products/3 HTTP/1.1" 200 512 "-" "curl"`,
+		`10.0.0.1 - - [10/Oct/2021:13:55:37 +0000] "POST /products HTTP/1.1" 201 12 "-" "curl"`,
+		"/products/1",
+		"",
+		"products",
+	}, "\n")
+
+	urls := server.ReadWarmURLs(strings.NewReader(input))
+	expected := []string{"/products/1", "/products/2?page=1", "/products/3"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Errorf("expected %v, got %v", expected, urls)
+	}
+}
+
+func TestWarmFetchesUrlsIntoTheCache(t *testing.T) {
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	repo, err := cache.NewMemoryRepository(cache.MemoryOptions{MaxBytes: 1 << 20, Shards: 2}, metrics)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer repo.Close()
+
+	var requests int32
+	cacheServer := server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		atomic.AddInt32(&requests, 1)
+		if string(ctx.Path()) == "/broken" {
+			ctx.SetStatusCode(http.StatusInternalServerError)
+			return
+		}
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+
+	options := server.WarmOptions{URLs: []string{"/products/1", "/products/2", "/broken"}, Concurrency: 2}
+	progress, err := cacheServer.Warm(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if progress.Running || progress.Done != 3 || progress.Fetched != 2 || progress.Failed != 1 {
+		t.Errorf("unexpected progress %+v", progress)
+	}
+	waitFor(t, func() bool { return repo.Len() == 2 })
+
+	progress, _ = cacheServer.Warm(options)
+	if progress.Cached != 2 || atomic.LoadInt32(&requests) != 4 {
+		t.Errorf("expected the cached urls to be skipped, got %+v after %d requests", progress, requests)
+	}
+}
+
+func TestWarmIsRateLimited(t *testing.T) {
+	cacheServer, _ := newMemoryServer(t)
+
+	started := time.Now()
+	_, err := cacheServer.Warm(server.WarmOptions{
+		URLs:        []string{"/products/1", "/products/2", "/products/3", "/products/4", "/products/5"},
+		Concurrency: 5,
+		Rate:        50,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(started); elapsed < 90*time.Millisecond {
+		t.Errorf("expected 5 urls at 50/s to take at least 100ms, took %v", elapsed)
+	}
+}
+
+func TestWarmEndpoint(t *testing.T) {
+	release := make(chan struct{})
+	cacheServer := server.NewServer(cache.FromLegacy(newMemoryRepository()), newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		<-release
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metric.NewPrometheus(prometheus.NewRegistry()))
+	cacheServer.AdminToken = testAdminToken
+	handler := cacheServer.Handler()
+
+	post := func(body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI(server.WarmPath)
+		ctx.Request.Header.Set(server.AdminTokenHeaderKey, testAdminToken)
+		ctx.Request.SetBodyString(body)
+		handler(ctx)
+		return ctx
+	}
+
+	if ctx := post(`{"urls": ["/products/1", "/products/2"]}`); ctx.Response.StatusCode() != http.StatusAccepted {
+		t.Fatalf("expected warming to start, got %d %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx := post(`{"urls": ["/products/3"]}`); ctx.Response.StatusCode() != http.StatusConflict {
+		t.Errorf("expected a conflict while warming runs, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := post(`{}`); ctx.Response.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected a bad request without urls, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := post(`{"file": "` + writeURLFile(t, "/products/4") + `"}`); ctx.Response.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected a url file in the body to be ignored, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := post(`{"urls": ["/products/5"], "rate": 2000000000}`); ctx.Response.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected a rate beyond the maximum to be rejected, got %d", ctx.Response.StatusCode())
+	}
+	if ctx := post(`{"urls": ["/products/5"], "concurrency": 10000000}`); ctx.Response.StatusCode() != http.StatusBadRequest {
+		t.Errorf("expected a concurrency beyond the maximum to be rejected, got %d", ctx.Response.StatusCode())
+	}
+	close(release)
+
+	waitFor(t, func() bool {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.SetRequestURI(server.WarmPath)
+		ctx.Request.Header.Set(server.AdminTokenHeaderKey, testAdminToken)
+		handler(ctx)
+
+		var progress model.WarmProgress
+		if err := json.Unmarshal(ctx.Response.Body(), &progress); err != nil {
+			t.Fatal(err)
+		}
+		return !progress.Running && progress.Fetched == 2
+	})
+}
+
+func writeURLFile(t *testing.T, urls ...string) string {
+	file, err := ioutil.TempFile("", "sidecache-urls")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = os.Remove(file.Name()) })
+	_, _ = file.WriteString(strings.Join(urls, "\n"))
+	_ = file.Close()
+	return file.Name()
+}
@@ -0,0 +1,179 @@
+package tests
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Trendyol/sidecache/pkg/cache"
+	"github.com/Trendyol/sidecache/pkg/metric"
+	"github.com/Trendyol/sidecache/pkg/server"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/valyala/fasthttp"
+	"go.uber.org/zap"
+)
+
+// blockingRepository holds the first Set until release is closed, so the following writes queue up.
+type blockingRepository struct {
+	started chan struct{}
+	release chan struct{}
+	once    sync.Once
+
+	mu      sync.Mutex
+	sets    int
+	batches []int
+}
+
+func newBlockingRepository() *blockingRepository {
+	return &blockingRepository{started: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (repository *blockingRepository) Get(ctx context.Context, key string) ([]byte, error) {
+	return nil, cache.ErrNotFound
+}
+
+func (repository *blockingRepository) Set(ctx context.Context, key string, value []byte, ttl time.Duration) error {
+	repository.once.Do(func() {
+		close(repository.started)
+		<-repository.release
+	})
+	repository.mu.Lock()
+	repository.sets++
+	repository.mu.Unlock()
+	return nil
+}
+
+func (repository *blockingRepository) SetMany(ctx context.Context, entries []cache.Entry) error {
+	repository.mu.Lock()
+	repository.batches = append(repository.batches, len(entries))
+	repository.mu.Unlock()
+	return nil
+}
+
+func (repository *blockingRepository) Remove(ctx context.Context, key string) error {
+	return nil
+}
+
+func setWriteEnv(t *testing.T, workers, queueSize, batchSize int, flushTimeout string) {
+	values := map[string]string{
+		"WRITE_WORKERS":       strconv.Itoa(workers),
+		"WRITE_QUEUE_SIZE":    strconv.Itoa(queueSize),
+		"WRITE_BATCH_SIZE":    strconv.Itoa(batchSize),
+		"WRITE_FLUSH_TIMEOUT": flushTimeout,
+	}
+	for name, value := range values {
+		name := name
+		_ = os.Setenv(name, value)
+		t.Cleanup(func() { _ = os.Unsetenv(name) })
+	}
+}
+
+func newWriteServer(t *testing.T, repo cache.CacheRepository, metrics *metric.Prometheus) *server.CacheServer {
+	return server.NewServer(repo, newUpstream(t, func(ctx *fasthttp.RequestCtx) {
+		ctx.Response.Header.Set(server.CacheHeaderKey, "max-age=60")
+		ctx.SetBodyString("{}")
+	}), zap.NewNop(), metrics)
+}
+
+// fillBlocked serves the first url and waits until its fill holds the only worker.
+func fillBlocked(t *testing.T, cacheServer *server.CacheServer, repo *blockingRepository) {
+	serve(cacheServer, fasthttp.MethodGet, "/products/0")
+	select {
+	case <-repo.started:
+	case <-time.After(time.Second):
+		t.Fatal("expected the first fill to be written")
+	}
+}
+
+func TestFillsAreDroppedWhenTheWriteQueueIsFull(t *testing.T) {
+	setWriteEnv(t, 1, 2, 1, "1s")
+	repo := newBlockingRepository()
+	metrics := metric.NewPrometheus(prometheus.NewRegistry())
+	cacheServer := newWriteServer(t, repo, metrics)
+
+	fillBlocked(t, cacheServer, repo)
+	for i := 1; i <= 4; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/"+strconv.Itoa(i))
+	}
+
+	if drops := testutil.ToFloat64(metrics.CacheWriteDropCounter); drops != 2 {
+		t.Errorf("expected 2 dropped fills, got %v", drops)
+	}
+	if depth := testutil.ToFloat64(metrics.CacheWriteQueueDepthGauge); depth != 2 {
+		t.Errorf("expected 2 queued fills, got %v", depth)
+	}
+
+	close(repo.release)
+	if !cacheServer.FlushWrites() {
+		t.Fatal("expected the queued fills to be flushed")
+	}
+	if repo.sets != 3 {
+		t.Errorf("expected the blocked and the 2 queued fills to be written, got %d", repo.sets)
+	}
+	if depth := testutil.ToFloat64(metrics.CacheWriteQueueDepthGauge); depth != 0 {
+		t.Errorf("expected an empty queue after the flush, got %v", depth)
+	}
+}
+
+func TestQueuedFillsAreWrittenInBatches(t *testing.T) {
+	setWriteEnv(t, 1, 10, 3, "1s")
+	repo := newBlockingRepository()
+	cacheServer := newWriteServer(t, repo, metric.NewPrometheus(prometheus.NewRegistry()))
+
+	fillBlocked(t, cacheServer, repo)
+	for i := 1; i <= 4; i++ {
+		serve(cacheServer, fasthttp.MethodGet, "/products/"+strconv.Itoa(i))
+	}
+
+	close(repo.release)
+	if !cacheServer.FlushWrites() {
+		t.Fatal("expected the queued fills to be flushed")
+	}
+	// the last fill is alone in its batch and written with Set
+	if len(repo.batches) != 1 || repo.batches[0] != 3 || repo.sets != 2 {
+		t.Errorf("expected one batch of 3 and 2 single writes, got batches %v and %d sets", repo.batches, repo.sets)
+	}
+}
+
+func TestFlushGivesUpAfterTheTimeout(t *testing.T) {
+	setWriteEnv(t, 1, 10, 1, "50ms")
+	repo := newBlockingRepository()
+	defer close(repo.release)
+	cacheServer := newWriteServer(t, repo, metric.NewPrometheus(prometheus.NewRegistry()))
+
+	fillBlocked(t, cacheServer, repo)
+	if cacheServer.FlushWrites() {
+		t.Error("expected the flush to time out while a write is blocked")
+	}
+}
+
+func TestMalformedServerEnvIsRejected(t *testing.T) {
+	if err := server.ValidateEnv(); err != nil {
+		t.Fatalf("expected the defaults to be valid, got %v", err)
+	}
+
+	setRefreshEnv(t, map[string]string{"WRITE_WORKERS": "abc", "CACHE_TTL_JITTER": "1.5", "REFRESH_MAX_KEYS": "0"})
+	err := server.ValidateEnv()
+	if err == nil || !strings.Contains(err.Error(), "WRITE_WORKERS") || !strings.Contains(err.Error(), "CACHE_TTL_JITTER") {
+		t.Errorf("expected an error naming the malformed variables, got %v", err)
+	}
+	if strings.Contains(err.Error(), "REFRESH_MAX_KEYS") {
+		t.Errorf("expected zero to disable tracking the hits, got %v", err)
+	}
+
+	for _, rate := range []string{"fast", "2000000000"} {
+		setRefreshEnv(t, map[string]string{"WARM_RATE": rate})
+		if _, err := server.WarmOptionsFromEnv(); err == nil || !strings.Contains(err.Error(), "WARM_RATE") {
+			t.Errorf("expected an error naming the malformed variable, got %v", err)
+		}
+	}
+	setRefreshEnv(t, map[string]string{"WARM_CONCURRENCY": "10000000"})
+	if _, err := server.WarmOptionsFromEnv(); err == nil || !strings.Contains(err.Error(), "WARM_CONCURRENCY") {
+		t.Errorf("expected a concurrency beyond the maximum to be rejected, got %v", err)
+	}
+}